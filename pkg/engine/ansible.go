@@ -27,27 +27,31 @@ func (ans *Ansible) GetKind() string {
 func (ans *Ansible) Process(ctx, conn context.Context, skew int) {
 	time.Sleep(time.Duration(skew) * time.Millisecond)
 	target := ans.GetTarget()
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	log := target.logger()
+	defer target.lockRun(ans)()
 
-	tag := []string{"yaml", "yml"}
+	tag := ans.fileTags([]string{"yaml", "yml"})
 	if ans.initialRun {
-		err := getRepo(target)
+		err := target.retry(ctx, "clone "+target.url, func() error { return getRepo(target) })
 		if err != nil {
-			logger.Errorf("Failed to clone repository %s: %v", target.url, err)
+			log.Errorf("Failed to clone repository %s: %v", target.url, err)
 			return
 		}
 
-		err = zeroToCurrent(ctx, conn, ans, target, &tag)
+		err = target.retry(ctx, "move to current", func() error {
+			return zeroToCurrent(ctx, conn, ans, target, tag)
+		})
 		if err != nil {
-			logger.Errorf("Error moving to current: %v", err)
+			log.Errorf("Error moving to current: %v", err)
 			return
 		}
 	}
 
-	err := currentToLatest(ctx, conn, ans, target, &tag)
+	err := target.retry(ctx, "move current to latest", func() error {
+		return currentToLatest(ctx, conn, ans, target, tag)
+	})
 	if err != nil {
-		logger.Errorf("Error moving current to latest: %v", err)
+		log.Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
@@ -59,7 +63,7 @@ func (ans *Ansible) MethodEngine(ctx context.Context, conn context.Context, chan
 }
 
 func (ans *Ansible) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
-	changeMap, err := applyChanges(ctx, ans.GetTarget(), ans.GetTargetPath(), ans.Glob, currentState, desiredState, tags)
+	changeMap, err := applyChanges(ctx, &ans.CommonMethod, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
@@ -70,17 +74,18 @@ func (ans *Ansible) Apply(ctx, conn context.Context, currentState, desiredState
 }
 
 func (ans *Ansible) ansiblePodman(ctx, conn context.Context, path string) error {
+	log := ans.GetTarget().logger()
 	// TODO: add logic to remove
 	if path == deleteFile {
 		return nil
 	}
-	logger.Infof("Deploying Ansible playbook %s", path)
+	log.Infof("Deploying Ansible playbook %s", path)
 
 	copyFile := ("/opt/" + path)
 	sshImage := "quay.io/fetchit/fetchit-ansible:latest"
 
-	logger.Infof("Identifying if fetchit-ansible image exists locally")
-	if err := detectOrFetchImage(conn, sshImage, true); err != nil {
+	log.Infof("Identifying if fetchit-ansible image exists locally")
+	if err := detectOrFetchImage(conn, sshImage, pullAlways, nil); err != nil {
 		return err
 	}
 
@@ -104,7 +109,7 @@ func (ans *Ansible) ansiblePodman(ctx, conn context.Context, path string) error
 	if err != nil {
 		return err
 	}
-	logger.Infof("Container created.")
+	log.Infof("Container created.")
 	if err := containers.Start(conn, createResponse.ID, nil); err != nil {
 		return err
 	}
@@ -113,6 +118,6 @@ func (ans *Ansible) ansiblePodman(ctx, conn context.Context, path string) error
 	if err != nil {
 		return err
 	}
-	logger.Infof("Container started....Requeuing")
+	log.Infof("Container started....Requeuing")
 	return nil
 }
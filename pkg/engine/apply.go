@@ -10,14 +10,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/containers/fetchit/pkg/engine/utils"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
-	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/gobwas/glob"
 	gitsign "github.com/sigstore/gitsign/pkg/git"
 	gitsignrekor "github.com/sigstore/gitsign/pkg/rekor"
@@ -27,13 +27,31 @@ import (
 const (
 	defaultRekorURL = "https://rekor.sigstore.dev"
 	hashReportLen   = 9
+	// symlinksFollow resolves symlinked files within the repository (default)
+	symlinksFollow = "follow"
+	// symlinksSkip ignores symlinked files entirely
+	symlinksSkip = "skip"
+	// maxDeepenDepth is the deepest a shallow clone is deepened to incrementally,
+	// beyond it the full history is fetched
+	maxDeepenDepth = 4096
+	// unshallowDepth fetches the full history, as git fetch --unshallow does
+	unshallowDepth = 2147483647
 )
 
-func applyChanges(ctx context.Context, target *Target, targetPath string, globPattern *string, currentState, desiredState plumbing.Hash, tags *[]string) (map[*object.Change]string, error) {
+func applyChanges(ctx context.Context, m *CommonMethod, currentState, desiredState plumbing.Hash, tags *[]string) (map[*object.Change]string, error) {
 	if desiredState.IsZero() {
 		return nil, errors.New("Cannot run Apply if desired state is empty")
 	}
-	directory := getDirectory(target)
+	directory := getDirectory(m.target)
+
+	targetPath, err := resolveTargetPath(directory, m.TargetPath)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error resolving target path %s", m.TargetPath)
+	}
+
+	if err := ensureCommit(m.target, currentState); err != nil {
+		return nil, err
+	}
 
 	currentTree, err := getSubTreeFromHash(directory, currentState, targetPath)
 	if err != nil {
@@ -45,7 +63,7 @@ func applyChanges(ctx context.Context, target *Target, targetPath string, globPa
 		return nil, utils.WrapErr(err, "Error getting tree from hash %s", desiredState)
 	}
 
-	changeMap, err := getFilteredChangeMap(directory, targetPath, globPattern, currentTree, desiredTree, tags)
+	changeMap, err := getFilteredChangeMap(directory, targetPath, m.Glob, m.Symlinks, currentTree, desiredTree, tags, m.target.submodules)
 	if err != nil {
 		return nil, utils.WrapErr(err, "Error getting filtered change map from %s to %s", currentState, desiredState)
 	}
@@ -53,80 +71,221 @@ func applyChanges(ctx context.Context, target *Target, targetPath string, globPa
 	return changeMap, nil
 }
 
-//getLatest will get the head of the branch in the repository specified by the target's url
-func getLatest(target *Target) (plumbing.Hash, error) {
-	ctx := context.Background()
-	directory := getDirectory(target)
+// refName describes the ref a target follows, for logs and errors
+func (t *Target) refName() string {
+	switch {
+	case t.revision != "":
+		return "revision " + t.revision
+	case t.tag != "":
+		return "tag " + t.tag
+	default:
+		return "branch " + t.branch
+	}
+}
 
-	repo, err := git.PlainOpen(directory)
-	if err != nil {
-		return plumbing.Hash{}, utils.WrapErr(err, "Error opening repository %s to fetch latest commit", directory)
+// ref returns the branch, tag or revision a target follows
+func (t *Target) ref() string {
+	switch {
+	case t.revision != "":
+		return t.revision
+	case t.tag != "":
+		return t.tag
+	default:
+		return t.branch
 	}
-	if target.envSecret != "" {
-		logger.Infof("Using the envSecret %s", target.envSecret)
-		target.pat = os.Getenv(target.envSecret)
+}
+
+// cloneReference returns the reference cloned for the target, the remote HEAD
+// is cloned for a revision without a branch
+func (t *Target) cloneReference() plumbing.ReferenceName {
+	switch {
+	case t.tag != "":
+		return plumbing.NewTagReferenceName(t.tag)
+	case t.branch != "":
+		return plumbing.NewBranchReferenceName(t.branch)
+	default:
+		return ""
 	}
-	if target.pat != "" {
-		target.username = "fetchit"
-		target.password = target.pat
+}
+
+// fetchOptions returns the options to fetch the target's branch or tag, a depth of 0 fetches all new history
+func fetchOptions(target *Target, depth int) (*git.FetchOptions, error) {
+	auth, err := gitAuth(target)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := gitProxy(target)
+	if err != nil {
+		return nil, err
 	}
 
-	refSpec := config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/heads/%s", target.branch, target.branch))
+	refSpecs := []config.RefSpec{"HEAD:refs/heads/HEAD"}
+	if ref := target.cloneReference(); ref != "" {
+		refSpecs = append([]config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))}, refSpecs...)
+	}
 
 	// default to using existing http method
 	fOptions := &git.FetchOptions{
-		RemoteName: "",
-		RefSpecs:   []config.RefSpec{refSpec, "HEAD:refs/heads/HEAD"},
-		Depth:      0,
-		Auth: &githttp.BasicAuth{
-			Username: target.username,
-			Password: target.password,
-		},
+		RemoteName:      "",
+		RefSpecs:        refSpecs,
+		Depth:           depth,
+		Auth:            auth,
 		Progress:        nil,
 		Tags:            0,
 		Force:           true,
-		InsecureSkipTLS: false,
-		CABundle:        []byte{},
+		InsecureSkipTLS: target.insecureSkipTLS,
+		CABundle:        target.caBundle,
+		ProxyOptions:    proxy,
+	}
+	return fOptions, nil
+}
+
+// ensureCommit deepens a shallow clone until it contains the commit with the given
+// hash, so that changes from that commit can be calculated
+func ensureCommit(target *Target, hash plumbing.Hash) error {
+	if hash.IsZero() || target.url == "" || target.disconnected {
+		return nil
 	}
-	// if using ssh, change auth to use ssh key
-	if target.ssh {
-		logger.Infof("git clone %s using SSH key %s ", target.url, target.sshKey)
-		authValue, err := ssh.NewPublicKeysFromFile("git", target.sshKey, target.password)
+	directory := getDirectory(target)
+	repo, err := git.PlainOpen(directory)
+	if err != nil {
+		return utils.WrapErr(err, "Error opening repository %s", directory)
+	}
+	if _, err := repo.CommitObject(hash); err != plumbing.ErrObjectNotFound {
+		return nil
+	}
+	shallow, err := repo.Storer.Shallow()
+	if err != nil || len(shallow) == 0 {
+		return nil
+	}
+
+	// Methods sharing the clone may deepen it at once
+	target.fetchMu.Lock()
+	defer target.fetchMu.Unlock()
+	if _, err := repo.CommitObject(hash); err == nil {
+		return nil
+	}
+	depth := target.depth
+	if depth < 1 {
+		depth = 1
+	}
+	for depth < unshallowDepth {
+		depth *= 2
+		if depth > maxDeepenDepth {
+			depth = unshallowDepth
+		}
+		logger.Infof("Commit %s is missing from the shallow clone of %s, deepening to %d commits", hash.String()[:hashReportLen], target.url, depth)
+		fOptions, err := fetchOptions(target, depth)
 		if err != nil {
-			logger.Infof("generate publickeys failed: %s", err.Error())
-			return plumbing.Hash{}, err
+			return err
+		}
+		if err := repo.Fetch(fOptions); err != nil && err != git.NoErrAlreadyUpToDate {
+			return utils.WrapErr(err, "Error deepening clone of %s", target.url)
+		}
+		if _, err := repo.CommitObject(hash); err == nil {
+			return nil
 		}
-		fOptions.Auth = authValue
-	}
-	if err = repo.Fetch(fOptions); err != nil && err != git.NoErrAlreadyUpToDate && !target.disconnected {
-		return plumbing.Hash{}, utils.WrapErr(err, "Error fetching branch %s from remote repository %s", target.branch, target.url)
 	}
+	return fmt.Errorf("commit %s not found in %s after fetching its full history", hash, target.url)
+}
 
-	branch, err := repo.Reference(plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", target.branch)), false)
+// getLatest will get the head of the branch or tag, or the fixed revision, in the repository specified by the target's url
+func getLatest(target *Target) (plumbing.Hash, error) {
+	ctx := context.Background()
+	directory := getDirectory(target)
+
+	repo, err := git.PlainOpen(directory)
+	if err != nil && target.url != "" && !target.disconnected {
+		// The clone is missing or was damaged since the first run, clone it again
+		if err := getClone(target); err != nil {
+			return plumbing.Hash{}, utils.WrapErr(err, "Error cloning repository %s", target.url)
+		}
+		repo, err = git.PlainOpen(directory)
+	}
 	if err != nil {
-		return plumbing.Hash{}, utils.WrapErr(err, "Error getting reference to branch %s", target.branch)
+		return plumbing.Hash{}, utils.WrapErr(err, "Error opening repository %s to fetch latest commit", directory)
+	}
+
+	// A fixed revision never moves, so the remote is only fetched until it is present
+	latest, err := resolveRef(target, repo)
+	if target.revision == "" || err != nil {
+		fOptions, err := fetchOptions(target, 0)
+		if err != nil {
+			return plumbing.Hash{}, err
+		}
+		if err = repo.Fetch(fOptions); err != nil && err != git.NoErrAlreadyUpToDate && !target.disconnected {
+			return plumbing.Hash{}, utils.WrapErr(err, "Error fetching %s from remote repository %s", target.refName(), target.url)
+		}
+		if latest, err = resolveRef(target, repo); err != nil {
+			return plumbing.Hash{}, err
+		}
 	}
 
 	wt, err := repo.Worktree()
 	if err != nil {
-		return plumbing.Hash{}, utils.WrapErr(err, "Error getting reference to worktree for repository", directory)
+		return plumbing.Hash{}, utils.WrapErr(err, "Error getting reference to worktree for repository %s", directory)
 	}
 
-	hashStr := branch.Hash().String()[:hashReportLen]
-	if err := wt.Checkout(&git.CheckoutOptions{Hash: branch.Hash()}); err != nil {
-		return plumbing.Hash{}, utils.WrapErr(err, "Error checking out %s on branch %s", hashStr, target.branch)
+	hashStr := latest.String()[:hashReportLen]
+	// Verify the commit before it is checked out, so an unverified commit never
+	// reaches the files methods deploy from
+	if target.gitsignVerify || target.commitKeys != nil {
+		commit, err := repo.CommitObject(latest)
+		if err != nil {
+			return plumbing.Hash{}, utils.WrapErr(err, "Error getting verified commit at hash %s from repository %s", hashStr, directory)
+		}
+		if target.gitsignVerify {
+			if err := VerifyGitsign(ctx, commit, hashStr, directory, target.gitsignRekorURL); err != nil {
+				return plumbing.Hash{}, utils.WrapErr(err, "Requested verified commit signatures, but commit %s from repository %s failed verification", hashStr, directory)
+			}
+		} else if err := verifyCommitSignature(commit, target.commitKeys); err != nil {
+			return plumbing.Hash{}, utils.WrapErrClass(utils.ErrValidation, err, "Refusing to deploy commit %s of %s, its signature is not from an allowed key", hashStr, target.refName())
+		}
+	}
+
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: latest}); err != nil {
+		return plumbing.Hash{}, utils.WrapErr(err, "Error checking out %s of %s", hashStr, target.refName())
+	}
+	if target.submodules {
+		if err := updateSubmodules(target, wt); err != nil {
+			return plumbing.Hash{}, err
+		}
 	}
+	return latest, err
+}
 
-	if target.gitsignVerify {
-		commit, err := repo.CommitObject(branch.Hash())
+// resolveRef returns the commit of the ref the target follows in the local
+// clone, a full hash revision missing from a shallow clone is fetched
+func resolveRef(target *Target, repo *git.Repository) (plumbing.Hash, error) {
+	switch {
+	case target.revision != "":
+		if hash, err := repo.ResolveRevision(plumbing.Revision(target.revision)); err == nil {
+			return *hash, nil
+		}
+		if plumbing.IsHash(target.revision) {
+			hash := plumbing.NewHash(target.revision)
+			if err := ensureCommit(target, hash); err == nil {
+				if _, err := repo.CommitObject(hash); err == nil {
+					return hash, nil
+				}
+			}
+		}
+		return plumbing.Hash{}, utils.Classify(utils.ErrNotFound, fmt.Errorf("revision %s does not exist in %s", target.revision, target.url))
+	case target.tag != "":
+		hash, err := repo.ResolveRevision(plumbing.Revision(plumbing.NewTagReferenceName(target.tag)))
 		if err != nil {
-			return plumbing.Hash{}, utils.WrapErr(err, "Error getting verified commit at hash %s from repository %s", hashStr, directory)
+			return plumbing.Hash{}, utils.Classify(utils.ErrNotFound, fmt.Errorf("tag %s does not exist in %s", target.tag, target.url))
 		}
-		if err := VerifyGitsign(ctx, commit, hashStr, directory, target.gitsignRekorURL); err != nil {
-			return plumbing.Hash{}, utils.WrapErr(err, "Requested verified commit signatures, but commit %s from repository %s failed verification", hashStr, directory)
+		return *hash, nil
+	default:
+		branch, err := repo.Reference(plumbing.NewBranchReferenceName(target.branch), false)
+		if err == plumbing.ErrReferenceNotFound {
+			return plumbing.Hash{}, utils.Classify(utils.ErrNotFound, fmt.Errorf("branch %s does not exist in %s", target.branch, target.url))
+		} else if err != nil {
+			return plumbing.Hash{}, utils.WrapErr(err, "Error getting reference to branch %s", target.branch)
 		}
+		return branch.Hash(), nil
 	}
-	return branch.Hash(), err
 }
 
 // VerifyGitsign verifies any commit signed using sigstore/gitsign & rekor
@@ -260,33 +419,72 @@ func getFilteredChangeMap(
 	directory,
 	targetPath string,
 	globPattern *string,
+	symlinks string,
 	currentTree,
 	desiredTree *object.Tree,
 	tags *[]string,
+	submodules bool,
 ) (map[*object.Change]string, error) {
 
 	changes, err := currentTree.Diff(desiredTree)
 	if err != nil {
-		return nil, utils.WrapErr(err, "Error getting diff between current and latest", targetPath)
+		return nil, utils.WrapErr(err, "Error getting diff between current and latest for %s", targetPath)
+	}
+	if submodules {
+		repo, err := git.PlainOpen(directory)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error opening repository %s to read submodules", directory)
+		}
+		if changes, err = expandSubmodules(repo.Storer, filepath.ToSlash(targetPath), changes); err != nil {
+			return nil, err
+		}
 	}
 
 	var g glob.Glob
 	if globPattern == nil {
 		g, err = glob.Compile("**")
 		if err != nil {
-			return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", globPattern)
+			return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", "**")
 		}
 	} else {
 		g, err = glob.Compile(*globPattern)
 		if err != nil {
-			return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", globPattern)
+			return nil, utils.WrapErr(err, "Error compiling glob for pattern %s", *globPattern)
 		}
 	}
 
+	// The ignore file of the desired commit applies to both added and removed files
+	ignore, err := ignoreMatcher(desiredTree)
+	if err != nil {
+		return nil, err
+	}
+
 	changeMap := make(map[*object.Change]string)
 	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		if isIgnored(ignore, name) {
+			continue
+		}
 		if change.To.Name != "" && checkTag(tags, change.To.Name) && g.Match(change.To.Name) {
 			path := filepath.Join(directory, targetPath, change.To.Name)
+			if change.To.TreeEntry.Mode == filemode.Symlink {
+				if symlinks == symlinksSkip {
+					logger.Infof("Skipping symlinked file %s", path)
+					continue
+				}
+				resolved, err := resolveInRepo(directory, path)
+				if err != nil {
+					return nil, utils.WrapErr(err, "Error resolving symlinked file %s", change.To.Name)
+				}
+				if info, err := os.Stat(resolved); err == nil && info.IsDir() {
+					logger.Infof("Skipping symlinked file %s, it resolves to directory %s", path, resolved)
+					continue
+				}
+				path = resolved
+			}
 			changeMap[change] = path
 		} else if change.From.Name != "" && checkTag(tags, change.From.Name) && g.Match(change.From.Name) {
 			changeMap[change] = deleteFile
@@ -296,6 +494,57 @@ func getFilteredChangeMap(
 	return changeMap, nil
 }
 
+// resolveTargetPath resolves any symlinks within the target path and returns
+// the resulting path relative to the repository root. A target path which no
+// longer exists on disk is returned unchanged.
+func resolveTargetPath(directory, targetPath string) (string, error) {
+	if targetPath == "" {
+		return targetPath, nil
+	}
+	if _, err := os.Lstat(filepath.Join(directory, targetPath)); os.IsNotExist(err) {
+		return targetPath, nil
+	}
+	return repoRelPath(directory, filepath.Join(directory, targetPath))
+}
+
+// resolveInRepo resolves any symlinks in path and returns the resolved path
+// joined onto the repository directory. Paths resolving outside of the
+// repository are rejected.
+func resolveInRepo(directory, path string) (string, error) {
+	rel, err := repoRelPath(directory, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(directory, rel), nil
+}
+
+func repoRelPath(directory, path string) (string, error) {
+	root, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s resolves to %s which is outside of repository %s", path, resolved, directory)
+	}
+	return rel, nil
+}
+
 func checkTag(tags *[]string, name string) bool {
 	if tags == nil {
 		return true
@@ -308,7 +557,13 @@ func checkTag(tags *[]string, name string) bool {
 	return false
 }
 
+// changeReadMu serializes reads of previous file contents from the repository,
+// which go-git does not guarantee are safe while files are deployed at once
+var changeReadMu sync.Mutex
+
 func getChangeString(change *object.Change) (*string, error) {
+	changeReadMu.Lock()
+	defer changeReadMu.Unlock()
 	if change != nil {
 		from, _, err := change.Files()
 		if err != nil {
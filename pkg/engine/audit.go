@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/natefinch/lumberjack"
+)
+
+const (
+	// defaultAuditMaxSize is the size in megabytes at which the audit log is rotated
+	defaultAuditMaxSize = 10
+	// defaultAuditMaxBackups is how many rotated audit logs are kept
+	defaultAuditMaxBackups = 5
+)
+
+// Kinds of objects in audit records
+const (
+	auditFile      = "file"
+	auditContainer = "container"
+	auditPod       = "pod"
+)
+
+// AuditLog appends a JSON line to a file for every file fetchit applies and
+// every container and pod it creates, starts, stops or removes, regardless of
+// the log level
+type AuditLog struct {
+	// Path of the audit log, a relative path is relative to /opt/mount
+	Path string `mapstructure:"path"`
+	// MaxSize in megabytes at which the log is rotated, defaults to 10
+	MaxSize int `mapstructure:"maxSize"`
+	// MaxBackups is how many rotated logs are kept, defaults to 5
+	MaxBackups int `mapstructure:"maxBackups"`
+}
+
+// AuditRecord is a line of the audit log
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target,omitempty"`
+	Method string    `json:"method,omitempty"`
+	Commit string    `json:"commit,omitempty"`
+	File   string    `json:"file,omitempty"`
+	// Kind is file, container or pod
+	Kind  string `json:"kind"`
+	Name  string `json:"name,omitempty"`
+	Image string `json:"image,omitempty"`
+	// Action is create, update, rename or delete for a file, and create,
+	// start, stop or remove for a container or pod
+	Action string `json:"action"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// auditLog is the audit log writer, nil when auditing is off
+var (
+	auditLog   io.WriteCloser
+	auditLogMu sync.Mutex
+)
+
+// setAuditLog opens the configured audit log, replacing any open one
+func setAuditLog(config *AuditLog) {
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	if auditLog != nil {
+		auditLog.Close()
+		auditLog = nil
+	}
+	if config == nil || config.Path == "" {
+		return
+	}
+	path := config.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("/opt", "mount", path)
+	}
+	w := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    config.MaxSize,
+		MaxBackups: config.MaxBackups,
+	}
+	if w.MaxSize <= 0 {
+		w.MaxSize = defaultAuditMaxSize
+	}
+	if w.MaxBackups <= 0 {
+		w.MaxBackups = defaultAuditMaxBackups
+	}
+	auditLog = w
+}
+
+// writeAudit appends a record to the audit log
+func writeAudit(record AuditRecord) {
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	if auditLog == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.Errorf("Error encoding audit record: %v", err)
+		return
+	}
+	if _, err := auditLog.Write(append(line, '\n')); err != nil {
+		logger.Errorf("Error writing audit log: %v", err)
+	}
+}
+
+// auditScope is what the podman connection of a deploy is acting for
+type auditScope struct {
+	target, method, commit, file string
+}
+
+type auditScopeKey struct{}
+
+// auditConn returns conn carrying the target, method, commit and file it
+// deploys, which are added to the audit records of containers and pods
+// changed through it
+func auditConn(ctx, conn context.Context, m Method, file string) context.Context {
+	auditLogMu.Lock()
+	enabled := auditLog != nil
+	auditLogMu.Unlock()
+	if !enabled {
+		return conn
+	}
+	scope := auditScope{method: metricsMethod(m), file: file}
+	if t := m.GetTarget(); t != nil {
+		scope.target = t.displayName()
+	}
+	if result := reconcileResultFrom(ctx); result != nil {
+		scope.commit = result.Commit
+	}
+	return context.WithValue(conn, auditScopeKey{}, scope)
+}
+
+// audit records an action on a file, container or pod
+func audit(conn context.Context, kind, name, image, action string, err error) {
+	record := AuditRecord{Kind: kind, Name: name, Image: image, Action: action, Result: resultOf(err)}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if conn != nil {
+		if scope, ok := conn.Value(auditScopeKey{}).(auditScope); ok {
+			record.Target, record.Method, record.Commit, record.File = scope.target, scope.method, scope.commit, scope.file
+		}
+	}
+	writeAudit(record)
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	setAuditLog(&AuditLog{Path: path})
+	defer setAuditLog(nil)
+
+	r := &Raw{CommonMethod: CommonMethod{Name: "apps", target: &Target{name: "edge"}}}
+	ctx := context.WithValue(context.Background(), reconcileResultKey{}, &ReconcileResult{Commit: "4b825dc"})
+	conn := auditConn(ctx, context.Background(), r, "web.yaml")
+	audit(conn, auditContainer, "web", "docker.io/library/nginx:latest", "create", nil)
+	audit(conn, auditContainer, "web", "", "start", errors.New("port is in use"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Failed: wrote %d records, want 2", len(lines))
+	}
+	var records []AuditRecord
+	for _, line := range lines {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed: record %s is not JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	want := AuditRecord{Target: "edge", Method: "raw/apps", Commit: "4b825dc", File: "web.yaml", Kind: "container", Name: "web", Image: "docker.io/library/nginx:latest", Action: "create", Result: "success"}
+	got := records[0]
+	got.Time = time.Time{}
+	if got != want {
+		t.Errorf("Failed: got %+v, want %+v", got, want)
+	}
+	if records[0].Time.IsZero() {
+		t.Errorf("Failed: record has no time")
+	}
+	if records[1].Result == "success" || records[1].Error != "port is in use" {
+		t.Errorf("Failed: failed start recorded as %+v", records[1])
+	}
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+// loadCABundle reads the PEM bundle of a caFile, a relative path is relative
+// to /opt/mount like the other files of a target
+func loadCABundle(path string) ([]byte, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("/opt", "mount", path)
+	}
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, utils.WrapErrClass(utils.ErrValidation, err, "Error reading caFile %s", path)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+		return nil, utils.Classify(utils.ErrValidation, fmt.Errorf("caFile %s holds no PEM certificates", path))
+	}
+	return bundle, nil
+}
+
+// caCertDir writes the target's CA bundle to a directory containers/image reads
+// as the certs.d directory of a registry, so the registry is trusted when an
+// image signature is verified. The directory is named after the bundle, so a
+// reloaded config reuses it.
+func caCertDir(t *Target) (string, error) {
+	if len(t.caBundle) == 0 {
+		return "", nil
+	}
+	sum := sha256.Sum256(t.caBundle)
+	dir := filepath.Join(os.TempDir(), "fetchit-certs", hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), t.caBundle, 0600); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
@@ -30,8 +30,11 @@ func (p *Prune) GetName() string {
 func (p *Prune) Process(ctx, conn context.Context, skew int) {
 	target := p.GetTarget()
 	time.Sleep(time.Duration(skew) * time.Millisecond)
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	defer target.lockRun(p)()
+	if target.dryRun {
+		logger.Infof("Dry run: would prune podman, all images: %t, volumes: %t", p.All, p.Volumes)
+		return
+	}
 	// Nothing to do with certain file we're just collecting garbage so can call the prunePodman method straight from here
 	opts := system.PruneOptions{
 		All:     &p.All,
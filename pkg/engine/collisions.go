@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// hostBinding is a host port bound for one protocol
+type hostBinding struct {
+	ip       string
+	port     uint16
+	protocol string
+}
+
+// validateCollisions checks every raw file of the target's raw methods at the
+// desired commit for container names and host ports used by more than one
+// file, so that a conflict is reported before any container is changed.
+// Conflicts between the files of the other methods are left to them.
+func (r *Raw) validateCollisions(ctx context.Context, desiredState plumbing.Hash, tags *[]string) error {
+	methods := []*Raw{r}
+	if target := r.GetTarget(); target != nil {
+		for _, other := range target.raws {
+			if other != r {
+				methods = append(methods, other)
+			}
+		}
+	}
+
+	names := map[string]string{}
+	podNames := map[string]string{}
+	ports := map[hostBinding]string{}
+	// own holds the files of r, which are checked first
+	own := map[string]bool{}
+	var conflicts []string
+	for _, m := range methods {
+		methodTags := tags
+		if m != r {
+			methodTags = m.fileTags(rawTags)
+		}
+		all, err := applyChanges(ctx, &m.CommonMethod, plumbing.ZeroHash, desiredState, methodTags)
+		if err != nil {
+			if m != r {
+				continue
+			}
+			return err
+		}
+		for change := range all {
+			_, to, err := change.Files()
+			if err != nil || to == nil {
+				continue
+			}
+			contents, err := to.Contents()
+			if err != nil {
+				return utils.WrapErr(err, "Error reading %s", change.To.Name)
+			}
+			raw, err := m.parseRawPod([]byte(contents), change.To.Name)
+			if err != nil {
+				// The files of the other methods are reported by their own reconciles
+				if m != r {
+					continue
+				}
+				return err
+			}
+			if !raw.enabled() {
+				continue
+			}
+			file := change.To.Name
+			if m == r {
+				own[file] = true
+			} else {
+				file = fmt.Sprintf("%s of raw method %s", file, m.Name)
+			}
+
+			for _, name := range raw.containerNames() {
+				if other, ok := names[name]; ok && own[other] {
+					conflicts = append(conflicts, fmt.Sprintf("container name %s is used by both %s and %s", name, other, file))
+				} else if !ok {
+					names[name] = file
+				}
+			}
+			if raw.isPod() {
+				if other, ok := podNames[raw.Pod]; ok && own[other] {
+					conflicts = append(conflicts, fmt.Sprintf("pod name %s is used by both %s and %s", raw.Pod, other, file))
+				} else if !ok {
+					podNames[raw.Pod] = file
+				}
+			}
+			for _, b := range hostBindings(raw.Ports) {
+				if other, ok := findBinding(ports, b); ok && other != file {
+					if own[other] {
+						conflicts = append(conflicts, fmt.Sprintf("host port %d/%s is bound by both %s and %s", b.port, b.protocol, other, file))
+					}
+					continue
+				}
+				ports[b] = file
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("conflicting files in %s: %s", r.TargetPath, strings.Join(conflicts, "; ")))
+	}
+	return nil
+}
+
+// hostBindings expands port mappings into each host port and protocol they bind
+func hostBindings(mappings []port) []hostBinding {
+	var result []hostBinding
+	for _, p := range mappings {
+		// podman assigns a free host port when none is given
+		if p.HostPort == 0 {
+			continue
+		}
+		size := p.Range
+		if size == 0 {
+			size = 1
+		}
+		protocols := strings.Split(p.Protocol, ",")
+		for _, proto := range protocols {
+			proto = strings.ToLower(strings.TrimSpace(proto))
+			if proto == "" {
+				proto = "tcp"
+			}
+			for i := uint16(0); i < size; i++ {
+				result = append(result, hostBinding{ip: p.HostIP, port: p.HostPort + i, protocol: proto})
+			}
+		}
+	}
+	return result
+}
+
+// findBinding returns the file binding the same port and protocol as b on an
+// overlapping address, an empty address binds every address
+func findBinding(bindings map[hostBinding]string, b hostBinding) (string, bool) {
+	for existing, file := range bindings {
+		if existing.port != b.port || existing.protocol != b.protocol {
+			continue
+		}
+		if existing.ip == "" || b.ip == "" || existing.ip == b.ip {
+			return file, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	sshSignatureMagic     = "SSHSIG"
+	sshSignatureNamespace = "git"
+)
+
+// commitKeys are the keys allowed to sign the commits a target deploys
+type commitKeys struct {
+	// gpgKeyring is an armored keyring of GPG public keys
+	gpgKeyring string
+	// sshSigners are SSH public keys
+	sshSigners []gossh.PublicKey
+}
+
+func (k *commitKeys) empty() bool {
+	return k == nil || (k.gpgKeyring == "" && len(k.sshSigners) == 0)
+}
+
+// signingKeyPath resolves a key file of verifyCommitsInfo, a relative path is
+// relative to /opt/mount like the other files of a target
+func signingKeyPath(path string) string {
+	if !filepath.IsAbs(path) {
+		return filepath.Join("/opt", "mount", path)
+	}
+	return path
+}
+
+// loadCommitKeys reads the GPG keyring and SSH allowed signers a target's
+// commits must be signed with
+func loadCommitKeys(info *VerifyCommitsInfo) (*commitKeys, error) {
+	keys := &commitKeys{}
+	if info.GPGKeyring != "" {
+		path := signingKeyPath(info.GPGKeyring)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Error reading gpgKeyring %s", path)
+		}
+		if _, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b)); err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Error parsing gpgKeyring %s, it must be an armored public keyring", path)
+		}
+		keys.gpgKeyring = string(b)
+	}
+	if info.SSHAllowedSigners != "" {
+		path := signingKeyPath(info.SSHAllowedSigners)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Error reading sshAllowedSigners %s", path)
+		}
+		if keys.sshSigners, err = parseAllowedSigners(b); err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Error parsing sshAllowedSigners %s", path)
+		}
+	}
+	return keys, nil
+}
+
+// parseAllowedSigners parses SSH public keys, one per line, in the
+// authorized_keys format or the allowed_signers format of git's
+// gpg.ssh.allowedSignersFile, whose principals and options are ignored
+func parseAllowedSigners(b []byte) ([]gossh.PublicKey, error) {
+	var signers []gossh.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		for fields := strings.Fields(line); err != nil && len(fields) > 1; fields = fields[1:] {
+			key, _, _, _, err = gossh.ParseAuthorizedKey([]byte(strings.Join(fields[1:], " ")))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d is not an SSH public key", n)
+		}
+		signers = append(signers, key)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH public keys found")
+	}
+	return signers, scanner.Err()
+}
+
+// verifyCommitSignature checks that a commit has a GPG or SSH signature made
+// by one of the allowed keys
+func verifyCommitSignature(commit *object.Commit, keys *commitKeys) error {
+	hashStr := commit.Hash.String()[:hashReportLen]
+	if commit.PGPSignature == "" {
+		return fmt.Errorf("commit %s is not signed", hashStr)
+	}
+	if strings.HasPrefix(commit.PGPSignature, "-----BEGIN SSH SIGNATURE-----") {
+		if len(keys.sshSigners) == 0 {
+			return fmt.Errorf("commit %s has an SSH signature but no sshAllowedSigners are configured", hashStr)
+		}
+		key, err := verifySSHSignature(commit, keys.sshSigners)
+		if err != nil {
+			return utils.WrapErr(err, "Error verifying SSH signature of commit %s", hashStr)
+		}
+		logger.Infof("Validated SSH signature of commit %s by key %s", hashStr, gossh.FingerprintSHA256(key))
+		return nil
+	}
+	if keys.gpgKeyring == "" {
+		return fmt.Errorf("commit %s has a GPG signature but no gpgKeyring is configured", hashStr)
+	}
+	entity, err := commit.Verify(keys.gpgKeyring)
+	if err != nil {
+		return utils.WrapErr(err, "Error verifying GPG signature of commit %s", hashStr)
+	}
+	logger.Infof("Validated GPG signature of commit %s by key %X", hashStr, entity.PrimaryKey.Fingerprint)
+	return nil
+}
+
+// sshSignature is the blob of an SSH signature after its magic preamble, see
+// PROTOCOL.sshsig in OpenSSH
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// verifySSHSignature verifies the SSH signature of a commit, returning the
+// allowed key which made it
+func verifySSHSignature(commit *object.Commit, signers []gossh.PublicKey) (gossh.PublicKey, error) {
+	block, _ := pem.Decode([]byte(commit.PGPSignature))
+	if block == nil || block.Type != "SSH SIGNATURE" || !bytes.HasPrefix(block.Bytes, []byte(sshSignatureMagic)) {
+		return nil, fmt.Errorf("malformed SSH signature")
+	}
+	var sig sshSignature
+	if err := gossh.Unmarshal(block.Bytes[len(sshSignatureMagic):], &sig); err != nil {
+		return nil, utils.WrapErr(err, "Error parsing SSH signature")
+	}
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return nil, fmt.Errorf("SSH signature is for namespace %q, not %q", sig.Namespace, sshSignatureNamespace)
+	}
+	key, err := gossh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error parsing SSH signature public key")
+	}
+	allowed := false
+	for _, signer := range signers {
+		if bytes.Equal(signer.Marshal(), key.Marshal()) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("signed by key %s which is not in sshAllowedSigners", gossh.FingerprintSHA256(key))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported SSH signature hash algorithm %q", sig.HashAlgorithm)
+	}
+	data, err := commitPayload(commit)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+	signed := append([]byte(sshSignatureMagic), gossh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+
+	signature := new(gossh.Signature)
+	if err := gossh.Unmarshal(sig.Signature, signature); err != nil {
+		return nil, utils.WrapErr(err, "Error parsing SSH signature")
+	}
+	if err := key.Verify(signed, signature); err != nil {
+		return nil, utils.WrapErr(err, "Bad SSH signature")
+	}
+	return key, nil
+}
+
+// commitPayload returns the encoded commit a signature was made over
+func commitPayload(commit *object.Commit) ([]byte, error) {
+	o := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(o); err != nil {
+		return nil, utils.WrapErr(err, "Error encoding commit %s", commit.Hash)
+	}
+	r, err := o.Reader()
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading commit %s", commit.Hash)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -2,11 +2,14 @@ package engine
 
 import (
 	"context"
-	"fmt"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 )
@@ -23,6 +26,24 @@ type CommonMethod struct {
 	TargetPath string `mapstructure:"targetPath"`
 	// A glob to pattern match files in the target path directory
 	Glob *string `mapstructure:"glob"`
+	// File name suffixes processed by the method, replacing the method's defaults,
+	// e.g. [".raw.yaml"] so raw files can share a directory with kube files
+	Extensions []string `mapstructure:"extensions"`
+	// How symlinked files in the target path are handled, either "follow" (default)
+	// to resolve them within the repository or "skip" to ignore them.
+	// Symlinks resolving outside of the repository are always rejected.
+	Symlinks string `mapstructure:"symlinks"`
+	// AuthFile is the path within the fetchit container of a containers-auth.json
+	// file used to pull images, defaults to podman's auth file location
+	AuthFile string `mapstructure:"authFile"`
+	// RegistryUsername and RegistryPassword authenticate image pulls, taking
+	// precedence over AuthFile
+	RegistryUsername string `mapstructure:"registryUsername"`
+	RegistryPassword string `mapstructure:"registryPassword"`
+	// NamePrefix is prepended to the names of the containers and pods deployed by
+	// a raw method, so targets deploying files with the same names do not replace
+	// each other's containers
+	NamePrefix string `mapstructure:"namePrefix"`
 	// initialRun is set by fetchit
 	initialRun bool
 	target     *Target
@@ -32,9 +53,15 @@ func (m *CommonMethod) GetName() string {
 	return m.Name
 }
 
+// SchedInfo returns the schedule of the method, falling back to the schedule of
+// its target when the method does not set its own
 func (m *CommonMethod) SchedInfo() SchedInfo {
+	schedule := m.Schedule
+	if schedule == "" && m.target != nil {
+		schedule = m.target.schedule
+	}
 	return SchedInfo{
-		schedule: m.Schedule,
+		schedule: schedule,
 		skew:     m.Skew,
 	}
 }
@@ -47,19 +74,177 @@ func (m *CommonMethod) GetTarget() *Target {
 	return m.target
 }
 
-func zeroToCurrent(ctx, conn context.Context, m Method, target *Target, tag *[]string) error {
-	current, err := getCurrent(target, m.GetKind(), m.GetName())
+// fileTags returns the file name suffixes the method processes, the configured
+// extensions when set and otherwise the defaults of the method
+func (m *CommonMethod) fileTags(defaults []string) *[]string {
+	if len(m.Extensions) > 0 {
+		tags := append([]string(nil), m.Extensions...)
+		return &tags
+	}
+	if defaults == nil {
+		return nil
+	}
+	return &defaults
+}
+
+// lockRun serializes the runs of m, so that a run which overlaps the previous
+// one, or a redeploy, waits for it. The returned func releases the lock.
+func (t *Target) lockRun(m Method) func() {
+	t.runsMu.Lock()
+	if t.runs == nil {
+		t.runs = map[string]*sync.Mutex{}
+	}
+	mu, ok := t.runs[dryRunKey(m)]
+	if !ok {
+		mu = &sync.Mutex{}
+		t.runs[dryRunKey(m)] = mu
+	}
+	t.runsMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// exclusive runs fn holding the clone of the target exclusively
+func (t *Target) exclusive(fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn()
+}
+
+// checkoutHold is the shared hold of an apply on the clone of its target. The
+// changes of an apply may run at once, and the hold is released while every
+// running change waits on something outside the clone, so that the target's
+// other methods can fetch meanwhile.
+type checkoutHold struct {
+	target  *Target
+	mu      sync.Mutex
+	running int
+	waiting int
+}
+
+type checkoutHoldKey struct{}
+
+// holdCheckout takes the clone of target shared, the returned context carries
+// the hold for the changes of the apply and the returned func releases it
+func holdCheckout(ctx context.Context, target *Target) (context.Context, func()) {
+	target.mu.RLock()
+	h := &checkoutHold{target: target}
+	return context.WithValue(ctx, checkoutHoldKey{}, h), target.mu.RUnlock
+}
+
+// enter and leave bracket a change of the apply, the clone is held while any
+// running change is not waiting
+func (h *checkoutHold) enter() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.running > 0 && h.waiting == h.running {
+		h.target.mu.RLock()
+	}
+	h.running++
+}
+
+func (h *checkoutHold) leave() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running--
+	if h.running > 0 && h.waiting == h.running {
+		h.target.mu.RUnlock()
+	}
+}
+
+// stepOutOfCheckout marks the running change of ctx as waiting outside the
+// clone, the returned func takes it back before the change reads the clone
+func stepOutOfCheckout(ctx context.Context) func() {
+	h, _ := ctx.Value(checkoutHoldKey{}).(*checkoutHold)
+	if h == nil {
+		return func() {}
+	}
+	h.mu.Lock()
+	h.waiting++
+	if h.waiting == h.running {
+		h.target.mu.RUnlock()
+	}
+	h.mu.Unlock()
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.waiting == h.running {
+			h.target.mu.RLock()
+		}
+		h.waiting--
+	}
+}
+
+// inChange runs fn as a change of the apply holding ctx
+func inChange(ctx context.Context, fn func() error) error {
+	if h, _ := ctx.Value(checkoutHoldKey{}).(*checkoutHold); h != nil {
+		h.enter()
+		defer h.leave()
+	}
+	return fn()
+}
+
+// fetchLatest extracts or fetches the latest commit of the target and checks it out
+func fetchLatest(target *Target) (plumbing.Hash, error) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if target.disconnected {
+		if len(target.url) > 0 {
+			extractZip(target.url)
+		} else if len(target.device) > 0 {
+			localDevicePull(getDirectory(target), target.device, "", false)
+		}
+	}
+	return getLatest(target)
+}
+
+// checkedOut returns the commit checked out in the clone of target, which is
+// newer than fetched when another method fetched since
+func checkedOut(target *Target, fetched plumbing.Hash) plumbing.Hash {
+	repo, err := git.PlainOpen(getDirectory(target))
 	if err != nil {
-		return fmt.Errorf("Failed to get current commit: %v", err)
+		return fetched
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fetched
+	}
+	return head.Hash()
+}
+
+func zeroToCurrent(ctx, conn context.Context, m Method, target *Target, tag *[]string) (err error) {
+	restoreCurrent(ctx, target, m)
+	ctx, release := holdCheckout(ctx, target)
+	defer release()
+	log := target.logger()
+	// The poll is recorded when the current commit is applied, a method with
+	// none yet is polled by currentToLatest
+	var current plumbing.Hash
+	start := time.Now()
+	defer func() {
+		if err != nil || !current.IsZero() {
+			observePoll(target, m, start, err)
+		}
+	}()
+	current, err = getCurrent(target, m.GetKind(), m.GetName())
+	if err != nil {
+		return utils.WrapErr(err, "Failed to get current commit")
 	}
 
 	if current != plumbing.ZeroHash {
+		target.setPhase(m, phaseApplying)
+		defer func() { target.finishRun(current.String(), err) }()
+		ctx, result := newReconcileResult(ctx, m, target, plumbing.ZeroHash, current)
 		err = m.Apply(ctx, conn, plumbing.ZeroHash, current, tag)
+		result.finish(err)
 		if err != nil {
-			return fmt.Errorf("Failed to apply changes: %v", err)
+			return utils.WrapErr(err, "Failed to apply changes")
 		}
 
-		logger.Infof("Moved %s to commit %s for git target %s", m.GetName(), current.String()[:hashReportLen], target.url)
+		if !target.dryRun {
+			observeCommit(target, m, current.String())
+		}
+		log.Infof("Moved %s to commit %s for git target %s", m.GetName(), result.describe(), target.url)
 	}
 
 	return nil
@@ -70,43 +255,104 @@ func getDirectory(target *Target) string {
 	return filepath.Base(trimDir)
 }
 
-func currentToLatest(ctx, conn context.Context, m Method, target *Target, tag *[]string) error {
+func currentToLatest(ctx, conn context.Context, m Method, target *Target, tag *[]string) (err error) {
+	log := target.logger()
+	var applied string
+	start := time.Now()
+	target.setPhase(m, phaseFetching)
+	defer func() {
+		target.finishRun(applied, err)
+		observePoll(target, m, start, err)
+	}()
+
 	directory := getDirectory(target)
-	if target.disconnected {
-		if len(target.url) > 0 {
-			extractZip(target.url)
-		} else if len(target.device) > 0 {
-			localDevicePull(directory, target.device, "", false)
-		}
-	}
-	latest, err := getLatest(target)
+	latest, err := fetchLatest(target)
 	if err != nil {
-		return fmt.Errorf("Failed to get latest commit: %v", err)
+		return utils.WrapErr(err, "Failed to get latest commit")
 	}
 
+	// The files of the checkout are read until the commit is applied, while
+	// the target's other methods may read them too
+	ctx, release := holdCheckout(ctx, target)
+	shared := true
+	defer func() {
+		if shared {
+			release()
+		}
+	}()
+	latest = checkedOut(target, latest)
 	current, err := getCurrent(target, m.GetKind(), m.GetName())
 	if err != nil {
-		return fmt.Errorf("Failed to get current commit: %v", err)
+		return utils.WrapErr(err, "Failed to get current commit")
 	}
 
-	if latest != current {
-		if err := m.Apply(ctx, conn, current, latest, tag); err != nil {
-			return fmt.Errorf("Failed to apply changes: %v", err)
+	if target.dryRun && latest != current && target.dryRunCommits[dryRunKey(m)] == latest {
+		log.Infof("Dry run of %s %s at %s already reported", m.GetKind(), m.GetName(), latest.String()[:hashReportLen])
+	} else if latest != current {
+		target.setPhase(m, phaseApplying)
+		ctx, result := newReconcileResult(ctx, m, target, current, latest)
+		err := m.Apply(ctx, conn, current, latest, tag)
+		result.finish(err)
+		if err != nil {
+			return utils.WrapErr(err, "Failed to apply changes")
+		}
+		release()
+		shared = false
+		// A dry run leaves the current commit in place, so the changes are applied once dry run is disabled
+		if target.dryRun {
+			target.exclusive(func() { target.dryRunCommits[dryRunKey(m)] = latest })
+			log.Infof("Dry run of %s from %s to %s complete, nothing was applied", m.GetName(), current.String()[:hashReportLen], result.describe())
+			return nil
 		}
-		updateCurrent(ctx, target, latest, m.GetKind(), m.GetName())
-		logger.Infof("Moved %s from %s to %s for git target %s", m.GetName(), current.String()[:hashReportLen], latest, target.url)
+		target.exclusive(func() { updateCurrent(ctx, target, latest, m.GetKind(), m.GetName()) })
+		applied = latest.String()
+		if fetchit != nil {
+			fetchit.state.recordCommit(target, m, applied)
+		}
+		observeCommit(target, m, applied)
+		log.Infof("Moved %s from %s to %s for git target %s", m.GetName(), current.String()[:hashReportLen], result.describe(), target.url)
 	} else {
-		logger.Infof("No changes applied to git target %s this run, %s currently at %s", directory, m.GetKind(), current.String()[:hashReportLen])
+		log.Infof("No changes applied to git target %s this run, %s currently at %s", directory, m.GetKind(), current.String()[:hashReportLen])
 	}
 
 	return nil
 }
 
 func runChanges(ctx context.Context, conn context.Context, m Method, changeMap map[*object.Change]string) error {
+	target := m.GetTarget()
+	if cm, ok := m.(concurrentMethod); ok && cm.concurrency() > 1 && len(changeMap) > 1 && (target == nil || !target.dryRun) {
+		return runChangesConcurrently(ctx, conn, m, changeMap, cm, cm.concurrency())
+	}
 	for change, changePath := range changeMap {
-		if err := m.MethodEngine(ctx, conn, change, changePath); err != nil {
+		var err error
+		if conn, err = runChange(ctx, conn, m, change, changePath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// runChange applies one change, returning the connection to use for the
+// changes after it
+func runChange(ctx context.Context, conn context.Context, m Method, change *object.Change, changePath string) (context.Context, error) {
+	if target := m.GetTarget(); target != nil && target.dryRun {
+		err := dryRunChange(ctx, conn, m, change, changePath)
+		recordAction(ctx, change, err)
+		return conn, err
+	}
+	err := inChange(ctx, func() error {
+		err := m.MethodEngine(ctx, conn, change, changePath)
+		// Retry a change which failed because the podman socket dropped, and
+		// use the new connection for the remaining changes
+		if newConn, ok := reconnectConn(conn, err); ok {
+			conn = newConn
+			err = m.MethodEngine(ctx, conn, change, changePath)
+		}
+		return err
+	})
+	recordAction(ctx, change, err)
+	audit(auditConn(ctx, conn, m, changeFile(change)), auditFile, "", "", changeAction(change), err)
+	logChange(ctx, m, change, err)
+	observeDeploy(m.GetTarget(), m, err)
+	return conn, err
+}
@@ -187,7 +187,7 @@ func downloadUpdateConfigFile(urlStr string, existsAlready, initial bool, pat, u
 	defer resp.Body.Close()
 	newBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return false, fmt.Errorf("error downloading config from %s: %v", err)
+		return false, fmt.Errorf("error downloading config from %s: %v", urlStr, err)
 	}
 	if newBytes == nil {
 		// if initial, this is the last resort, newBytes should be populated
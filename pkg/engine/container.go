@@ -2,17 +2,23 @@ package engine
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/containers/fetchit/pkg/engine/utils"
 	"github.com/containers/podman/v4/libpod/define"
 	"github.com/containers/podman/v4/pkg/bindings/containers"
 	"github.com/containers/podman/v4/pkg/bindings/images"
 	"github.com/containers/podman/v4/pkg/domain/entities"
 	"github.com/containers/podman/v4/pkg/specgen"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sync/singleflight"
 )
 
 const stopped = define.ContainerStateStopped
 
+// imagePulls coalesces concurrent pulls of the same image reference
+var imagePulls singleflight.Group
+
 func generateSpec(method, file, copyFile, dest string, name string) *specgen.SpecGenerator {
 	s := specgen.NewSpecGenerator(fetchitImage, false)
 	s.Name = method + "-" + name + "-" + file
@@ -99,17 +105,59 @@ func waitAndRemoveContainer(conn context.Context, ID string) error {
 	return nil
 }
 
-func detectOrFetchImage(conn context.Context, imageName string, force bool) error {
-	present, err := images.Exists(conn, imageName, nil)
+// detectOrFetchImage pulls imageName according to policy: Always pulls it, IfNotPresent
+// pulls it when it is not present locally and Never fails when it is not present.
+// opts may carry registry credentials and is nil for public images. An image
+// pinned by digest cannot change, so it is only pulled when it is not present.
+// When opts selects a platform, a local image of another platform is treated as
+// not present.
+func detectOrFetchImage(conn context.Context, imageName string, policy string, opts *images.PullOptions) error {
+	var present bool
+	err := withPodman(conn, podmanTimeout(), "check image "+imageName, func(ctx context.Context) error {
+		var err error
+		present, err = images.Exists(ctx, imageName, nil)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	if p, ok := pullPlatform(opts); ok {
+		if present {
+			err := withPodman(conn, podmanTimeout(), "inspect image "+imageName, func(ctx context.Context) error {
+				var err error
+				present, err = localPlatformMatches(ctx, imageName, p)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if !present && policy != pullNever {
+				logger.Infof("Local image %s is not for platform %s, pulling it again", imageName, p)
+			}
+		}
+	}
+	if policy == pullNever {
+		if !present {
+			return utils.Classify(utils.ErrNotFound, fmt.Errorf("image %s is not present for the platform and the pull policy is %s", imageName, pullNever))
+		}
+		return nil
+	}
 
-	if !present || force {
-		_, err = images.Pull(conn, imageName, nil)
+	if !present || (policy == pullAlways && imageDigest(imageName) == "") {
+		// Callers pulling the same image at once wait for a single pull and share its result
+		logRegistryAuth(imageName, opts)
+		_, err, shared := imagePulls.Do(pullKey(imageName, "", opts), func() (interface{}, error) {
+			return nil, withPodman(conn, pullTimeout(), "pull image "+imageName, func(ctx context.Context) error {
+				_, err := images.Pull(ctx, imageName, opts)
+				return err
+			})
+		})
 		if err != nil {
 			return err
 		}
+		if shared {
+			logger.Infof("Image %s pulled once for concurrent deployments", imageName)
+		}
 	}
 
 	return nil
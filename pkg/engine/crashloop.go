@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+const (
+	// defaultCrashLoopRestarts is how many restarts within the window are a crash loop
+	defaultCrashLoopRestarts = 3
+	// defaultCrashLoopWindow is how long a new container is watched after it starts
+	defaultCrashLoopWindow = time.Minute
+	// crashLoopInterval is how often a watched container is inspected
+	crashLoopInterval = 2 * time.Second
+)
+
+// crashLoop configures the detection of containers which start but then keep
+// restarting after a deploy
+type crashLoop struct {
+	// Restarts within Window which are a crash loop, defaults to 3
+	Restarts int `mapstructure:"restarts"`
+	// Window is how long a new container is watched after it starts, defaults to 1m
+	Window string `mapstructure:"window"`
+}
+
+// crashLoopLimits returns the restart threshold and window of the method's crashLoop
+func (r *Raw) crashLoopLimits() (int, time.Duration, error) {
+	restarts, window := defaultCrashLoopRestarts, defaultCrashLoopWindow
+	if r.CrashLoop.Restarts != 0 {
+		restarts = r.CrashLoop.Restarts
+	}
+	if restarts < 1 {
+		return 0, 0, utils.Classify(utils.ErrValidation, fmt.Errorf("crashLoop restarts of method %s must be at least 1", r.Name))
+	}
+	if r.CrashLoop.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(r.CrashLoop.Window); err != nil {
+			return 0, 0, utils.WrapErrClass(utils.ErrValidation, err, "Invalid crashLoop window %s of method %s", r.CrashLoop.Window, r.Name)
+		}
+		if window <= 0 {
+			return 0, 0, utils.Classify(utils.ErrValidation, fmt.Errorf("crashLoop window %s of method %s must be positive", r.CrashLoop.Window, r.Name))
+		}
+	}
+	return restarts, window, nil
+}
+
+// crashLoopError reports a container found crash looping, so that callers can
+// tell it from a watch which was cancelled or could not inspect the container
+type crashLoopError struct {
+	msg string
+}
+
+func (e *crashLoopError) Error() string {
+	return e.msg
+}
+
+// isCrashLoop reports whether err is from a container found crash looping
+func isCrashLoop(err error) bool {
+	var crash *crashLoopError
+	return errors.As(err, &crash)
+}
+
+// watchCrashLoop watches a container which has just started for the method's
+// crashLoop window. Podman restarts the container under its restart policy,
+// fetchit only counts the restarts, and the container is crash looping when
+// podman restarts it restarts times or it is left exited with an error. A
+// cancelled ctx ends the watch with its error.
+func (r *Raw) watchCrashLoop(ctx, conn context.Context, name string) error {
+	if r.CrashLoop == nil {
+		return nil
+	}
+	restarts, window, err := r.crashLoopLimits()
+	if err != nil {
+		return err
+	}
+	r.GetTarget().logger().Infof("Watching container %s for %s for a crash loop", name, window)
+	deadline := time.Now().Add(window)
+	for {
+		ctr, err := inspectContainer(conn, name)
+		if err != nil {
+			return utils.WrapErr(err, "Error inspecting container %s", name)
+		}
+		if int(ctr.RestartCount) >= restarts {
+			return utils.Classify(utils.ErrValidation, &crashLoopError{fmt.Sprintf("container %s restarted %d times within %s", name, ctr.RestartCount, window)})
+		}
+		if !time.Now().Before(deadline) {
+			if ctr.State != nil && !ctr.State.Running && ctr.State.ExitCode != 0 {
+				return utils.Classify(utils.ErrValidation, &crashLoopError{fmt.Sprintf("container %s exited with code %d", name, ctr.State.ExitCode)})
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(crashLoopInterval):
+		}
+	}
+}
+
+// setCrashLooped remembers that the container of a file crash looped at the
+// commit being applied, so the commit is not deployed again on every poll
+func (r *Raw) setCrashLooped(ctx context.Context, file string) {
+	result := reconcileResultFrom(ctx)
+	if result == nil {
+		return
+	}
+	r.crashMu.Lock()
+	defer r.crashMu.Unlock()
+	if r.crashLooped == nil {
+		r.crashLooped = map[string]string{}
+	}
+	r.crashLooped[file] = result.Commit
+}
+
+// checkCrashLooped fails the deploy of a file whose container already crash
+// looped at the commit being applied, leaving the rolled back container running
+// until a new commit changes the file or the file is force redeployed
+func (r *Raw) checkCrashLooped(ctx context.Context, file string) error {
+	result := reconcileResultFrom(ctx)
+	r.crashMu.Lock()
+	defer r.crashMu.Unlock()
+	if result == nil || r.crashLooped[file] == "" {
+		return nil
+	}
+	if forceRedeploy(ctx) {
+		delete(r.crashLooped, file)
+		return nil
+	}
+	if r.crashLooped[file] == result.Commit {
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("container of %s crash looped at commit %s, waiting for a new commit", file, result.Commit))
+	}
+	delete(r.crashLooped, file)
+	return nil
+}
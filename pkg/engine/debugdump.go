@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"encoding/json"
+
+	"github.com/containers/podman/v4/pkg/specgen"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "<redacted>"
+
+// dumpSpec logs, at debug level, the fully resolved RawPod parsed from path and
+// the spec generated from it, exactly as it will be sent to podman. The values
+// of environment variables are redacted, as they may come from secret stores,
+// env files or the interpolated environment of fetchit.
+func dumpSpec(log *zap.SugaredLogger, path string, raw *RawPod, s *specgen.SpecGenerator) {
+	if !log.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		return
+	}
+	rawJSON, err := json.Marshal(redactRaw(raw))
+	if err != nil {
+		log.Debugf("Unable to marshal resolved file %s: %v", path, err)
+		return
+	}
+	specJSON, err := json.Marshal(redactSpec(s))
+	if err != nil {
+		log.Debugf("Unable to marshal spec of %s: %v", path, err)
+		return
+	}
+	log.Debugf("Resolved %s: %s", path, rawJSON)
+	log.Debugf("Spec generated from %s: %s", path, specJSON)
+}
+
+// redactEnv returns a copy of env with every value redacted
+func redactEnv(env map[string]string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	out := make(map[string]string, len(env))
+	for k := range env {
+		out[k] = redacted
+	}
+	return out
+}
+
+// redactSpec returns a copy of s with its environment redacted
+func redactSpec(s *specgen.SpecGenerator) *specgen.SpecGenerator {
+	spec := *s
+	spec.Env = redactEnv(s.Env)
+	return &spec
+}
+
+// redactRaw returns a copy of raw and its containers with their environment redacted
+func redactRaw(raw *RawPod) *RawPod {
+	out := *raw
+	out.Env = redactEnv(raw.Env)
+	if raw.Containers != nil {
+		out.Containers = make([]RawPod, len(raw.Containers))
+		for i := range raw.Containers {
+			out.Containers[i] = *redactRaw(&raw.Containers[i])
+		}
+	}
+	return &out
+}
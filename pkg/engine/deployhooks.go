@@ -0,0 +1,262 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/containers/common/libnetwork/types"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/api/handlers"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"go.uber.org/zap"
+)
+
+const (
+	// deployHookTimeout bounds how long a PreDeploy or PostDeploy command may run
+	deployHookTimeout = 10 * time.Minute
+	// defaultReadinessTimeout is how long ReadinessExec has to succeed when a
+	// container does not set ReadinessTimeout
+	defaultReadinessTimeout = 2 * time.Minute
+	// readinessInterval is the pause between attempts of ReadinessExec
+	readinessInterval = 2 * time.Second
+	// readinessOutputLimit is how much of the output of the last failed
+	// ReadinessExec attempt is kept in the deploy error
+	readinessOutputLimit = 512
+)
+
+// hookCommand splits a hook into an entrypoint and command, a single element is
+// run with the shell as healthcheck commands are
+func hookCommand(hook []string) ([]string, []string) {
+	if len(hook) == 1 {
+		return []string{"/bin/sh", "-c"}, hook
+	}
+	return hook[:1], hook[1:]
+}
+
+// preDeploySpec returns the spec of the container running the PreDeploy
+// command of s. It shares the image, environment, mounts and networks of s but
+// publishes no ports and takes no network aliases, static addresses or static
+// MAC, so it does not collide with the container still running.
+func preDeploySpec(s *specgen.SpecGenerator, hook []string) *specgen.SpecGenerator {
+	h := *s
+	h.Name = s.Name + "-predeploy"
+	h.Entrypoint, h.Command = hookCommand(hook)
+	h.PortMappings = nil
+	h.HealthConfig = nil
+	h.RestartPolicy = define.RestartPolicyNo
+	h.RestartRetries = nil
+	h.Labels = map[string]string{"owned-by": FetchItLabel}
+	if s.Networks != nil {
+		h.Networks = make(map[string]types.PerNetworkOptions, len(s.Networks))
+		for name, opts := range s.Networks {
+			opts.Aliases = nil
+			opts.StaticIPs = nil
+			opts.StaticMAC = nil
+			h.Networks[name] = opts
+		}
+	}
+	return &h
+}
+
+// runPreDeploy runs the PreDeploy command of a container in a short-lived
+// container created from its spec, before the running container is replaced
+func runPreDeploy(conn context.Context, log *zap.SugaredLogger, s *specgen.SpecGenerator, hook []string) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	h := preDeploySpec(s, hook)
+	if err := removeExisting(conn, h.Name, nil); err != nil {
+		return utils.WrapErr(err, "Error removing leftover PreDeploy container %s", h.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(conn, deployHookTimeout)
+	defer cancel()
+	created, err := containers.CreateWithSpec(ctx, h, nil)
+	audit(conn, auditContainer, h.Name, h.Image, "create", err)
+	if err != nil {
+		return utils.WrapErr(err, "Error creating PreDeploy container %s", h.Name)
+	}
+	defer func() {
+		err := withPodman(conn, podmanTimeout(), "remove container "+h.Name, func(ctx context.Context) error {
+			_, err := containers.Remove(ctx, created.ID, new(containers.RemoveOptions).WithForce(true))
+			return err
+		})
+		audit(conn, auditContainer, h.Name, "", "remove", err)
+		if err != nil {
+			log.Errorf("Error removing PreDeploy container %s: %v", h.Name, err)
+		}
+	}()
+	err = containers.Start(ctx, created.ID, nil)
+	audit(conn, auditContainer, h.Name, "", "start", err)
+	if err != nil {
+		return utils.WrapErr(err, "Error starting PreDeploy container %s", h.Name)
+	}
+
+	out := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range out {
+			log.Infof("PreDeploy %s: %s", s.Name, strings.TrimRight(line, "\n"))
+		}
+	}()
+	opts := new(containers.LogOptions).WithFollow(true).WithStdout(true).WithStderr(true)
+	err = containers.Logs(ctx, created.ID, opts, out, out)
+	close(out)
+	<-done
+	if err != nil {
+		log.Infof("Unable to follow output of PreDeploy container %s: %v", h.Name, err)
+	}
+
+	code, err := containers.Wait(ctx, created.ID, new(containers.WaitOptions).WithCondition([]define.ContainerStatus{define.ContainerStateStopped, define.ContainerStateExited}))
+	if err != nil {
+		return utils.WrapErr(err, "Error waiting for PreDeploy of container %s", s.Name)
+	}
+	if code != 0 {
+		return fmt.Errorf("PreDeploy of container %s exited with code %d", s.Name, code)
+	}
+	log.Infof("PreDeploy of container %s succeeded", s.Name)
+	return nil
+}
+
+// hookLog writes the output of a hook to the log, line by line
+type hookLog struct {
+	log     *zap.SugaredLogger
+	prefix  string
+	partial string
+}
+
+func (w *hookLog) Write(p []byte) (int, error) {
+	lines := strings.Split(w.partial+string(p), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		w.log.Infof("%s: %s", w.prefix, line)
+	}
+	w.partial = lines[len(lines)-1]
+	return len(p), nil
+}
+
+func (w *hookLog) Close() error {
+	if w.partial != "" {
+		w.log.Infof("%s: %s", w.prefix, w.partial)
+		w.partial = ""
+	}
+	return nil
+}
+
+// runPostDeploy executes the PostDeploy command of a container inside it once it
+// has started, such as a smoke test against the container's own ports
+func runPostDeploy(conn context.Context, log *zap.SugaredLogger, name string, hook []string) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(conn, deployHookTimeout)
+	defer cancel()
+	output := &hookLog{log: log, prefix: "PostDeploy " + name}
+	code, err := execIn(ctx, name, hook, output)
+	output.Close()
+	if err != nil {
+		return utils.WrapErr(err, "Error running PostDeploy of container %s", name)
+	}
+	if code != 0 {
+		return fmt.Errorf("PostDeploy of container %s exited with code %d", name, code)
+	}
+	log.Infof("PostDeploy of container %s succeeded", name)
+	return nil
+}
+
+// nopWriteCloser is a writer the exec bindings may close
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// execIn executes a command inside a running container, writing its output to
+// output, and returns its exit code. A single element is run with the shell.
+func execIn(ctx context.Context, name string, command []string, output io.Writer) (int, error) {
+	config := new(handlers.ExecCreateConfig)
+	config.Cmd = command
+	if len(command) == 1 {
+		config.Cmd = []string{"/bin/sh", "-c", command[0]}
+	}
+	config.AttachStdout = true
+	config.AttachStderr = true
+
+	session, err := containers.ExecCreate(ctx, name, config)
+	if err != nil {
+		return 0, err
+	}
+	var stream io.WriteCloser = nopWriteCloser{output}
+	opts := new(containers.ExecStartAndAttachOptions).WithOutputStream(stream).WithErrorStream(stream).
+		WithAttachOutput(true).WithAttachError(true)
+	if err := containers.ExecStartAndAttach(ctx, session, opts); err != nil {
+		return 0, err
+	}
+	inspect, err := containers.ExecInspect(ctx, session, nil)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// readinessTimeout returns how long the ReadinessExec of a container has to succeed
+func (raw *RawPod) readinessTimeout() (time.Duration, error) {
+	if raw.ReadinessTimeout == "" {
+		return defaultReadinessTimeout, nil
+	}
+	if len(raw.ReadinessExec) == 0 {
+		return 0, fmt.Errorf("ReadinessTimeout is set without ReadinessExec")
+	}
+	timeout, err := time.ParseDuration(raw.ReadinessTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("ReadinessTimeout %q must be a positive duration such as 30s", raw.ReadinessTimeout)
+	}
+	return timeout, nil
+}
+
+// waitReady executes the ReadinessExec of a container inside it until the
+// command exits 0, failing when it does not succeed within the container's
+// ReadinessTimeout. The output of the last failed attempt is included in the
+// error, as attempts are not logged.
+func waitReady(conn context.Context, log *zap.SugaredLogger, name string, raw *RawPod) error {
+	if len(raw.ReadinessExec) == 0 {
+		return nil
+	}
+	timeout, err := raw.readinessTimeout()
+	if err != nil {
+		return utils.Classify(utils.ErrValidation, err)
+	}
+	ctx, cancel := context.WithTimeout(conn, timeout)
+	defer cancel()
+	var last string
+	for {
+		var output bytes.Buffer
+		code, err := execIn(ctx, name, raw.ReadinessExec, &output)
+		if err == nil && code == 0 {
+			log.Infof("Container %s is ready", name)
+			return nil
+		}
+		if err != nil {
+			last = err.Error()
+		} else {
+			out := strings.TrimSpace(output.String())
+			if len(out) > readinessOutputLimit {
+				out = "..." + out[len(out)-readinessOutputLimit:]
+			}
+			last = fmt.Sprintf("exited with code %d: %s", code, out)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ReadinessExec of container %s did not succeed within %s, last attempt %s", name, timeout, last)
+		case <-time.After(readinessInterval):
+		}
+	}
+}
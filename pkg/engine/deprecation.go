@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// deprecatedRawFields maps deprecated fields of raw manifests to their
+// replacement. Fields are added here when they are renamed or superseded and
+// removed once they are no longer accepted.
+var deprecatedRawFields = map[string]string{
+	// PullImage was never read from manifests, images are pulled by the method's policy
+	"PullImage":      "pullPolicy on the raw method",
+	"NetworkAliases": "Networks with Aliases",
+}
+
+// deprecatedField warns that a deprecated field is in use and counts it
+func deprecatedField(method, source, field, replacement string) {
+	logger.Warnf("%s uses the deprecated %s field %s, use %s instead", source, method, field, replacement)
+	deprecatedFieldTotal.WithLabelValues(method, field).Inc()
+}
+
+// warnDeprecatedRawFields reports deprecated top level fields set in a raw manifest
+func warnDeprecatedRawFields(path string, b []byte) {
+	if len(deprecatedRawFields) == 0 {
+		return
+	}
+	// yaml is a superset of json, so both manifest formats can be read as yaml
+	fields := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &fields); err != nil {
+		return
+	}
+	for key := range fields {
+		for field, replacement := range deprecatedRawFields {
+			// json field names are matched case insensitively
+			if strings.EqualFold(key, field) {
+				deprecatedField(rawMethod, path, field, replacement)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// parseDevice parses a device in the host[:container][:permissions] format of
+// podman's --device, returning the host path
+func parseDevice(device string) (string, error) {
+	parts := strings.Split(device, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return "", fmt.Errorf("invalid device %q, expected host[:container][:permissions]", device)
+	}
+	host := parts[0]
+	if !filepath.IsAbs(host) {
+		return "", fmt.Errorf("invalid device %q, the host path must be absolute", device)
+	}
+	var container, perms string
+	switch len(parts) {
+	case 2:
+		// As with podman, a second part which is valid permissions is not a path
+		if validDevicePerms(parts[1]) {
+			perms = parts[1]
+		} else {
+			container = parts[1]
+		}
+	case 3:
+		container, perms = parts[1], parts[2]
+		if !validDevicePerms(perms) {
+			return "", fmt.Errorf("invalid device %q, permissions must be a combination of r, w and m", device)
+		}
+	}
+	if container != "" && !filepath.IsAbs(container) {
+		return "", fmt.Errorf("invalid device %q, the container path must be absolute", device)
+	}
+	return host, nil
+}
+
+func validDevicePerms(perms string) bool {
+	if perms == "" || len(perms) > 3 {
+		return false
+	}
+	seen := map[rune]bool{}
+	for _, c := range perms {
+		if !strings.ContainsRune("rwm", c) || seen[c] {
+			return false
+		}
+		seen[c] = true
+	}
+	return true
+}
+
+// convertDevices validates devices and converts them for the spec, podman
+// parses each device itself when the container is created
+func convertDevices(devices []string) ([]specs.LinuxDevice, error) {
+	var result []specs.LinuxDevice
+	for _, d := range devices {
+		if _, err := parseDevice(d); err != nil {
+			return nil, err
+		}
+		result = append(result, specs.LinuxDevice{Path: d})
+	}
+	return result, nil
+}
+
+// checkDevices verifies the host paths of a container's devices exist. fetchit
+// does not see the host's devices, so the paths are checked by a short lived
+// privileged container, which exits with the position of the first missing path.
+func checkDevices(conn context.Context, name string, devices []specs.LinuxDevice) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(devices))
+	for _, d := range devices {
+		host, err := parseDevice(d.Path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, host)
+	}
+
+	s := specgen.NewSpecGenerator(fetchitImage, false)
+	s.Name = rawMethod + "-" + name + "-device-check"
+	s.Privileged = true
+	s.Command = append([]string{"sh", "-c", `i=1; for d in "$@"; do [ -e "$d" ] || exit $i; i=$((i+1)); done`, "sh"}, paths...)
+
+	if exists, _ := containers.Exists(conn, s.Name, nil); exists {
+		containers.Remove(conn, s.Name, new(containers.RemoveOptions).WithForce(true))
+	}
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return utils.WrapErr(err, "Error checking devices of container %s", name)
+	}
+	exitCode, err := containers.Wait(conn, createResponse.ID, new(containers.WaitOptions).WithCondition([]define.ContainerStatus{stopped}))
+	containers.Remove(conn, createResponse.ID, new(containers.RemoveOptions).WithForce(true))
+	if err != nil {
+		return utils.WrapErr(err, "Error checking devices of container %s", name)
+	}
+	if exitCode > 0 && int(exitCode) <= len(paths) {
+		return utils.Classify(utils.ErrNotFound, fmt.Errorf("device %s of container %s does not exist on the host", paths[exitCode-1], name))
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("device check of container %s exited with code %d", name, exitCode)
+	}
+	return nil
+}
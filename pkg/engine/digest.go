@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestMaxErrors caps the distinct errors kept for each target in a digest
+const digestMaxErrors = 10
+
+// ReconcileDigest summarises the reconciles of every target over a window,
+// it is passed to the reconcile hook in place of each ReconcileResult when the
+// hook is in digest mode
+type ReconcileDigest struct {
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Summary []string        `json:"summary"`
+	Targets []*TargetDigest `json:"targets"`
+}
+
+// TargetDigest counts the reconciles of a target within a digest window
+type TargetDigest struct {
+	Target     string `json:"target"`
+	Reconciles int    `json:"reconciles"`
+	Failed     int    `json:"failed"`
+	// Actions counts the changed files by action, e.g. create or delete
+	Actions       map[string]int `json:"actions"`
+	FailedActions int            `json:"failedActions"`
+	// Errors are the distinct errors of failed reconciles, oldest first
+	Errors []string `json:"errors,omitempty"`
+}
+
+// digests collects results between deliveries of a digest
+var digests = &digestCollector{targets: map[string]*TargetDigest{}}
+
+type digestCollector struct {
+	mu      sync.Mutex
+	start   time.Time
+	targets map[string]*TargetDigest
+	once    sync.Once
+}
+
+func (d *digestCollector) add(r *ReconcileResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.targets[r.Target]
+	if !ok {
+		t = &TargetDigest{Target: r.Target, Actions: map[string]int{}}
+		d.targets[r.Target] = t
+	}
+	t.Reconciles++
+	for _, a := range r.Actions {
+		t.Actions[a.Action]++
+		if a.Error != "" {
+			t.FailedActions++
+		}
+	}
+	if r.Error != "" {
+		t.Failed++
+		if len(t.Errors) < digestMaxErrors && !containsString(t.Errors, r.Error) {
+			t.Errors = append(t.Errors, r.Error)
+		}
+	}
+}
+
+// flush returns the digest of the window ending now and starts the next
+// window, nil is returned when nothing was reconciled
+func (d *digestCollector) flush() *ReconcileDigest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	digest := &ReconcileDigest{Start: d.start, End: now}
+	for _, t := range d.targets {
+		digest.Targets = append(digest.Targets, t)
+	}
+	d.start = now
+	d.targets = map[string]*TargetDigest{}
+	if len(digest.Targets) == 0 {
+		return nil
+	}
+
+	sort.Slice(digest.Targets, func(i, j int) bool {
+		return digest.Targets[i].Target < digest.Targets[j].Target
+	})
+	for _, t := range digest.Targets {
+		applied := 0
+		for _, n := range t.Actions {
+			applied += n
+		}
+		digest.Summary = append(digest.Summary, fmt.Sprintf("target %s: %d reconciles, %d failed; %d files applied, %d failed",
+			t.Target, t.Reconciles, t.Failed, applied-t.FailedActions, t.FailedActions))
+	}
+	return digest
+}
+
+// run delivers a digest to the reconcile hook at the end of each window. The
+// hook is read on every window so that config reloads take effect.
+func (d *digestCollector) run() {
+	d.once.Do(func() {
+		d.mu.Lock()
+		d.start = time.Now()
+		d.mu.Unlock()
+		go func() {
+			for {
+				var hook *ReconcileHook
+				if fetchit != nil {
+					hook = fetchit.reconcileHook
+				}
+				window, ok := time.Duration(0), false
+				if hook != nil {
+					window, ok = hook.digestWindow()
+				}
+				if !ok {
+					window = time.Minute
+				}
+				time.Sleep(window)
+				if !ok {
+					// Start the next window when digest mode is enabled again
+					d.flush()
+					continue
+				}
+				digest := d.flush()
+				if digest == nil {
+					continue
+				}
+				payload, err := json.Marshal(digest)
+				if err != nil {
+					logger.Errorf("Error marshalling reconcile digest for hook: %v", err)
+					continue
+				}
+				hook.send(payload, strings.Join(digest.Summary, "\n"), "digest")
+			}
+		}()
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// dryRunner is implemented by methods which describe the actions they would
+// take for a change in dry run mode, other methods log only the changed file
+type dryRunner interface {
+	dryRunChange(ctx, conn context.Context, change *object.Change, path string) error
+}
+
+// dryRunKey identifies a method in the dry run commits of its target
+func dryRunKey(m Method) string {
+	return m.GetKind() + "/" + m.GetName()
+}
+
+// dryRunChange reports a change of a dry run target instead of applying it
+func dryRunChange(ctx, conn context.Context, m Method, change *object.Change, path string) error {
+	if dr, ok := m.(dryRunner); ok {
+		return dr.dryRunChange(ctx, conn, change, path)
+	}
+	name := change.To.Name
+	if path == deleteFile {
+		name = change.From.Name
+	}
+	m.GetTarget().logger().Infof("Dry run: %s %s would %s %s", m.GetKind(), m.GetName(), changeAction(change), name)
+	return nil
+}
+
+// dryRunChange logs the spec generated from a raw file and the containers
+// rawPodman would delete and create, without pulling images or changing containers
+func (r *Raw) dryRunChange(ctx, conn context.Context, change *object.Change, path string) error {
+	log := r.GetTarget().logger()
+	prev, err := getChangeString(change)
+	if err != nil {
+		return err
+	}
+
+	var raw *RawPod
+	if path != deleteFile {
+		rawFile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if raw, err = r.parseRawPod(rawFile, change.To.Name); err != nil {
+			return err
+		}
+	}
+
+	if prev != nil {
+		prevRaw, err := r.parsePrevRawPod([]byte(*prev), change.From.Name)
+		if err != nil {
+			return err
+		}
+		if prevRaw.enabled() && (raw == nil || !prevRaw.sameDeployment(raw)) {
+			log.Infof("Dry run: would delete %s of %s", prevRaw.describe(), change.From.Name)
+		}
+	}
+	if raw == nil {
+		return nil
+	}
+	if !raw.enabled() {
+		log.Infof("Dry run: would remove any %s of disabled file %s", raw.describe(), path)
+		return nil
+	}
+	if err := raw.validate(); err != nil {
+		return utils.WrapErr(err, "Error validating %s", path)
+	}
+	if err := r.GetTarget().checkImages(raw); err != nil {
+		return utils.WrapErr(err, "Error validating %s", path)
+	}
+
+	containers := []*RawPod{raw}
+	if raw.isPod() {
+		p, err := podSpecGen(raw)
+		if err != nil {
+			return utils.WrapErrClass(utils.ErrValidation, err, "Error generating pod spec from %s", path)
+		}
+		podJSON, err := json.Marshal(p)
+		if err != nil {
+			return utils.WrapErr(err, "Error marshalling pod spec of %s", path)
+		}
+		log.Infof("Dry run: pod spec generated from %s: %s", path, podJSON)
+		containers = containerRefs(raw.Containers)
+	}
+	for _, c := range containers {
+		c.StopTimeout = r.stopTimeout(c)
+		if err := resolveHostRelative(conn, c); err != nil {
+			return utils.WrapErr(err, "Error resolving resource limits from %s", path)
+		}
+		if err := r.loadEnvFiles(c); err != nil {
+			return err
+		}
+		r.expandName(ctx, c)
+		s, err := createSpecGen(*c)
+		if err != nil {
+			return utils.WrapErrClass(utils.ErrValidation, err, "Error generating spec from %s", path)
+		}
+		if raw.isPod() {
+			joinPod(s, raw.Pod)
+		}
+		if err := checkNetworks(conn, s); err != nil {
+			return err
+		}
+		if err := checkSecrets(conn, s); err != nil {
+			return err
+		}
+		r.labelCommit(ctx, s.Labels)
+
+		specJSON, err := json.Marshal(redactSpec(s))
+		if err != nil {
+			return utils.WrapErr(err, "Error marshalling spec of %s", path)
+		}
+		log.Infof("Dry run: spec of container %s generated from %s: %s", s.Name, path, specJSON)
+		if len(c.PreDeploy) > 0 {
+			log.Infof("Dry run: would run PreDeploy %q of container %s before replacing it", c.PreDeploy, c.Name)
+		}
+		if len(c.ReadinessExec) > 0 {
+			log.Infof("Dry run: would run ReadinessExec %q in container %s until it succeeds", c.ReadinessExec, c.Name)
+		}
+		if len(c.PostDeploy) > 0 {
+			log.Infof("Dry run: would run PostDeploy %q in container %s after it starts", c.PostDeploy, c.Name)
+		}
+		policy, err := r.pullPolicy()
+		if err != nil {
+			return err
+		}
+		switch policy {
+		case pullAlways:
+			log.Infof("Dry run: would pull image %s", c.Image)
+		case pullNever:
+			log.Infof("Dry run: would use image %s without pulling it", c.Image)
+		default:
+			log.Infof("Dry run: would pull image %s if it is not present", c.Image)
+		}
+	}
+	log.Infof("Dry run: would replace any existing %s, then create and start it", raw.describe())
+	if r.Systemd != nil {
+		log.Infof("Dry run: would install and enable systemd unit %s", rawUnits(raw)[0])
+	}
+	return nil
+}
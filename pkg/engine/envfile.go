@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+// loadEnvFiles merges the EnvFile files of a raw container into its Env, in
+// order, with the values set in Env taking precedence. The files are paths
+// within the repository checkout, and symlinks must resolve within it.
+func (r *Raw) loadEnvFiles(raw *RawPod) error {
+	if len(raw.EnvFile) == 0 {
+		return nil
+	}
+	directory := getDirectory(r.GetTarget())
+	env := map[string]string{}
+	for _, file := range raw.EnvFile {
+		path := filepath.Join(directory, file)
+		if rel, err := filepath.Rel(directory, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("env file %s of container %s is outside of the repository", file, raw.Name))
+		}
+		// An env file which is a symlink must resolve within the repository too
+		resolved, err := resolveInRepo(directory, path)
+		if os.IsNotExist(err) {
+			return utils.Classify(utils.ErrNotFound, fmt.Errorf("env file %s of container %s does not exist in the repository", file, raw.Name))
+		} else if err != nil {
+			return utils.WrapErrClass(utils.ErrValidation, err, "Error resolving env file %s of container %s", file, raw.Name)
+		}
+		b, err := ioutil.ReadFile(resolved)
+		if os.IsNotExist(err) {
+			return utils.Classify(utils.ErrNotFound, fmt.Errorf("env file %s of container %s does not exist in the repository", file, raw.Name))
+		} else if err != nil {
+			return utils.WrapErr(err, "Error reading env file %s of container %s", file, raw.Name)
+		}
+		vars, err := parseEnvFile(b)
+		if err != nil {
+			return utils.WrapErrClass(utils.ErrValidation, err, "Error parsing env file %s of container %s", file, raw.Name)
+		}
+		for k, v := range vars {
+			env[k] = v
+		}
+	}
+	for k, v := range raw.Env {
+		env[k] = v
+	}
+	raw.Env = env
+	return nil
+}
+
+// parseEnvFile parses KEY=VALUE lines, skipping blank lines and lines starting
+// with #. As with podman's --env-file, values are used as written without unquoting.
+func parseEnvFile(b []byte) (map[string]string, error) {
+	env := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 || strings.ContainsAny(line[:i], " \t") {
+			return nil, fmt.Errorf("line %d is not KEY=VALUE", n)
+		}
+		env[line[:i]] = line[i+1:]
+	}
+	return env, scanner.Err()
+}
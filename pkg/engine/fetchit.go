@@ -8,14 +8,13 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/containers/podman/v4/pkg/bindings"
+	"github.com/containers/fetchit/pkg/engine/utils"
 	"github.com/go-co-op/gocron"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/net/http/httpproxy"
 )
 
 const (
@@ -47,6 +46,14 @@ type Fetchit struct {
 	scheduler          *gocron.Scheduler
 	methodTargetScheds map[Method]SchedInfo
 	allMethodTypes     map[string]struct{}
+	reconcileHook      *ReconcileHook
+	stopTimeout        *uint
+	state              *appliedState
+	reconnectTimeout   time.Duration
+	podmanTimeout      time.Duration
+	pullTimeout        time.Duration
+	caFile             string
+	dryRun             bool
 }
 
 func newFetchit() *Fetchit {
@@ -115,7 +122,7 @@ func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
 		// TODO: socket directory same for all platforms?
 		// sock_dir := os.Getenv("XDG_RUNTIME_DIR")
 		// socket := "unix:" + sock_dir + "/podman/podman.sock"
-		conn, err := bindings.NewConnection(ctx, "unix://run/podman/podman.sock")
+		conn, err := newPodmanConn(ctx, defaultPodmanURI)
 		if err != nil || conn == nil {
 			cobra.CheckErr(fmt.Errorf("error establishing connection to podman.sock: %v", err))
 		}
@@ -123,7 +130,7 @@ func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
 	}
 	fetchit.conn = fc.conn
 
-	if err := detectOrFetchImage(fc.conn, fetchitImage, false); err != nil {
+	if err := detectOrFetchImage(fc.conn, fetchitImage, pullIfNotPresent, nil); err != nil {
 		cobra.CheckErr(err)
 	}
 
@@ -167,6 +174,49 @@ func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
 		fetchit.envSecret = config.GitAuth.EnvSecret
 	}
 
+	// Resolvers are replaced on every (re)load so removed stores no longer resolve
+	config.SecretStores.register()
+	fetchit.reconcileHook = config.ReconcileHook
+	if config.ReconcileHook != nil && config.ReconcileHook.Digest != "" {
+		if _, ok := config.ReconcileHook.digestWindow(); !ok {
+			logger.Errorf("Invalid reconcile hook digest window %s, sending each result instead", config.ReconcileHook.Digest)
+		}
+		digests.run()
+	}
+	fetchit.stopTimeout = config.StopTimeout
+	fetchit.dryRun = config.DryRun
+	if config.MetricsAddress != "" {
+		serveHTTP(config)
+		if hook := config.Webhook; hook != nil {
+			if hook.Secret == "" {
+				logger.Errorf("Not serving the webhook on %s, a secret is required", hook.webhookPath())
+			} else {
+				logger.Infof("Serving the webhook on %s", hook.webhookPath())
+			}
+		}
+	} else if config.Webhook != nil || config.ControlToken != "" {
+		logger.Errorf("Not serving the webhook or pause controls, they require metricsAddress to be set")
+	}
+	fetchit.state = loadState(defaultStatePath)
+	fetchit.reconnectTimeout = defaultReconnectTimeout
+	if config.ReconnectTimeout != "" {
+		timeout, err := time.ParseDuration(config.ReconnectTimeout)
+		if err != nil {
+			logger.Errorf("Invalid reconnectTimeout %s, using %s: %v", config.ReconnectTimeout, defaultReconnectTimeout, err)
+		} else {
+			fetchit.reconnectTimeout = timeout
+		}
+	}
+	setReconnectTimeout(fc.conn, fetchit.reconnectTimeout)
+	fetchit.podmanTimeout = parseTimeout("podmanTimeout", config.PodmanTimeout, defaultPodmanTimeout)
+	fetchit.pullTimeout = parseTimeout("pullTimeout", config.PullTimeout, defaultPullTimeout)
+	fetchit.caFile = config.CAFile
+	if err := setLogFormat(config.LogFormat); err != nil {
+		logger.Errorf("%v, using text logs", err)
+		_ = setLogFormat(logFormatText)
+	}
+	setAuditLog(config.AuditLog)
+
 	if config.Prune != nil {
 		prune := &TargetConfig{
 			prune: config.Prune,
@@ -194,7 +244,9 @@ func (fc *FetchitConfig) populateFetchit(config *FetchitConfig) *Fetchit {
 		fc.scheduler = gocron.NewScheduler(time.UTC)
 	}
 	fetchit.scheduler = fc.scheduler
-	return getMethodTargetScheds(fc.TargetConfigs, fetchit)
+	f := getMethodTargetScheds(fc.TargetConfigs, fetchit)
+	publishConfig(f, config)
+	return f
 }
 
 // This location will be checked first. This is from a `-v /path/to/config.yaml:/opt/mount/config.yaml`,
@@ -263,6 +315,7 @@ func getMethodTargetScheds(targetConfigs []*TargetConfig, fetchit *Fetchit) *Fet
 		tc.mu.Lock()
 		defer tc.mu.Unlock()
 		internalTarget := &Target{
+			name:   tc.Name,
 			url:    tc.Url,
 			device: tc.Device,
 			pat:    fetchit.pat,
@@ -273,12 +326,133 @@ func getMethodTargetScheds(targetConfigs []*TargetConfig, fetchit *Fetchit) *Fet
 			username:     fetchit.username,
 			password:     fetchit.password,
 			branch:       tc.Branch,
+			tag:          tc.Tag,
+			revision:     tc.Revision,
 			disconnected: tc.Disconnected,
+			depth:        tc.Depth,
+			submodules:   tc.RecurseSubmodules,
+		}
+
+		if tc.Tag != "" && tc.Revision != "" {
+			logger.Errorf("Skipping target %s, only one of tag and revision may be set", internalTarget.displayName())
+			continue
+		}
+
+		policy, err := newImagePolicy(tc.AllowedImages, tc.DeniedImages)
+		if err != nil {
+			logger.Errorf("Skipping target %s, invalid image policy: %v", internalTarget.displayName(), err)
+			continue
+		}
+		internalTarget.imagePolicy = policy
+
+		schedule, err := targetSchedule(tc)
+		if err != nil {
+			logger.Errorf("Skipping target %s: %v", internalTarget.displayName(), err)
+			continue
+		}
+		internalTarget.schedule = schedule
+		if tc.HTTPProxy != "" || tc.HTTPSProxy != "" || tc.NoProxy != "" {
+			internalTarget.proxy = &httpproxy.Config{HTTPProxy: tc.HTTPProxy, HTTPSProxy: tc.HTTPSProxy, NoProxy: tc.NoProxy}
+		}
+		if caFile := tc.CAFile; caFile != "" || fetchit.caFile != "" {
+			if caFile == "" {
+				caFile = fetchit.caFile
+			}
+			bundle, err := loadCABundle(caFile)
+			if err != nil {
+				logger.Errorf("Skipping target %s: %v", internalTarget.displayName(), err)
+				continue
+			}
+			internalTarget.caBundle = bundle
+		}
+		if tc.InsecureSkipTLS {
+			internalTarget.insecureSkipTLS = true
+			logger.Warnf("Target %s skips TLS verification of its git and registry endpoints, connections to them can be intercepted", internalTarget.displayName())
+		}
+
+		internalTarget.vars = tc.Vars
+		internalTarget.raws = tc.Raw
+		if tc.DryRun || fetchit.dryRun {
+			internalTarget.dryRun = true
+			internalTarget.dryRunCommits = map[string]plumbing.Hash{}
+			logger.Infof("Target %s is in dry run mode, changes are reported but not applied", internalTarget.displayName())
+		}
+		internalTarget.retryAttempts = tc.RetryAttempts
+		if tc.RetryDelay != "" {
+			delay, err := time.ParseDuration(tc.RetryDelay)
+			if err != nil {
+				logger.Errorf("Invalid retryDelay %s for target %s, using %s: %v", tc.RetryDelay, internalTarget.displayName(), defaultRetryDelay, err)
+			} else {
+				internalTarget.retryDelay = delay
+			}
+		}
+
+		if tc.LogLevel != "" {
+			log, err := newTargetLogger(internalTarget.displayName(), tc.LogLevel)
+			if err != nil {
+				logger.Errorf("Invalid logLevel %s for target %s, using the global level: %v", tc.LogLevel, internalTarget.displayName(), err)
+			} else {
+				internalTarget.log = log
+			}
+		}
+		if internalTarget.log == nil && jsonLogs {
+			internalTarget.log = logger.With("target", internalTarget.displayName())
+		}
+
+		if tc.User != "" {
+			if _, err := userUID(tc.User); err != nil {
+				logger.Errorf("Skipping target %s, unable to deploy as user %s: %v", internalTarget.displayName(), tc.User, err)
+				continue
+			}
+			internalTarget.user = tc.User
+			if _, err := internalTarget.podmanConn(nil); err != nil {
+				logger.Errorf("Target %s will connect to the session of user %s when it runs: %v", internalTarget.displayName(), tc.User, err)
+			}
+		}
+
+		if tc.SSHKeyFile != "" {
+			keyPath := tc.SSHKeyFile
+			if !filepath.IsAbs(keyPath) {
+				keyPath = filepath.Join("/opt", "mount", ".ssh", keyPath)
+			}
+			if err := checkForPrivateKey(keyPath); err != nil {
+				logger.Errorf("Skipping target %s, SSH key not found: %v", internalTarget.displayName(), err)
+				continue
+			}
+			internalTarget.ssh = true
+			internalTarget.sshKey = keyPath
+		}
+		internalTarget.sshPassphrase = tc.SSHKeyPassphrase
+		internalTarget.sshHostKey = tc.SSHHostKey
+		internalTarget.sshInsecureHostKey = tc.SkipHostKeyCheck
+
+		if tc.ImageSignatureKey != "" {
+			keyPath := tc.ImageSignatureKey
+			if !filepath.IsAbs(keyPath) {
+				keyPath = filepath.Join("/opt", "mount", keyPath)
+			}
+			if _, err := os.Stat(keyPath); err != nil {
+				logger.Errorf("Skipping target %s, image signature key not found: %v", internalTarget.displayName(), err)
+				continue
+			}
+			internalTarget.imageSignatureKey = keyPath
 		}
 
 		if tc.VerifyCommitsInfo != nil {
 			internalTarget.gitsignVerify = tc.VerifyCommitsInfo.GitsignVerify
 			internalTarget.gitsignRekorURL = tc.VerifyCommitsInfo.GitsignRekorURL
+			keys, err := loadCommitKeys(tc.VerifyCommitsInfo)
+			if err != nil {
+				logger.Errorf("Skipping target %s, commit signing keys not loaded: %v", internalTarget.displayName(), err)
+				continue
+			}
+			if !keys.empty() {
+				if internalTarget.gitsignVerify {
+					logger.Errorf("Skipping target %s, gitsignVerify cannot be combined with gpgKeyring or sshAllowedSigners", internalTarget.displayName())
+					continue
+				}
+				internalTarget.commitKeys = keys
+			}
 		}
 
 		if tc.configReload != nil {
@@ -332,7 +506,15 @@ func getMethodTargetScheds(targetConfigs []*TargetConfig, fetchit *Fetchit) *Fet
 			for _, r := range tc.Raw {
 				r.initialRun = true
 				r.target = internalTarget
+				if r.PullImage && r.PullPolicy == "" {
+					deprecatedField(rawMethod, "target "+internalTarget.displayName(), "pullImage", "pullPolicy: Always")
+				}
 				fetchit.methodTargetScheds[r] = r.SchedInfo()
+				if r.WatchImages != "" {
+					w := newImageWatch(r)
+					fetchit.methodTargetScheds[w] = w.SchedInfo()
+					fetchit.allMethodTypes[imageWatchMethod] = struct{}{}
+				}
 			}
 		}
 		if len(tc.Systemd) > 0 {
@@ -343,10 +525,37 @@ func getMethodTargetScheds(targetConfigs []*TargetConfig, fetchit *Fetchit) *Fet
 				fetchit.methodTargetScheds[sd] = sd.SchedInfo()
 			}
 		}
+		if len(tc.Volume) > 0 {
+			fetchit.allMethodTypes[volumeMethod] = struct{}{}
+			for _, v := range tc.Volume {
+				v.initialRun = true
+				v.target = internalTarget
+				fetchit.methodTargetScheds[v] = v.SchedInfo()
+			}
+		}
 	}
 	return fetchit
 }
 
+// targetSchedule returns the schedule a target gives its methods which do not
+// set their own, from either its cron schedule or its pollInterval
+func targetSchedule(tc *TargetConfig) (string, error) {
+	switch {
+	case tc.Schedule != "" && tc.PollInterval != "":
+		return "", utils.Classify(utils.ErrValidation, fmt.Errorf("only one of schedule and pollInterval may be set"))
+	case tc.PollInterval != "":
+		interval, err := time.ParseDuration(tc.PollInterval)
+		if err != nil {
+			return "", utils.WrapErrClass(utils.ErrValidation, err, "Invalid pollInterval %s", tc.PollInterval)
+		}
+		if interval <= 0 {
+			return "", utils.Classify(utils.ErrValidation, fmt.Errorf("pollInterval %s must be positive", tc.PollInterval))
+		}
+		return "@every " + interval.String(), nil
+	}
+	return tc.Schedule, nil
+}
+
 func (f *Fetchit) RunTargets() {
 	for method := range f.methodTargetScheds {
 		// ConfigReload, PodmanAutoUpdateAll, Image, Prune methods do not include git URL
@@ -367,22 +576,49 @@ func (f *Fetchit) RunTargets() {
 		defer cancel()
 		mt := method.GetKind()
 		logger.Infof("Processing git target: %s Method: %s Name: %s", method.GetTarget().url, mt, method.GetName())
-		s.Cron(schedInfo.schedule).Tag(mt).Do(method.Process, ctx, f.conn, skew)
+		s.Cron(schedInfo.schedule).Tag(mt).Do(reconcile, ctx, f.conn, method, skew)
 		s.StartImmediately()
 	}
 	s.StartAsync()
 	select {}
 }
 
+// reconcile runs a scheduled Process of method through fetchit's connection
+// conn, or the session of the target's user, first replacing the podman
+// connection when it dropped since the last run
+func reconcile(ctx, conn context.Context, method Method, skew int) {
+	if t := method.GetTarget(); t != nil && isPaused(t) {
+		t.logger().Infof("Skipping %s %s, target %s is paused", method.GetKind(), method.GetName(), t.displayName())
+		return
+	}
+	conn, err := method.GetTarget().podmanConn(conn)
+	if err == nil {
+		conn, err = healthyConn(conn)
+	}
+	if err != nil {
+		method.GetTarget().logger().Errorf("Skipping %s %s, podman is unavailable: %v", method.GetKind(), method.GetName(), err)
+		return
+	}
+	method.Process(ctx, conn, skew)
+}
+
 func getRepo(target *Target) error {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	var err error
 	if target.url != "" && !target.disconnected {
-		getClone(target)
+		err = getClone(target)
 	} else if target.disconnected && len(target.url) > 0 {
-		getDisconnected(target)
+		err = getDisconnected(target)
 	} else if target.disconnected && len(target.device) > 0 {
-		getDeviceDisconnected(target)
+		err = getDeviceDisconnected(target)
+	} else {
+		return nil
 	}
-	return nil
+	if err == nil {
+		target.setCloned()
+	}
+	return err
 }
 
 func getClone(target *Target) error {
@@ -398,41 +634,38 @@ func getClone(target *Target) error {
 		if _, err := os.Stat(directory + "/.git"); err != nil {
 			return fmt.Errorf("%s exists but is not a git repository", directory)
 		}
+		// the existing clone is fetched into by getLatest, unless it is corrupt
+		if err := checkClone(directory); err != nil {
+			logger.Infof("Clone of %s in %s is corrupt, cloning again: %v", target.url, directory, err)
+			if err := os.RemoveAll(directory); err != nil {
+				return utils.WrapErr(err, "Error removing corrupt clone %s", directory)
+			}
+			exists = false
+		}
 	} else if !os.IsNotExist(err) {
 		return err
 	}
 	if !exists {
-		logger.Infof("git clone %s %s --recursive", target.url, target.branch)
-		// if the envSecret is set, use it as variable target.PAT
-		if target.envSecret != "" {
-			target.pat = os.Getenv(target.envSecret)
-			logger.Infof("Using the envSecret %s", target.envSecret)
+		logger.Infof("git clone %s %s --recursive", target.url, target.refName())
+		auth, err := gitAuth(target)
+		if err != nil {
+			return err
 		}
-		if target.pat != "" {
-			target.username = "fetchit"
-			target.password = target.pat
+		proxy, err := gitProxy(target)
+		if err != nil {
+			return err
 		}
-		// default to using existing http method
 		cOptions := &git.CloneOptions{
-			Auth: &githttp.BasicAuth{
-				Username: target.username, // the value of this field should not matter when using a PAT
-				Password: target.password,
-			},
-			URL:           target.url,
-			ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", target.branch)),
-			SingleBranch:  true,
-		}
-		// if using ssh, change auth to use ssh key
-		if target.ssh {
-			logger.Infof("git clone %s using SSH key %s ", target.url, target.sshKey)
-			authValue, err := ssh.NewPublicKeysFromFile("git", target.sshKey, target.password)
-			if err != nil {
-				logger.Infof("generate publickeys failed: %s", err.Error())
-				return err
-			}
-			cOptions.Auth = authValue
+			Auth:            auth,
+			URL:             target.url,
+			ReferenceName:   target.cloneReference(),
+			SingleBranch:    true,
+			Depth:           target.depth,
+			ProxyOptions:    proxy,
+			CABundle:        target.caBundle,
+			InsecureSkipTLS: target.insecureSkipTLS,
 		}
-		_, err := git.PlainClone(absPath, false, cOptions)
+		_, err = git.PlainClone(absPath, false, cOptions)
 		if err != nil {
 			logger.Infof("git clone failed: %s", err.Error())
 			return err
@@ -441,6 +674,21 @@ func getClone(target *Target) error {
 	return nil
 }
 
+// checkClone verifies that the clone in directory can be opened and that the
+// commit checked out is present
+func checkClone(directory string) error {
+	repo, err := git.PlainOpen(directory)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	_, err = repo.CommitObject(head.Hash())
+	return err
+}
+
 func getDisconnected(target *Target) error {
 	directory := getDirectory(target)
 	var exists bool
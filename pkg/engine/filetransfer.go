@@ -24,32 +24,36 @@ func (ft *FileTransfer) GetKind() string {
 
 func (ft *FileTransfer) Process(ctx, conn context.Context, skew int) {
 	target := ft.GetTarget()
+	log := target.logger()
 	time.Sleep(time.Duration(skew) * time.Millisecond)
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	defer target.lockRun(ft)()
 
 	if ft.initialRun {
-		err := getRepo(target)
+		err := target.retry(ctx, "clone "+target.url, func() error { return getRepo(target) })
 		if err != nil {
 			if len(target.url) > 0 {
-				logger.Errorf("Failed to clone repository at %s: %v", target.url, err)
+				log.Errorf("Failed to clone repository at %s: %v", target.url, err)
 				return
 			} else if len(target.localPath) > 0 {
-				logger.Errorf("Failed to clone repository %s: %v", target.localPath, err)
+				log.Errorf("Failed to clone repository %s: %v", target.localPath, err)
 				return
 			}
 		}
 
-		err = zeroToCurrent(ctx, conn, ft, target, nil)
+		err = target.retry(ctx, "move to current", func() error {
+			return zeroToCurrent(ctx, conn, ft, target, ft.fileTags(nil))
+		})
 		if err != nil {
-			logger.Errorf("Error moving to current: %v target url is: %s ", err, target.url)
+			log.Errorf("Error moving to current: %v target url is: %s ", err, target.url)
 			return
 		}
 	}
 
-	err := currentToLatest(ctx, conn, ft, target, nil)
+	err := target.retry(ctx, "move current to latest", func() error {
+		return currentToLatest(ctx, conn, ft, target, ft.fileTags(nil))
+	})
 	if err != nil {
-		logger.Errorf("Error moving current to latest: %v", err)
+		log.Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
@@ -68,7 +72,7 @@ func (ft *FileTransfer) MethodEngine(ctx, conn context.Context, change *object.C
 }
 
 func (ft *FileTransfer) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
-	changeMap, err := applyChanges(ctx, ft.GetTarget(), ft.GetTargetPath(), ft.Glob, currentState, desiredState, tags)
+	changeMap, err := applyChanges(ctx, &ft.CommonMethod, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
@@ -79,6 +83,7 @@ func (ft *FileTransfer) Apply(ctx, conn context.Context, currentState, desiredSt
 }
 
 func (ft *FileTransfer) fileTransferPodman(ctx, conn context.Context, path, dest string, prev *string) error {
+	log := ft.GetTarget().logger()
 	if prev != nil {
 		pathToRemove := filepath.Join(dest, filepath.Base(*prev))
 		s := generateSpecRemove(filetransferMethod, filepath.Base(pathToRemove), pathToRemove, dest, ft.Name)
@@ -97,7 +102,7 @@ func (ft *FileTransfer) fileTransferPodman(ctx, conn context.Context, path, dest
 		return nil
 	}
 
-	logger.Infof("Deploying file(s) %s", path)
+	log.Infof("Deploying file(s) %s", path)
 
 	file := filepath.Base(path)
 
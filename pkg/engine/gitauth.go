@@ -1,12 +1,30 @@
 package engine
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var defaultSSHKey = filepath.Join("/opt", "mount", ".ssh", "id_rsa")
 
+// defaultKnownHosts holds the host keys ssh repositories are verified against
+// unless SSH_KNOWN_HOSTS names another file, or a target pins its host key
+var defaultKnownHosts = filepath.Join("/opt", "mount", ".ssh", "known_hosts")
+
+// scpURL matches the scp-like form of ssh git URLs, e.g. git@github.com:org/repo.git
+var scpURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/]`)
+
 // Basic type needed for ssh authentication
 type GitAuth struct {
 	SSH        bool   `mapstructure:"ssh"`
@@ -24,3 +42,85 @@ func checkForPrivateKey(path string) error {
 	}
 	return nil
 }
+
+// isSSHURL reports whether a git URL uses the ssh transport
+func isSSHURL(url string) bool {
+	return strings.HasPrefix(url, "ssh://") || scpURL.MatchString(url)
+}
+
+// gitAuth returns the auth method for the target's repository, an ssh deploy
+// key for ssh URLs when a key is configured and otherwise http basic auth with
+// the username and password or PAT
+func gitAuth(target *Target) (transport.AuthMethod, error) {
+	if target.envSecret != "" {
+		logger.Infof("Using the envSecret %s", target.envSecret)
+		target.pat = os.Getenv(target.envSecret)
+	}
+	if target.pat != "" {
+		target.username = "fetchit"
+		target.password = target.pat
+	}
+	if !target.ssh || !isSSHURL(target.url) {
+		return &githttp.BasicAuth{
+			Username: target.username, // the value of this field should not matter when using a PAT
+			Password: target.password,
+		}, nil
+	}
+
+	logger.Infof("git clone %s using SSH key %s ", target.url, target.sshKey)
+	passphrase := target.sshPassphrase
+	if passphrase == "" {
+		passphrase = target.password
+	}
+	user := "git"
+	if i := strings.Index(strings.TrimPrefix(target.url, "ssh://"), "@"); i > 0 {
+		user = strings.TrimPrefix(target.url, "ssh://")[:i]
+	}
+	auth, err := ssh.NewPublicKeysFromFile(user, target.sshKey, passphrase)
+	if err != nil {
+		logger.Infof("generate publickeys failed: %s", err.Error())
+		return nil, err
+	}
+	switch {
+	case target.sshInsecureHostKey:
+		logger.Infof("Host key verification is disabled for %s", target.url)
+		auth.HostKeyCallback = gossh.InsecureIgnoreHostKey()
+	case target.sshHostKey != "":
+		callback, err := pinnedHostKey(target.sshHostKey)
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback = callback
+	default:
+		// The callback is built for the target rather than left to go-git,
+		// which reads SSH_KNOWN_HOSTS as set by whichever target ran last
+		knownHosts := os.Getenv("SSH_KNOWN_HOSTS")
+		if knownHosts == "" {
+			knownHosts = defaultKnownHosts
+		}
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error reading known hosts %s for %s", knownHosts, target.url)
+		}
+		auth.HostKeyCallback = callback
+	}
+	return auth, nil
+}
+
+// pinnedHostKey accepts only the given host key, either a public key in
+// authorized_keys format or its SHA256 fingerprint, e.g. SHA256:uNiVzt...
+func pinnedHostKey(pinned string) (gossh.HostKeyCallback, error) {
+	if strings.HasPrefix(pinned, "SHA256:") {
+		return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			if fingerprint := gossh.FingerprintSHA256(key); fingerprint != pinned {
+				return fmt.Errorf("host key %s of %s does not match the pinned key %s", fingerprint, hostname, pinned)
+			}
+			return nil
+		}, nil
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pinned))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sshHostKey, expected a public key or a SHA256 fingerprint: %w", err)
+	}
+	return gossh.FixedHostKey(key), nil
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"net/url"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// gitProxy returns the proxy used to clone and fetch a target's repository
+// from its httpProxy, httpsProxy and noProxy, which follow the semantics of the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. Only http and
+// https repository URLs are proxied. A target without proxy settings uses the
+// environment of fetchit.
+func gitProxy(target *Target) (transport.ProxyOptions, error) {
+	if target.proxy == nil {
+		return transport.ProxyOptions{}, nil
+	}
+	u, err := url.Parse(target.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return transport.ProxyOptions{}, nil
+	}
+	proxy, err := target.proxy.ProxyFunc()(u)
+	if err != nil {
+		return transport.ProxyOptions{}, utils.WrapErrClass(utils.ErrValidation, err, "Invalid proxy for %s", target.url)
+	}
+	if proxy == nil {
+		return transport.ProxyOptions{}, nil
+	}
+	opts := transport.ProxyOptions{}
+	if proxy.User != nil {
+		opts.Username = proxy.User.Username()
+		opts.Password, _ = proxy.User.Password()
+		proxy.User = nil
+	}
+	opts.URL = proxy.String()
+	return opts, nil
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// runningConfig is the view of the loaded config served over HTTP. It is
+// built once a config's targets are loaded and replaced as a whole on reload,
+// so handlers never read the maps a reload is writing.
+type runningConfig struct {
+	fetchit *Fetchit
+	// targets of the config, each once and sorted by name
+	targets []*Target
+	// methods of each target
+	methods map[*Target][]Method
+	// webhook of the config, nil when it has none
+	webhook *Webhook
+	// controlToken authorizes the pause, resume and redeploy controls, which
+	// are not served when it is empty
+	controlToken string
+}
+
+var running atomic.Value
+
+// publishConfig makes the methods and targets of a loaded config visible to
+// the HTTP handlers, and drops the webhook runs queued for the previous config
+func publishConfig(f *Fetchit, config *FetchitConfig) {
+	rc := &runningConfig{fetchit: f, methods: map[*Target][]Method{}, webhook: config.Webhook, controlToken: config.ControlToken}
+	for m := range f.methodTargetScheds {
+		t := m.GetTarget()
+		if t == nil {
+			continue
+		}
+		if _, ok := rc.methods[t]; !ok {
+			rc.targets = append(rc.targets, t)
+		}
+		rc.methods[t] = append(rc.methods[t], m)
+	}
+	sort.Slice(rc.targets, func(i, j int) bool { return rc.targets[i].displayName() < rc.targets[j].displayName() })
+	for _, methods := range rc.methods {
+		sort.Slice(methods, func(i, j int) bool { return metricsMethod(methods[i]) < metricsMethod(methods[j]) })
+	}
+	running.Store(rc)
+	drainTriggered()
+}
+
+// currentConfig returns the config last published, its fetchit is nil until
+// the first config is loaded
+func currentConfig() *runningConfig {
+	if rc, ok := running.Load().(*runningConfig); ok {
+		return rc
+	}
+	return &runningConfig{}
+}
+
+// healthz reports fetchit live while the scheduler running the polls of its targets is
+func healthz(w http.ResponseWriter, r *http.Request) {
+	f := currentConfig().fetchit
+	if f == nil || f.scheduler == nil || !f.scheduler.IsRunning() {
+		http.Error(w, "scheduler is not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports fetchit ready once the repository of every target has been
+// cloned or loaded at least once, targets without a repository are always ready
+func readyz(w http.ResponseWriter, r *http.Request) {
+	rc := currentConfig()
+	if rc.fetchit == nil {
+		http.Error(w, "config is not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	var waiting []string
+	for _, t := range rc.targets {
+		if (t.url != "" || t.device != "") && !t.Status().Cloned {
+			waiting = append(waiting, t.displayName())
+		}
+	}
+	if len(waiting) > 0 {
+		http.Error(w, "waiting for the repositories of "+strings.Join(waiting, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// status serves the status of each target as JSON, keyed by target name
+func status(w http.ResponseWriter, r *http.Request) {
+	statuses := map[string]TargetStatus{}
+	for _, t := range currentConfig().targets {
+		statuses[t.displayName()] = t.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		logger.Errorf("Error writing status: %v", err)
+	}
+}
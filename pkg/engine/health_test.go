@@ -0,0 +1,27 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestPublishConfig(t *testing.T) {
+	saved := currentConfig()
+	defer running.Store(saved)
+	web, db := &Target{name: "web"}, &Target{name: "db"}
+	f := &Fetchit{methodTargetScheds: map[Method]SchedInfo{
+		&Raw{CommonMethod: CommonMethod{Name: "b", target: web}}: {},
+		&Raw{CommonMethod: CommonMethod{Name: "a", target: web}}: {},
+		&Kube{CommonMethod: CommonMethod{Name: "k", target: db}}: {},
+	}}
+	publishConfig(f, &FetchitConfig{})
+	// A reload writing the map must not change what was published
+	f.methodTargetScheds[&Raw{CommonMethod: CommonMethod{Name: "c", target: web}}] = SchedInfo{}
+
+	rc := currentConfig()
+	if len(rc.targets) != 2 || rc.targets[0] != db || rc.targets[1] != web {
+		t.Fatalf("Failed: published targets %v", rc.targets)
+	}
+	if m := rc.methods[web]; len(m) != 2 || m[0].GetName() != "a" || m[1].GetName() != "b" {
+		t.Errorf("Failed: published methods of web %v", m)
+	}
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+const (
+	// hostUnitTimeout is how long to wait for required host units to become active
+	hostUnitTimeout = 5 * time.Minute
+	// hostUnitMaxBackoff caps the delay between checks of required host units
+	hostUnitMaxBackoff = 30 * time.Second
+)
+
+// waitHostUnits waits for each of the named host systemd units to be active,
+// checking with an increasing delay until hostUnitTimeout passes. The systemd
+// dbus socket of the host must be available to fetchit.
+func waitHostUnits(ctx context.Context, name string, units []string) error {
+	if len(units) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, hostUnitTimeout)
+	defer cancel()
+
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return utils.WrapErr(err, "Error connecting to systemd to check units required by container %s", name)
+	}
+	defer conn.Close()
+
+	// Units are waited for without holding the clone of the target, the file
+	// and env files of the container were read before
+	var stepIn func()
+	defer func() {
+		if stepIn != nil {
+			stepIn()
+		}
+	}()
+	delay := time.Second
+	for {
+		inactive, err := inactiveUnits(ctx, conn, units)
+		if err != nil {
+			return utils.WrapErr(err, "Error checking units required by container %s", name)
+		}
+		if len(inactive) == 0 {
+			return nil
+		}
+		logger.Infof("Waiting for host units %s required by container %s", strings.Join(inactive, ", "), name)
+		if stepIn == nil {
+			stepIn = stepOutOfCheckout(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return utils.Classify(utils.ErrTransient, fmt.Errorf("host units %s required by container %s are not active", strings.Join(inactive, ", "), name))
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > hostUnitMaxBackoff {
+			delay = hostUnitMaxBackoff
+		}
+	}
+}
+
+// inactiveUnits returns those of units which are not active, including units systemd does not know
+func inactiveUnits(ctx context.Context, conn *dbus.Conn, units []string) ([]string, error) {
+	statuses, err := conn.ListUnitsByNamesContext(ctx, units)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]bool, len(statuses))
+	for _, status := range statuses {
+		active[status.Name] = status.ActiveState == "active"
+	}
+	var inactive []string
+	for _, unit := range units {
+		if !active[unit] {
+			inactive = append(inactive, unit)
+		}
+	}
+	return inactive, nil
+}
@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ignoreFile lists paths of a target path which are never processed, in gitignore syntax
+const ignoreFile = ".fetchitignore"
+
+// ignoreMatcher reads the .fetchitignore file at the root of a target path's
+// tree, nil is returned when there is none
+func ignoreMatcher(tree *object.Tree) (gitignore.Matcher, error) {
+	f, err := tree.File(ignoreFile)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, utils.WrapErr(err, "Error reading %s", ignoreFile)
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error reading %s", ignoreFile)
+	}
+	var patterns []gitignore.Pattern
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+	return gitignore.NewMatcher(patterns), nil
+}
+
+// isIgnored reports whether a file, relative to the target path, is excluded by
+// the .fetchitignore file. The ignore file itself is never processed.
+func isIgnored(matcher gitignore.Matcher, name string) bool {
+	if name == ignoreFile {
+		return true
+	}
+	return matcher != nil && matcher.Match(strings.Split(name, "/"), false)
+}
@@ -36,8 +36,11 @@ func (i *Image) GetKind() string {
 func (i *Image) Process(ctx, conn context.Context, skew int) {
 	target := i.GetTarget()
 	time.Sleep(time.Duration(skew) * time.Millisecond)
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	defer target.lockRun(i)()
+	if target.dryRun {
+		logger.Infof("Dry run: image method %s would load an image", i.GetName())
+		return
+	}
 
 	if len(i.Url) > 0 {
 		err := i.loadHTTPPodman(ctx, conn, i.Url)
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+// validDigest matches a sha256 image digest, e.g. sha256:9f86d08...
+var validDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// imageDigest returns the digest of an image reference pinned by digest, such
+// as quay.io/fetchit/fetchit@sha256:..., or "" for a reference by tag
+func imageDigest(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	return ""
+}
+
+// verifyImageDigest checks that the local image has the expected digest, either
+// as the digest it was pulled by or as one of its repository digests
+func verifyImageDigest(conn context.Context, image, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	img, err := inspectImage(conn, image)
+	if err != nil {
+		return utils.WrapErr(err, "Error inspecting image %s", image)
+	}
+	if img.Digest.String() == expected {
+		return nil
+	}
+	for _, d := range img.RepoDigests {
+		if imageDigest(d) == expected {
+			return nil
+		}
+	}
+	return utils.Classify(utils.ErrValidation, fmt.Errorf("image %s has digest %s, expected %s", image, img.Digest, expected))
+}
+
+// digestProblems checks the ExpectedDigest of a raw container agrees with its Image
+func digestProblems(raw *RawPod) []string {
+	var problems []string
+	pinned := imageDigest(raw.Image)
+	if pinned != "" && !validDigest.MatchString(pinned) {
+		problems = append(problems, fmt.Sprintf("Image %s must be pinned by a sha256 digest", raw.Image))
+	}
+	if raw.ExpectedDigest == "" {
+		return problems
+	}
+	if !validDigest.MatchString(raw.ExpectedDigest) {
+		problems = append(problems, fmt.Sprintf("ExpectedDigest %q must be sha256: followed by 64 hex characters", raw.ExpectedDigest))
+	} else if pinned != "" && pinned != raw.ExpectedDigest {
+		problems = append(problems, fmt.Sprintf("ExpectedDigest %s does not match the digest of Image %s", raw.ExpectedDigest, raw.Image))
+	}
+	return problems
+}
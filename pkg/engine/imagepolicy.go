@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/gobwas/glob"
+)
+
+// imagePolicy restricts the images a target may deploy
+type imagePolicy struct {
+	allowed []imagePattern
+	denied  []imagePattern
+}
+
+type imagePattern struct {
+	pattern string
+	glob    glob.Glob
+}
+
+// newImagePolicy compiles the allowedImages and deniedImages of a target, nil
+// is returned when neither is set
+func newImagePolicy(allowed, denied []string) (*imagePolicy, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	compile := func(field string, patterns []string) ([]imagePattern, error) {
+		var result []imagePattern
+		for _, p := range patterns {
+			g, err := glob.Compile(p, '/')
+			if err != nil {
+				return nil, utils.WrapErrClass(utils.ErrValidation, err, "Error compiling %s pattern %q", field, p)
+			}
+			result = append(result, imagePattern{pattern: p, glob: g})
+		}
+		return result, nil
+	}
+	var p imagePolicy
+	var err error
+	if p.allowed, err = compile("allowedImages", allowed); err != nil {
+		return nil, err
+	}
+	if p.denied, err = compile("deniedImages", denied); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// match returns the first pattern matching the image with or without its tag
+// or digest
+func match(patterns []imagePattern, ref reference.Named) (string, bool) {
+	for _, p := range patterns {
+		if p.glob.Match(ref.String()) || p.glob.Match(ref.Name()) {
+			return p.pattern, true
+		}
+	}
+	return "", false
+}
+
+// check fails for an image the policy does not allow. Images must be fully
+// qualified, as podman may resolve a short name to any search registry.
+func (p *imagePolicy) check(image string) error {
+	if p == nil {
+		return nil
+	}
+	ref, err := reference.ParseNamed(image)
+	if err != nil {
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("image %q is not allowed by the image policy, images must be fully qualified such as docker.io/library/nginx:latest", image))
+	}
+	if pattern, ok := match(p.denied, ref); ok {
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("image %s is not allowed by the image policy, it matches deniedImages pattern %q", image, pattern))
+	}
+	if len(p.allowed) > 0 {
+		if _, ok := match(p.allowed, ref); !ok {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("image %s is not allowed by the image policy, it matches no allowedImages pattern", image))
+		}
+	}
+	return nil
+}
+
+// checkImages checks the images of every container of a raw file against the
+// target's image policy
+func (t *Target) checkImages(raw *RawPod) error {
+	containers := []*RawPod{raw}
+	if raw.isPod() {
+		containers = containerRefs(raw.Containers)
+	}
+	for _, c := range containers {
+		if err := t.imagePolicy.check(c.Image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kubeImages returns the images of the containers, init containers and
+// ephemeral containers of any kind of object in a kube file
+func kubeImages(kubeYaml []byte) ([]string, error) {
+	docs, err := kubeDocuments(kubeYaml)
+	if err != nil {
+		return nil, err
+	}
+	images := map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				if list, ok := child.([]interface{}); ok && (key == "containers" || key == "initContainers" || key == "ephemeralContainers") {
+					for _, c := range list {
+						if c, ok := c.(map[string]interface{}); ok {
+							if image, ok := c["image"].(string); ok {
+								images[image] = true
+							}
+						}
+					}
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	for _, doc := range docs {
+		walk(doc)
+	}
+	result := make([]string, 0, len(images))
+	for image := range images {
+		result = append(result, image)
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+)
+
+var (
+	sigstoreRegistriesOnce sync.Once
+	sigstoreRegistriesDir  string
+	sigstoreRegistriesErr  error
+)
+
+// sigstoreRegistries returns a registries.d directory which has containers/image
+// read the sigstore signatures, as pushed by cosign, attached to images in any registry
+func sigstoreRegistries() (string, error) {
+	sigstoreRegistriesOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "fetchit-registries.d")
+		if err != nil {
+			sigstoreRegistriesErr = err
+			return
+		}
+		config := []byte("default-docker:\n  use-sigstore-attachments: true\n")
+		sigstoreRegistriesErr = ioutil.WriteFile(filepath.Join(dir, "fetchit.yaml"), config, 0600)
+		sigstoreRegistriesDir = dir
+	})
+	return sigstoreRegistriesDir, sigstoreRegistriesErr
+}
+
+// verifyImageSignature verifies the sigstore signature of an image in its registry
+// against the public key of the target, using the method's registry credentials.
+// It returns the digest of the verified manifest, which the pulled image must match.
+func verifyImageSignature(ctx context.Context, t *Target, name string, opts *images.PullOptions) (string, error) {
+	ref, err := docker.ParseReference("//" + name)
+	if err != nil {
+		return "", utils.WrapErrClass(utils.ErrValidation, err, "Error parsing image %s", name)
+	}
+	dir, err := sigstoreRegistries()
+	if err != nil {
+		return "", utils.WrapErr(err, "Error configuring sigstore attachments")
+	}
+	sys := &types.SystemContext{RegistriesDirPath: dir}
+	if opts != nil {
+		sys.AuthFilePath = opts.GetAuthfile()
+		if opts.GetUsername() != "" {
+			sys.DockerAuthConfig = &types.DockerAuthConfig{Username: opts.GetUsername(), Password: opts.GetPassword()}
+		}
+		if p, ok := pullPlatform(opts); ok {
+			sys.OSChoice, sys.ArchitectureChoice, sys.VariantChoice = p.OS, p.Arch, p.Variant
+		}
+	}
+	if t.insecureSkipTLS {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	if sys.DockerCertPath, err = caCertDir(t); err != nil {
+		return "", utils.WrapErr(err, "Error writing caFile of target %s", t.displayName())
+	}
+
+	// cosign signs the repository, so the signature is accepted for any tag of it
+	req, err := signature.NewPRSigstoreSignedKeyPath(t.imageSignatureKey, signature.NewPRMMatchRepository())
+	if err != nil {
+		return "", utils.WrapErrClass(utils.ErrValidation, err, "Error loading image signature key %s", t.imageSignatureKey)
+	}
+	policy, err := signature.NewPolicyContext(&signature.Policy{Default: signature.PolicyRequirements{req}})
+	if err != nil {
+		return "", err
+	}
+	defer policy.Destroy()
+
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error reading image %s from its registry", name)
+	}
+	defer src.Close()
+	unparsed := image.UnparsedInstance(src, nil)
+	if allowed, err := policy.IsRunningImageAllowed(ctx, unparsed); !allowed {
+		return "", utils.WrapErrClass(utils.ErrValidation, err, "Image %s is not signed by key %s", name, t.imageSignatureKey)
+	}
+	b, _, err := unparsed.Manifest(ctx)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error reading manifest of image %s", name)
+	}
+	digest, err := manifest.Digest(b)
+	if err != nil {
+		return "", utils.WrapErr(err, "Error computing digest of image %s", name)
+	}
+	t.logger().Infof("Verified signature of image %s at %s, signed by key %s", name, digest, t.imageSignatureKey)
+	return digest.String(), nil
+}
+
+// fetchImage pulls the image of a raw container with the method's pull policy and
+// verifies it. When the target has an image signature key the signature is verified
+// before the image is pulled, and unless the policy is Never the image is always
+// pulled so the local image is the one verified.
+func (r *Raw) fetchImage(ctx, conn context.Context, raw *RawPod) error {
+	t := r.GetTarget()
+	expected := raw.ExpectedDigest
+	policy, err := r.pullPolicy()
+	if err != nil {
+		return err
+	}
+	opts, err := r.platformPullOptions(conn, raw)
+	if err != nil {
+		return err
+	}
+	if t.imageSignatureKey != "" {
+		verified, err := verifyImageSignature(ctx, t, raw.Image, opts)
+		if err != nil {
+			return err
+		}
+		if expected != "" && expected != verified {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("signed image %s has digest %s, expected %s", raw.Image, verified, expected))
+		}
+		expected = verified
+		if policy != pullNever {
+			policy = pullAlways
+		}
+	}
+	if err := detectOrFetchImage(conn, raw.Image, policy, opts); err != nil {
+		return err
+	}
+	return verifyImageDigest(conn, raw.Image, expected)
+}
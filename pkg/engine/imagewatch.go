@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const imageWatchMethod = "imagewatch"
+
+// imageWatch periodically checks the images of the containers deployed by a raw
+// method, on its own schedule, and recreates containers whose image tag has
+// moved to a new digest upstream without a change in git
+type imageWatch struct {
+	raw *Raw
+}
+
+func newImageWatch(r *Raw) *imageWatch {
+	return &imageWatch{raw: r}
+}
+
+func (w *imageWatch) GetName() string {
+	return w.raw.GetName()
+}
+
+func (w *imageWatch) GetKind() string {
+	return imageWatchMethod
+}
+
+func (w *imageWatch) GetTarget() *Target {
+	return w.raw.GetTarget()
+}
+
+func (w *imageWatch) SchedInfo() SchedInfo {
+	return SchedInfo{
+		schedule: w.raw.WatchImages,
+		skew:     w.raw.Skew,
+	}
+}
+
+func (w *imageWatch) Process(ctx, conn context.Context, skew int) {
+	time.Sleep(time.Duration(skew) * time.Millisecond)
+	target := w.GetTarget()
+	log := target.logger()
+	// The watch redeploys files of the raw method, so it runs as one of its runs
+	defer target.lockRun(w.raw)()
+	ctx, release := holdCheckout(ctx, target)
+	defer release()
+	if target.dryRun {
+		return
+	}
+
+	current, err := getCurrent(target, rawMethod, w.raw.GetName())
+	if err != nil {
+		log.Errorf("Error getting current commit for image watch of %s: %v", w.raw.GetName(), err)
+		return
+	}
+	// Nothing has been deployed yet, the git reconcile will pull fresh images
+	if current == plumbing.ZeroHash {
+		return
+	}
+
+	// The redeploy of a stale image expands name tokens with the deployed commit
+	ctx, _ = newReconcileResult(ctx, w.raw, target, current, current)
+	changeMap, err := applyChanges(ctx, &w.raw.CommonMethod, plumbing.ZeroHash, current, w.raw.fileTags(rawTags))
+	if err != nil {
+		log.Errorf("Error listing files for image watch of %s: %v", w.raw.GetName(), err)
+		return
+	}
+	for change, path := range changeMap {
+		if path == deleteFile {
+			continue
+		}
+		if err := w.checkFile(ctx, conn, change, path); err != nil {
+			log.Errorf("Image watch of %s failed for %s: %v", w.raw.GetName(), path, err)
+		}
+	}
+}
+
+func (w *imageWatch) MethodEngine(ctx context.Context, conn context.Context, change *object.Change, path string) error {
+	return nil
+}
+
+func (w *imageWatch) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
+	return nil
+}
+
+// checkFile recreates the container deployed from path when its image is stale
+func (w *imageWatch) checkFile(ctx, conn context.Context, change *object.Change, path string) error {
+	log := w.GetTarget().logger()
+	rawFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	raw, err := w.raw.parseRawPod(rawFile, change.To.Name)
+	if err != nil {
+		return err
+	}
+	if !raw.enabled() {
+		return nil
+	}
+	policy, err := w.raw.pullPolicy()
+	if err != nil {
+		return err
+	}
+	// Images are never pulled under Never, so there is nothing to watch
+	if policy == pullNever {
+		return nil
+	}
+	watched := []*RawPod{raw}
+	if raw.isPod() {
+		watched = containerRefs(raw.Containers)
+	}
+	for _, c := range watched {
+		// Images pinned by digest, in Image or ExpectedDigest, never move
+		if imageDigest(c.Image) != "" || c.ExpectedDigest != "" {
+			continue
+		}
+		opts, err := w.raw.platformPullOptions(conn, c)
+		if err != nil {
+			return err
+		}
+		name := c.Name
+		if hasNameTokens(name) {
+			// The container runs under the name expanded when it was deployed
+			if name, err = w.raw.deployedInstance(conn, c.Name); err != nil {
+				return err
+			}
+			if name == "" {
+				log.Infof("No container deployed as %s from %s, skipping its image check", c.Name, path)
+				continue
+			}
+		}
+		updated, err := imageUpdated(conn, name, c.Image, watchPullPolicy(policy), opts)
+		if err != nil {
+			return err
+		}
+		if updated {
+			log.Infof("Image %s of container %s has a newer digest, recreating the %s", c.Image, name, raw.describe())
+			return inChange(ctx, func() error { return w.raw.rawPodman(ctx, conn, change, path) })
+		}
+	}
+	return nil
+}
+
+// watchPullPolicy maps the pull policy of a method to the podman pull policy of
+// its image watch. Always pulls on every check, and as the watch exists to
+// find newer images, IfNotPresent pulls only when the registry has a newer one.
+func watchPullPolicy(policy string) string {
+	if policy == pullAlways {
+		return "always"
+	}
+	return "newer"
+}
+
+// imageUpdated pulls image by the podman pull policy and reports whether the
+// local image now differs from the one the container runs
+func imageUpdated(conn context.Context, name, image, policy string, opts *images.PullOptions) (bool, error) {
+	exists, err := containerExists(conn, name)
+	if err != nil || !exists {
+		return false, err
+	}
+	ctr, err := inspectContainer(conn, name)
+	if err != nil {
+		return false, utils.WrapErr(err, "Error inspecting container %s", name)
+	}
+
+	_, err, _ = imagePulls.Do(pullKey(image, policy, opts), func() (interface{}, error) {
+		return nil, withPodman(conn, pullTimeout(), "pull image "+image, func(ctx context.Context) error {
+			_, err := images.Pull(ctx, image, opts.WithPolicy(policy).WithQuiet(true))
+			return err
+		})
+	})
+	if err != nil {
+		return false, utils.WrapErr(err, "Error checking registry for a newer %s", image)
+	}
+	local, err := inspectImage(conn, image)
+	if err != nil {
+		return false, utils.WrapErr(err, "Error inspecting image %s", image)
+	}
+	return local.ID != ctr.Image, nil
+}
@@ -5,15 +5,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/libpod/define"
 	"github.com/containers/podman/v4/pkg/bindings"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
 	"github.com/containers/podman/v4/pkg/bindings/play"
+	"github.com/containers/podman/v4/pkg/bindings/pods"
 	"github.com/containers/podman/v4/pkg/domain/entities"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -24,11 +29,20 @@ import (
 	k8syaml "sigs.k8s.io/yaml"
 )
 
-const kubeMethod = "kube"
+const (
+	kubeMethod = "kube"
+
+	kubeOnFailureLeave    = "leave"
+	kubeOnFailureRollback = "rollback"
+)
 
 // Kube to launch pods using podman kube-play
 type Kube struct {
 	CommonMethod `mapstructure:",squash"`
+	// OnFailure controls what happens to the resources of a YAML file which
+	// partially applied, either "leave" (default) to keep what was created and
+	// report the error or "rollback" to remove everything created from the file
+	OnFailure string `mapstructure:"onFailure"`
 }
 
 func (k *Kube) GetKind() string {
@@ -37,35 +51,73 @@ func (k *Kube) GetKind() string {
 
 func (k *Kube) Process(ctx, conn context.Context, skew int) {
 	target := k.GetTarget()
+	log := target.logger()
 	time.Sleep(time.Duration(skew) * time.Millisecond)
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	defer target.lockRun(k)()
 
 	initial := k.initialRun
-	tag := []string{"yaml", "yml"}
+	tag := k.fileTags([]string{"yaml", "yml"})
 	if initial {
-		err := getRepo(target)
+		err := target.retry(ctx, "clone "+target.url, func() error { return getRepo(target) })
 		if err != nil {
-			logger.Errorf("Failed to clone repository %s: %v", target.url, err)
+			log.Errorf("Failed to clone repository %s: %v", target.url, err)
 			return
 		}
 
-		err = zeroToCurrent(ctx, conn, k, target, &tag)
+		err = target.retry(ctx, "move to current", func() error {
+			return zeroToCurrent(ctx, conn, k, target, tag)
+		})
 		if err != nil {
-			logger.Errorf("Error moving to current: %v", err)
+			log.Errorf("Error moving to current: %v", err)
 			return
 		}
 	}
 
-	err := currentToLatest(ctx, conn, k, target, &tag)
+	err := target.retry(ctx, "move current to latest", func() error {
+		return currentToLatest(ctx, conn, k, target, tag)
+	})
 	if err != nil {
-		logger.Errorf("Error moving current to latest: %v", err)
+		log.Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
+	if !initial {
+		k.replaceBrokenPods(ctx, conn, tag)
+	}
+
 	k.initialRun = false
 }
 
+// replaceBrokenPods plays again the files at the current commit with pods
+// which exist but are broken, as no commit may touch them for a long time
+func (k *Kube) replaceBrokenPods(ctx, conn context.Context, tag *[]string) {
+	target := k.GetTarget()
+	if target.dryRun {
+		return
+	}
+	log := target.logger()
+	ctx, release := holdCheckout(ctx, target)
+	defer release()
+	current, err := getCurrent(target, k.GetKind(), k.GetName())
+	if err != nil || current.IsZero() {
+		return
+	}
+	changeMap, err := applyChanges(ctx, &k.CommonMethod, plumbing.ZeroHash, current, tag)
+	if err != nil {
+		log.Errorf("Error listing the files of kube method %s to check their pods: %v", k.Name, err)
+		return
+	}
+	for _, path := range changeMap {
+		kubeYaml, err := ioutil.ReadFile(path)
+		if err != nil || len(brokenPods(conn, kubeYaml)) == 0 {
+			continue
+		}
+		if err := inChange(ctx, func() error { return k.kubePodman(ctx, conn, path, nil) }); err != nil {
+			log.Errorf("Error replacing broken pods of %s: %v", path, err)
+		}
+	}
+}
+
 func (k *Kube) MethodEngine(ctx context.Context, conn context.Context, change *object.Change, path string) error {
 	prev, err := getChangeString(change)
 	if err != nil {
@@ -75,7 +127,7 @@ func (k *Kube) MethodEngine(ctx context.Context, conn context.Context, change *o
 }
 
 func (k *Kube) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
-	changeMap, err := applyChanges(ctx, k.GetTarget(), k.GetTargetPath(), k.Glob, currentState, desiredState, tags)
+	changeMap, err := applyChanges(ctx, &k.CommonMethod, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
@@ -86,8 +138,18 @@ func (k *Kube) Apply(ctx, conn context.Context, currentState, desiredState plumb
 }
 
 func (k *Kube) kubePodman(ctx, conn context.Context, path string, prev *string) error {
+	log := k.GetTarget().logger()
+	switch k.OnFailure {
+	case "", kubeOnFailureLeave, kubeOnFailureRollback:
+	default:
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("invalid onFailure %q for kube method %s, must be %s or %s", k.OnFailure, k.Name, kubeOnFailureLeave, kubeOnFailureRollback))
+	}
+
 	if path != deleteFile {
-		logger.Infof("Creating podman container from %s using kube method", path)
+		log.Infof("Creating podman container from %s using kube method", path)
+		if err := k.checkImages(path); err != nil {
+			return utils.WrapErr(err, "Error deploying %s, its pods were left running", path)
+		}
 	}
 
 	if prev != nil {
@@ -103,6 +165,11 @@ func (k *Kube) kubePodman(ctx, conn context.Context, path string, prev *string)
 			return utils.WrapErr(err, "Error reading file")
 		}
 
+		// Pods left broken by an earlier partial failure are replaced along with healthy ones
+		for _, name := range brokenPods(conn, kubeYaml) {
+			log.Infof("Pod %s from %s is broken, replacing it", name, path)
+		}
+
 		// Try stopping the pods, don't care if they don't exist
 		err = stopPods(conn, kubeYaml)
 		if err != nil {
@@ -111,15 +178,55 @@ func (k *Kube) kubePodman(ctx, conn context.Context, path string, prev *string)
 			}
 		}
 
-		err = createPods(conn, path, kubeYaml)
+		err = createPods(conn, path, kubeYaml, k.kubeOptions())
 		if err != nil {
-			return utils.WrapErr(err, "Error creating pod")
+			if k.OnFailure != kubeOnFailureRollback {
+				log.Infof("Leaving resources created from %s in place after failure, they will be replaced on the next reconcile", path)
+				return utils.WrapErr(err, "Error creating pod")
+			}
+			if rbErr := stopPods(conn, kubeYaml); rbErr != nil && !strings.Contains(rbErr.Error(), "no such pod") {
+				log.Errorf("Error rolling back resources created from %s: %v", path, rbErr)
+				return utils.WrapErr(err, "Error creating pod")
+			}
+			// The pods of the previous version of the file were stopped above
+			if prev != nil {
+				if rbErr := k.playPrevious(conn, path, []byte(*prev)); rbErr != nil {
+					log.Errorf("Error restoring the previous version of %s: %v", path, rbErr)
+					return utils.WrapErr(err, "Error creating pod, rolled back %s without its previous version", path)
+				}
+				log.Infof("Rolled back %s to its previous version", path)
+				return utils.WrapErr(err, "Error creating pod, rolled back %s to its previous version", path)
+			}
+			log.Infof("Rolled back resources created from %s", path)
+			return utils.WrapErr(err, "Error creating pod, rolled back %s", path)
 		}
 	}
 
 	return nil
 }
 
+// checkImages checks the images of a kube file against the target's image policy
+func (k *Kube) checkImages(path string) error {
+	policy := k.GetTarget().imagePolicy
+	if policy == nil {
+		return nil
+	}
+	kubeYaml, err := ioutil.ReadFile(path)
+	if err != nil {
+		return utils.WrapErr(err, "Error reading file")
+	}
+	images, err := kubeImages(kubeYaml)
+	if err != nil {
+		return utils.WrapErrClass(utils.ErrValidation, err, "Error reading images of %s", path)
+	}
+	for _, image := range images {
+		if err := policy.check(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func stopPods(ctx context.Context, podSpec []byte) error {
 	conn, err := bindings.GetClient(ctx)
 	if err != nil {
@@ -139,7 +246,7 @@ func stopPods(ctx context.Context, podSpec []byte) error {
 	return nil
 }
 
-func createPods(ctx context.Context, path string, specs []byte) error {
+func createPods(ctx context.Context, path string, specs []byte, opts *play.KubeOptions) error {
 	pod_list, err := podFromBytes(specs)
 	if err != nil {
 		return utils.WrapErr(err, "Error getting list of pods in spec")
@@ -152,15 +259,87 @@ func createPods(ctx context.Context, path string, specs []byte) error {
 		}
 	}
 
-	_, err = play.Kube(ctx, path, nil)
+	report, err := play.Kube(ctx, path, opts)
 	if err != nil {
 		return utils.WrapErr(err, "Error playing kube spec")
 	}
+	// Containers failing to start do not fail the play, leaving the pod partially applied
+	for _, pod := range report.Pods {
+		if len(pod.ContainerErrors) > 0 {
+			return fmt.Errorf("pod %s partially applied: %s", pod.ID, strings.Join(pod.ContainerErrors, "; "))
+		}
+	}
 
 	logger.Infof("Created pods from spec in %s", path)
 	return nil
 }
 
+// playPrevious plays the previous version of a file again after its new
+// version was rolled back
+func (k *Kube) playPrevious(ctx context.Context, path string, prev []byte) error {
+	f, err := ioutil.TempFile("", "fetchit-kube-*.yaml")
+	if err != nil {
+		return utils.WrapErr(err, "Error creating file for the previous version of %s", path)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(prev)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return utils.WrapErr(err, "Error writing the previous version of %s", path)
+	}
+	return createPods(ctx, f.Name(), prev, k.kubeOptions())
+}
+
+// brokenPods returns the pods of the spec which exist but are broken
+func brokenPods(ctx context.Context, specs []byte) []string {
+	podList, err := podFromBytes(specs)
+	if err != nil {
+		return nil
+	}
+	var broken []string
+	for _, pod := range podList {
+		exists, err := pods.Exists(ctx, pod.ObjectMeta.Name, nil)
+		if err != nil || !exists {
+			continue
+		}
+		inspect, err := pods.Inspect(ctx, pod.ObjectMeta.Name, nil)
+		if err != nil || inspect.InspectPodData == nil {
+			continue
+		}
+		var exitCodes []int32
+		if inspect.State == define.PodStateExited {
+			for _, c := range inspect.Containers {
+				if ctr, err := containers.Inspect(ctx, c.ID, nil); err == nil && ctr.State != nil {
+					exitCodes = append(exitCodes, ctr.State.ExitCode)
+				}
+			}
+		}
+		if podBroken(inspect.State, exitCodes) {
+			broken = append(broken, pod.ObjectMeta.Name)
+		}
+	}
+	return broken
+}
+
+// podBroken reports whether a pod in state, whose containers exited with
+// exitCodes, is broken. A pod whose containers all completed successfully,
+// such as a job, is not.
+func podBroken(state string, exitCodes []int32) bool {
+	switch state {
+	case define.PodStateDegraded, define.PodStateErrored:
+		return true
+	case define.PodStateExited:
+		for _, code := range exitCodes {
+			if code != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func podFromBytes(input []byte) ([]v1.Pod, error) {
 	var t metav1.TypeMeta
 	d := yaml.NewDecoder(bytes.NewReader(input))
@@ -207,6 +386,36 @@ func podFromBytes(input []byte) ([]v1.Pod, error) {
 	return ret, nil
 }
 
+// kubeDocuments decodes each document of a kube file as JSON would
+func kubeDocuments(input []byte) ([]interface{}, error) {
+	d := yaml.NewDecoder(bytes.NewReader(input))
+	var docs []interface{}
+	for {
+		var i interface{}
+		err := d.Decode(&i)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error decoding yaml")
+		}
+		o, err := yaml.Marshal(i)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error marshalling yaml into object for conversion to json")
+		}
+		b, err := k8syaml.YAMLToJSON(o)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error converting yaml to json")
+		}
+		var doc interface{}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, utils.WrapErr(err, "Error unmarshalling json object")
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
 func validatePod(p v1.Pod) error {
 	for _, container := range p.Spec.Containers {
 		if container.Name == p.ObjectMeta.Name {
@@ -0,0 +1,25 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/containers/podman/v4/libpod/define"
+)
+
+func TestPodBroken(t *testing.T) {
+	for _, tt := range []struct {
+		state     string
+		exitCodes []int32
+		broken    bool
+	}{
+		{define.PodStateRunning, nil, false},
+		{define.PodStateDegraded, nil, true},
+		{define.PodStateErrored, nil, true},
+		{define.PodStateExited, []int32{0, 0}, false},
+		{define.PodStateExited, []int32{0, 1}, true},
+	} {
+		if got := podBroken(tt.state, tt.exitCodes); got != tt.broken {
+			t.Errorf("Failed: pod %s with exit codes %v broken %v, want %v", tt.state, tt.exitCodes, got, tt.broken)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonLogs is set when the config selects JSON logs, every target then logs
+// with its name in the target field
+var jsonLogs bool
+
+// setLogFormat switches the loggers to the logFormat of the config, text is the default
+func setLogFormat(format string) error {
+	switch format {
+	case "", logFormatText:
+		if jsonLogs {
+			InitLogger()
+		}
+		jsonLogs = false
+	case logFormatJSON:
+		initLogger(getJSONEncoder())
+		jsonLogs = true
+	default:
+		return fmt.Errorf("invalid logFormat %s, must be text or json", format)
+	}
+	return nil
+}
+
+// formatCore writes each entry through logCore, so that a config reload can
+// change the log format without replacing the loggers in use
+type formatCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func (c *formatCore) With(fields []zapcore.Field) zapcore.Core {
+	return &formatCore{
+		LevelEnabler: c.LevelEnabler,
+		fields:       append(append([]zapcore.Field(nil), c.fields...), fields...),
+	}
+}
+
+func (c *formatCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *formatCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	core := logCore.Load().(zapcore.Core)
+	return core.Write(e, append(c.fields[:len(c.fields):len(c.fields)], fields...))
+}
+
+func (c *formatCore) Sync() error {
+	return logCore.Load().(zapcore.Core).Sync()
+}
+
+// getJSONEncoder encodes each line as a JSON object with the timestamp, level
+// and message, followed by the fields of the line such as target and method
+func getJSONEncoder() zapcore.Encoder {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.TimeKey = "timestamp"
+	cfg.MessageKey = "message"
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	cfg.EncodeLevel = zapcore.LowercaseLevelEncoder
+	return zapcore.NewJSONEncoder(cfg)
+}
+
+// methodLogger returns the logger of a method's target with the method, and
+// the file and commit being applied when they are known, as fields
+func methodLogger(ctx context.Context, m Method, file string) *zap.SugaredLogger {
+	t := m.GetTarget()
+	log := t.logger()
+	if t != nil && t.log == nil {
+		log = log.With("target", t.displayName())
+	}
+	log = log.With("method", dryRunKey(m))
+	if file != "" {
+		log = log.With("file", file)
+	}
+	if result := reconcileResultFrom(ctx); result != nil {
+		log = log.With("commit", result.Commit)
+	}
+	return log
+}
+
+// logChange logs the outcome of applying a changed file as a deploy event with
+// its action and, when it failed, its error
+func logChange(ctx context.Context, m Method, change *object.Change, err error) {
+	file := changeFile(change)
+	action := changeAction(change)
+	log := methodLogger(ctx, m, file).With("action", action)
+	if err != nil {
+		log.With("error", err.Error()).Errorf("Failed to %s %s", action, file)
+		return
+	}
+	log.Infof("Applied %s of %s", action, file)
+}
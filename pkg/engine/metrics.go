@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var deprecatedFieldTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fetchit_deprecated_field_total",
+	Help: "Number of times a deprecated field was found in a config or manifest.",
+}, []string{"method", "field"})
+
+var deploysTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fetchit_deploys_total",
+	Help: "Number of changed files deployed, by target, method and result.",
+}, []string{"target", "method", "result"})
+
+var pollsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fetchit_polls_total",
+	Help: "Number of polls of a target by a method, by result.",
+}, []string{"target", "method", "result"})
+
+var pollDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "fetchit_poll_duration_seconds",
+	Help:    "Duration of each poll of a target by a method, including fetching and applying changes.",
+	Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+}, []string{"target", "method"})
+
+var lastSuccessTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fetchit_last_success_timestamp_seconds",
+	Help: "Unix time of the last poll of a target by a method which succeeded.",
+}, []string{"target", "method"})
+
+var lastAppliedCommit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fetchit_last_applied_commit_info",
+	Help: "The commit last applied to a target by a method, as the commit label with value 1.",
+}, []string{"target", "method", "commit"})
+
+// metricsMethod is the method label of metrics, its kind and name
+func metricsMethod(m Method) string {
+	return m.GetKind() + "/" + m.GetName()
+}
+
+func resultOf(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// observePoll records the duration and result of a poll of a target by a method
+func observePoll(t *Target, m Method, start time.Time, err error) {
+	target, method := t.displayName(), metricsMethod(m)
+	pollDuration.WithLabelValues(target, method).Observe(time.Since(start).Seconds())
+	pollsTotal.WithLabelValues(target, method, resultOf(err)).Inc()
+	if err == nil {
+		lastSuccessTime.WithLabelValues(target, method).SetToCurrentTime()
+	}
+}
+
+// observeDeploy counts the deploy of a changed file
+func observeDeploy(t *Target, m Method, err error) {
+	deploysTotal.WithLabelValues(t.displayName(), metricsMethod(m), resultOf(err)).Inc()
+}
+
+// observeCommit replaces the commit last applied to a target by a method
+func observeCommit(t *Target, m Method, commit string) {
+	target, method := t.displayName(), metricsMethod(m)
+	lastAppliedCommit.DeletePartialMatch(prometheus.Labels{"target": target, "method": method})
+	lastAppliedCommit.WithLabelValues(target, method, commit).Set(1)
+}
+
+var httpOnce sync.Once
+
+// serveHTTP serves fetchit's metrics at /metrics on the config's metricsAddress,
+// e.g. :9090, along with the /healthz and /readyz probes, the /status of each
+// target, and the webhook and the /pause, /resume and /redeploy controls when
+// they are configured. The server is started once, on the address of the first
+// config loaded, and the webhook and controls follow the path, secret and
+// control token of the config currently loaded.
+func serveHTTP(config *FetchitConfig) {
+	addr := config.MetricsAddress
+	httpOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/healthz", healthz)
+		mux.HandleFunc("/readyz", readyz)
+		mux.HandleFunc("/status", status)
+		// The webhook is served on the path of the config currently loaded
+		mux.HandleFunc("/", webhookHandler())
+		// The controls authorize requests with the token of the config currently loaded
+		mux.HandleFunc("/pause", controlHandler(true))
+		mux.HandleFunc("/resume", controlHandler(false))
+		mux.HandleFunc("/redeploy", redeployHandler())
+		go func() {
+			logger.Infof("Serving metrics and health on %s", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logger.Errorf("Error serving metrics and health on %s: %v", addr, err)
+			}
+		}()
+	})
+}
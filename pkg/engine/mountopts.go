@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mountOptionAliases translates the long forms of podman's --mount options to
+// the options podman expects in a spec
+var mountOptionAliases = map[string]string{
+	"relabel=shared":  "z",
+	"relabel=private": "Z",
+	"readonly":        "ro",
+	"readonly=true":   "ro",
+	"readonly=false":  "rw",
+	"ro=true":         "ro",
+	"ro=false":        "rw",
+}
+
+// mountOptionGroups are options of which a mount may set only one
+var mountOptionGroups = [][]string{
+	{"rw", "ro"},
+	{"z", "Z"},
+	{"exec", "noexec"},
+	{"suid", "nosuid"},
+	{"dev", "nodev"},
+	{"copy", "nocopy"},
+	{"bind", "rbind"},
+	{"tmpcopyup", "notmpcopyup"},
+	{"private", "rprivate", "slave", "rslave", "shared", "rshared", "unbindable", "runbindable"},
+}
+
+// mountOptions are the options accepted by each kind of mount, options with a
+// value such as size=64m are listed by name
+var mountOptions = map[string][]string{
+	"Mounts":  {"rw", "ro", "z", "Z", "U", "O", "exec", "noexec", "suid", "nosuid", "dev", "nodev", "bind", "rbind", "idmap", "private", "rprivate", "slave", "rslave", "shared", "rshared", "unbindable", "runbindable"},
+	"Volumes": {"rw", "ro", "z", "Z", "U", "O", "exec", "noexec", "suid", "nosuid", "dev", "nodev", "copy", "nocopy", "idmap", "private", "rprivate", "slave", "rslave", "shared", "rshared", "unbindable", "runbindable"},
+	"Tmpfs":   {"rw", "ro", "U", "exec", "noexec", "suid", "nosuid", "dev", "nodev", "size", "mode", "tmpcopyup", "notmpcopyup"},
+}
+
+// mountKind returns the kind of mount whose options a mount of mountType
+// takes, or "" for types such as devpts whose options are left to podman
+func mountKind(mountType string) string {
+	switch strings.ToLower(mountType) {
+	case "", "bind":
+		return "Mounts"
+	case "volume":
+		return "Volumes"
+	case "tmpfs":
+		return "Tmpfs"
+	}
+	return ""
+}
+
+// normalizeMountOptions translates the long forms of options to the z, Z, ro and rw
+// shorthands podman relabels and mounts host paths by, and rejects options unknown
+// for the kind of mount, Mounts, Volumes or Tmpfs, or which conflict with each other.
+// The options of any other kind are returned as they are.
+func normalizeMountOptions(kind, dest string, opts []string) ([]string, error) {
+	if len(opts) == 0 || mountOptions[kind] == nil {
+		return opts, nil
+	}
+	result := make([]string, 0, len(opts))
+	for _, opt := range opts {
+		opt = strings.TrimSpace(opt)
+		if alias, ok := mountOptionAliases[strings.ToLower(opt)]; ok {
+			opt = alias
+		}
+		name := strings.SplitN(opt, "=", 2)[0]
+		if !containsString(mountOptions[kind], name) {
+			return nil, fmt.Errorf("%s at %s has unknown option %q", kind, dest, opt)
+		}
+		result = append(result, opt)
+	}
+	for _, group := range mountOptionGroups {
+		var found []string
+		for _, opt := range result {
+			if containsString(group, opt) {
+				found = append(found, opt)
+			}
+		}
+		if len(found) > 1 {
+			return nil, fmt.Errorf("%s at %s can only set one of %s", kind, dest, strings.Join(found, ", "))
+		}
+	}
+	return result, nil
+}
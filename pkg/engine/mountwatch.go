@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/fsnotify/fsnotify"
+)
+
+// mountRestartDelay groups the burst of events of a single update to a mount
+// source, such as a write followed by a rename, into one restart
+const mountRestartDelay = 2 * time.Second
+
+// mountWatches restarts containers when the host source of one of their bind
+// mounts marked restartOnChange changes
+var mountWatches = &mountWatcher{
+	containers: map[string]*watchedContainer{},
+	sources:    map[string]map[string]bool{},
+	dirs:       map[string]int{},
+}
+
+type mountWatcher struct {
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	// containers maps each container name to its watched mounts
+	containers map[string]*watchedContainer
+	// sources maps each watched mount source to the names of containers mounting it
+	sources map[string]map[string]bool
+	// dirs counts the watched sources within each directory watched by fsnotify
+	dirs map[string]int
+}
+
+type watchedContainer struct {
+	conn    context.Context
+	timeout *uint
+	sources []string
+	dirs    []string
+	restart *time.Timer
+}
+
+// set replaces the watched mounts of the named container with those of mounts
+// marked restartOnChange, no mounts stops watching for the container
+func (m *mountWatcher) set(conn context.Context, name string, timeout *uint, mounts []mount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(name)
+
+	var wc *watchedContainer
+	for _, mt := range mounts {
+		if !mt.RestartOnChange {
+			continue
+		}
+		source := filepath.Clean(mt.Source)
+		info, err := os.Stat(source)
+		if err != nil {
+			logger.Errorf("Unable to watch mount source %s of container %s, it must be mounted into fetchit at the same path: %v", source, name, err)
+			continue
+		}
+		// Watch the directory of a file source so that files replaced by a rename are still seen
+		dir := source
+		if !info.IsDir() {
+			dir = filepath.Dir(source)
+		}
+		if m.dirs[dir] == 0 {
+			if err := m.ensureWatcher(); err != nil {
+				logger.Errorf("Unable to watch mount sources: %v", err)
+				return
+			}
+			if err := m.watcher.Add(dir); err != nil {
+				logger.Errorf("Unable to watch mount source %s of container %s: %v", source, name, err)
+				continue
+			}
+		}
+		m.dirs[dir]++
+		if m.sources[source] == nil {
+			m.sources[source] = map[string]bool{}
+		}
+		m.sources[source][name] = true
+		if wc == nil {
+			wc = &watchedContainer{conn: conn, timeout: timeout}
+		}
+		wc.sources = append(wc.sources, source)
+		wc.dirs = append(wc.dirs, dir)
+		logger.Infof("Watching mount source %s of container %s for changes", source, name)
+	}
+	if wc != nil {
+		m.containers[name] = wc
+	}
+}
+
+// remove stops watching the mounts of the named container, m.mu must be held
+func (m *mountWatcher) remove(name string) {
+	wc, ok := m.containers[name]
+	if !ok {
+		return
+	}
+	if wc.restart != nil {
+		wc.restart.Stop()
+	}
+	for _, source := range wc.sources {
+		delete(m.sources[source], name)
+		if len(m.sources[source]) == 0 {
+			delete(m.sources, source)
+		}
+	}
+	for _, dir := range wc.dirs {
+		m.dirs[dir]--
+		if m.dirs[dir] == 0 {
+			delete(m.dirs, dir)
+			m.watcher.Remove(dir)
+		}
+	}
+	delete(m.containers, name)
+}
+
+func (m *mountWatcher) ensureWatcher() error {
+	if m.watcher != nil {
+		return nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	m.watcher = w
+	go m.run(w)
+	return nil
+}
+
+func (m *mountWatcher) run(w *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			m.changed(event.Name)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf("Error watching mount sources: %v", err)
+		}
+	}
+}
+
+// changed schedules a restart of the containers mounting path, either directly
+// or through its directory
+func (m *mountWatcher) changed(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, source := range []string{path, filepath.Dir(path)} {
+		for name := range m.sources[source] {
+			wc := m.containers[name]
+			if wc.restart != nil {
+				wc.restart.Reset(mountRestartDelay)
+				continue
+			}
+			name := name
+			wc.restart = time.AfterFunc(mountRestartDelay, func() { m.restart(name) })
+		}
+	}
+}
+
+func (m *mountWatcher) restart(name string) {
+	m.mu.Lock()
+	wc, ok := m.containers[name]
+	if ok {
+		wc.restart = nil
+	}
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	opts := new(containers.RestartOptions)
+	if wc.timeout != nil {
+		opts = opts.WithTimeout(int(*wc.timeout))
+	}
+	logger.Infof("Mount source of container %s changed, restarting it", name)
+	err := withPodman(wc.conn, stopBound(wc.timeout), "restart container "+name, func(ctx context.Context) error {
+		return containers.Restart(ctx, name, opts)
+	})
+	if err != nil {
+		logger.Errorf("Error restarting container %s after its mount source changed: %v", name, err)
+	}
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+)
+
+// Tokens which may be used in the Name of a raw container so that each deploy
+// creates a uniquely named container, e.g. web-{{.ShortSHA}}. The file template
+// leaves them in place and they are expanded when the container is created.
+const (
+	shortSHAToken  = "{{.ShortSHA}}"
+	commitToken    = "{{.Commit}}"
+	timestampToken = "{{.Timestamp}}"
+	// nameTimestampFormat formats {{.Timestamp}} with characters podman accepts in a name
+	nameTimestampFormat = "20060102-150405"
+	// nameTemplateLabel holds the unexpanded name of a container whose name
+	// has tokens, which finds the instances deployed by earlier commits
+	nameTemplateLabel = "fetchit.name"
+)
+
+// nameTokenPattern matches the name tokens with any spacing, e.g. {{ .ShortSHA }}
+var nameTokenPattern = regexp.MustCompile(`\{\{\s*\.(ShortSHA|Commit|Timestamp)\s*\}\}`)
+
+// canonicalNameTokens rewrites the name tokens of a file which is not rendered
+// as a template to the spacing hasNameTokens and expandNameTokens look for
+func canonicalNameTokens(b []byte) []byte {
+	return nameTokenPattern.ReplaceAll(b, []byte("{{.$1}}"))
+}
+
+// hasNameTokens reports whether a container name is expanded on deploy
+func hasNameTokens(name string) bool {
+	return strings.Contains(name, shortSHAToken) || strings.Contains(name, commitToken) || strings.Contains(name, timestampToken)
+}
+
+// expandNameTokens replaces the tokens of a container name with the commit
+// being deployed and the time of the deploy
+func expandNameTokens(name, commit string, now time.Time) string {
+	short := commit
+	if len(short) > hashReportLen {
+		short = short[:hashReportLen]
+	}
+	return strings.NewReplacer(
+		shortSHAToken, short,
+		commitToken, commit,
+		timestampToken, now.UTC().Format(nameTimestampFormat),
+	).Replace(name)
+}
+
+// expandName expands the tokens in the Name of a raw container for the commit
+// being applied, keeping the unexpanded name to label the container with
+func (r *Raw) expandName(ctx context.Context, raw *RawPod) {
+	if !hasNameTokens(raw.Name) {
+		return
+	}
+	var commit string
+	if result := reconcileResultFrom(ctx); result != nil {
+		commit = result.Commit
+	}
+	raw.nameTemplate = raw.Name
+	raw.Name = expandNameTokens(raw.Name, commit, time.Now())
+}
+
+// stableName is the name identifying the container of a raw file across
+// deploys, the unexpanded name when its name has tokens
+func (raw *RawPod) stableName() string {
+	if raw.nameTemplate != "" {
+		return raw.nameTemplate
+	}
+	return raw.Name
+}
+
+// deployedInstance returns the name of the newest container this method
+// deployed from a name with tokens, or "" when there is none
+func (r *Raw) deployedInstance(conn context.Context, template string) (string, error) {
+	filters := r.ownedFilters()
+	filters["label"] = append(filters["label"], fmt.Sprintf("%s=%s", nameTemplateLabel, template))
+	var instances []entities.ListContainer
+	err := withPodman(conn, podmanTimeout(), "list containers", func(ctx context.Context) error {
+		var err error
+		instances, err = containers.List(ctx, new(containers.ListOptions).WithAll(true).WithFilters(filters))
+		return err
+	})
+	if err != nil {
+		return "", utils.WrapErr(err, "Error listing containers deployed as %s", template)
+	}
+	var name string
+	var created time.Time
+	for _, c := range instances {
+		if len(c.Names) > 0 && (name == "" || c.Created.After(created)) {
+			name, created = c.Names[0], c.Created
+		}
+	}
+	return name, nil
+}
+
+// deleteInstances removes the containers this method deployed from a name with
+// tokens, except the one named keep. They are found by their label as their
+// names differ with each deploy.
+func (r *Raw) deleteInstances(conn context.Context, template, keep string, timeout *uint) error {
+	filters := r.ownedFilters()
+	filters["label"] = append(filters["label"], fmt.Sprintf("%s=%s", nameTemplateLabel, template))
+	var instances []entities.ListContainer
+	err := withPodman(conn, podmanTimeout(), "list containers", func(ctx context.Context) error {
+		var err error
+		instances, err = containers.List(ctx, new(containers.ListOptions).WithAll(true).WithFilters(filters))
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error listing containers deployed as %s", template)
+	}
+	for _, c := range instances {
+		if len(c.Names) == 0 || c.Names[0] == keep {
+			continue
+		}
+		name := c.Names[0]
+		r.disableUnits(conn, []string{containerUnit(name)})
+		if err := deleteContainer(conn, name, timeout); err != nil {
+			return err
+		}
+		if fetchit != nil {
+			fetchit.state.setContainerHash(r.GetTarget(), name, "")
+		}
+		mountWatches.set(conn, name, nil, nil)
+		r.GetTarget().logger().Infof("Deleted podman container %s deployed as %s", name, template)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// concurrentMethod is implemented by methods which can apply the changes of a
+// commit concurrently. Changes sharing a key are applied one after another.
+type concurrentMethod interface {
+	concurrency() int
+	changeKeys(change *object.Change, path string) []string
+}
+
+// changeFailure is a change which failed to apply
+type changeFailure struct {
+	file string
+	err  error
+}
+
+// runChangesConcurrently applies the changes of a method with at most limit
+// groups of changes in flight. Changes sharing a key are grouped and applied in
+// the order of their files, stopping at the first failure of the group. All
+// failures are reported in the order of their files, the error returned wraps
+// the first of them.
+func runChangesConcurrently(ctx, conn context.Context, m Method, changeMap map[*object.Change]string, cm concurrentMethod, limit int) error {
+	groups := groupChanges(changeMap, cm)
+	var mu sync.Mutex
+	var failures []changeFailure
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for _, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(group []*object.Change) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			conn := conn
+			for _, change := range group {
+				var err error
+				if conn, err = runChange(ctx, conn, m, change, changeMap[change]); err != nil {
+					mu.Lock()
+					failures = append(failures, changeFailure{file: changeFile(change), err: err})
+					mu.Unlock()
+					return
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	if len(failures) == 0 {
+		return nil
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].file < failures[j].file })
+	if len(failures) == 1 {
+		return failures[0].err
+	}
+	files := make([]string, 0, len(failures))
+	for _, f := range failures {
+		files = append(files, f.file)
+	}
+	return utils.WrapErr(failures[0].err, "%d of %d changes failed (%s), first error in %s", len(failures), len(changeMap), strings.Join(files, ", "), failures[0].file)
+}
+
+// groupChanges groups changes which share a key, each group and the changes
+// within it are ordered by file
+func groupChanges(changeMap map[*object.Change]string, cm concurrentMethod) [][]*object.Change {
+	changes := make([]*object.Change, 0, len(changeMap))
+	for change := range changeMap {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changeFile(changes[i]) < changeFile(changes[j]) })
+
+	// each change starts in its own group, and groups are merged when a change
+	// has a key already seen
+	parent := make([]int, len(changes))
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	owners := map[string]int{}
+	for i, change := range changes {
+		parent[i] = i
+		for _, key := range cm.changeKeys(change, changeMap[change]) {
+			if j, ok := owners[key]; ok {
+				parent[find(i)] = find(j)
+			} else {
+				owners[key] = i
+			}
+		}
+	}
+
+	var groups [][]*object.Change
+	index := map[int]int{}
+	for i, change := range changes {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], change)
+	}
+	return groups
+}
+
+func (r *Raw) concurrency() int {
+	return r.Concurrency
+}
+
+// changeKeys returns the files, container, pod and volume names and host ports
+// of both versions of a changed raw file, so changes to files which replace
+// each other's containers or share a volume or port are not applied at once
+func (r *Raw) changeKeys(change *object.Change, path string) []string {
+	var keys []string
+	// an added file has no From name and a deleted file no To name, which
+	// must not group every addition or deletion together
+	for _, name := range []string{change.From.Name, change.To.Name} {
+		if name != "" {
+			keys = append(keys, "file:"+name)
+		}
+	}
+	add := func(raw *RawPod) {
+		for _, name := range raw.containerNames() {
+			keys = append(keys, "container:"+name)
+		}
+		if raw.isPod() {
+			keys = append(keys, "pod:"+raw.Pod)
+		}
+		for _, vol := range rawVolumes(raw) {
+			keys = append(keys, "volume:"+vol.Name)
+		}
+		for _, b := range hostBindings(raw.Ports) {
+			keys = append(keys, fmt.Sprintf("port:%d/%s", b.port, b.protocol))
+		}
+	}
+	if path != deleteFile {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			if raw, err := r.parseRawPod(b, change.To.Name); err == nil {
+				add(raw)
+			}
+		}
+	}
+	if prev, err := getChangeString(change); err == nil && prev != nil {
+		if raw, err := r.parsePrevRawPod([]byte(*prev), change.From.Name); err == nil {
+			add(raw)
+		}
+	}
+	return keys
+}
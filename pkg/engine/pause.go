@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// pausedTargets holds the names of paused targets, so a target stays paused
+// when a config reload replaces it
+var pausedTargets = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+func isPaused(t *Target) bool {
+	pausedTargets.RLock()
+	defer pausedTargets.RUnlock()
+	return pausedTargets.names[t.displayName()]
+}
+
+// setPaused pauses or resumes a target, it reports whether the target changed
+func setPaused(t *Target, paused bool) bool {
+	pausedTargets.Lock()
+	defer pausedTargets.Unlock()
+	name := t.displayName()
+	if pausedTargets.names[name] == paused {
+		return false
+	}
+	if paused {
+		pausedTargets.names[name] = true
+	} else {
+		delete(pausedTargets.names, name)
+	}
+	return true
+}
+
+// controlHandler pauses, or resumes, the target named by the target query
+// parameter of a POST carrying the control token as a bearer token. A resumed
+// target is run immediately to catch up with the commits it skipped.
+func controlHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, target := controlTarget(w, r)
+		if target == nil {
+			return
+		}
+		name := target.displayName()
+		if !setPaused(target, pause) {
+			fmt.Fprintf(w, "target %s is already %s\n", name, pausedState(pause))
+			return
+		}
+		logger.Infof("Target %s %s", name, pausedState(pause))
+		if !pause {
+			trigger(target)
+		}
+		fmt.Fprintf(w, "target %s %s\n", name, pausedState(pause))
+	}
+}
+
+// controlTarget authorizes a control request with the control token of the
+// config currently loaded and returns the target named by its target query
+// parameter. On failure the error is written and the target is nil.
+func controlTarget(w http.ResponseWriter, r *http.Request) (*Fetchit, *Target) {
+	rc := currentConfig()
+	if rc.controlToken == "" {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "controls must be POSTed", http.StatusMethodNotAllowed)
+		return nil, nil
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(rc.controlToken)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return nil, nil
+	}
+	if rc.fetchit == nil {
+		http.Error(w, "config is not loaded", http.StatusServiceUnavailable)
+		return nil, nil
+	}
+	name := r.URL.Query().Get("target")
+	for _, t := range rc.targets {
+		if t.displayName() == name {
+			return rc.fetchit, t
+		}
+	}
+	http.Error(w, fmt.Sprintf("no target named %q", name), http.StatusNotFound)
+	return nil, nil
+}
+
+func pausedState(paused bool) string {
+	if paused {
+		return "paused"
+	}
+	return "resumed"
+}
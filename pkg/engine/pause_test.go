@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestControlHandler(t *testing.T) {
+	target := &Target{name: "web"}
+	saved, savedLogger := currentConfig(), logger
+	defer func() { running.Store(saved); logger = savedLogger }()
+	logger = zap.NewNop().Sugar()
+	publishConfig(&Fetchit{methodTargetScheds: map[Method]SchedInfo{&Raw{CommonMethod: CommonMethod{target: target}}: {}}}, &FetchitConfig{ControlToken: "token"})
+
+	pause := controlHandler(true)
+	for _, tt := range []struct {
+		auth, name string
+		want       int
+	}{
+		{"Bearer wrong", "web", http.StatusUnauthorized},
+		{"Bearer token", "other", http.StatusNotFound},
+		{"Bearer token", "web", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pause?target="+tt.name, nil)
+		req.Header.Set("Authorization", tt.auth)
+		w := httptest.NewRecorder()
+		pause(w, req)
+		if w.Code != tt.want {
+			t.Errorf("pause %s with %q returned %d, want %d", tt.name, tt.auth, w.Code, tt.want)
+		}
+	}
+	if !target.Status().Paused {
+		t.Fatalf("Failed: target web is not paused")
+	}
+	setPaused(target, false)
+	if target.Status().Paused {
+		t.Fatalf("Failed: target web is still paused")
+	}
+
+	// A reload rotating or removing the token applies to the next request
+	f := currentConfig().fetchit
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"rotated", http.StatusUnauthorized},
+		{"", http.StatusNotFound},
+	} {
+		publishConfig(f, &FetchitConfig{ControlToken: tt.token})
+		req := httptest.NewRequest(http.MethodPost, "/pause?target=web", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		pause(w, req)
+		if w.Code != tt.want {
+			t.Errorf("pause with control token %q returned %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+}
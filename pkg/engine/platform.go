@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+)
+
+// platform is the os/arch[/variant] an image is pulled for, e.g. linux/arm64
+type platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// parsePlatform parses a Platform in the os/arch[/variant] format of podman's --platform
+func parsePlatform(p string) (platform, error) {
+	parts := strings.Split(p, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return platform{}, fmt.Errorf("invalid Platform %q, must be os/arch or os/arch/variant, e.g. linux/arm64", p)
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t") {
+			return platform{}, fmt.Errorf("invalid Platform %q, must be os/arch or os/arch/variant, e.g. linux/arm64", p)
+		}
+	}
+	result := platform{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		result.Variant = parts[2]
+	}
+	return result, nil
+}
+
+func (p platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Arch + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Arch
+}
+
+// hostPlatform returns the platform of the podman host
+func hostPlatform(conn context.Context) (platform, error) {
+	info, err := podmanInfo(conn)
+	if err != nil {
+		return platform{}, utils.WrapErr(err, "Error getting podman info for the host platform")
+	}
+	return platform{OS: info.Host.OS, Arch: info.Host.Arch}, nil
+}
+
+// platformPullOptions returns the method's pull options for the Platform of a
+// raw container, or for the platform of the podman host when it sets none, so
+// a local image of another platform is never reused
+func (r *Raw) platformPullOptions(conn context.Context, raw *RawPod) (*images.PullOptions, error) {
+	var p platform
+	var err error
+	if raw.Platform != "" {
+		if p, err = parsePlatform(raw.Platform); err != nil {
+			return nil, utils.Classify(utils.ErrValidation, err)
+		}
+	} else if p, err = hostPlatform(conn); err != nil {
+		return nil, err
+	}
+	opts := r.pullOptions().WithOS(p.OS).WithArch(p.Arch)
+	if p.Variant != "" {
+		opts = opts.WithVariant(p.Variant)
+	}
+	return opts, nil
+}
+
+// pullPlatform returns the platform set on pull options, ok is false when the
+// pull is for podman's default platform
+func pullPlatform(opts *images.PullOptions) (platform, bool) {
+	if opts == nil || opts.Arch == nil {
+		return platform{}, false
+	}
+	return platform{OS: opts.GetOS(), Arch: opts.GetArch(), Variant: opts.GetVariant()}, true
+}
+
+// localPlatformMatches reports whether the local image has the OS and
+// architecture of the platform. Podman does not report the variant of an
+// image, so images differing only in variant are treated as matching.
+func localPlatformMatches(conn context.Context, image string, p platform) (bool, error) {
+	img, err := images.GetImage(conn, image, nil)
+	if err != nil {
+		return false, utils.WrapErr(err, "Error inspecting image %s", image)
+	}
+	return (p.OS == "" || img.Os == p.OS) && img.Architecture == p.Arch, nil
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings"
+	"github.com/containers/podman/v4/pkg/bindings/system"
+)
+
+const (
+	defaultPodmanURI = "unix://run/podman/podman.sock"
+	// defaultReconnectTimeout is how long to keep reconnecting to a podman socket
+	// which dropped, long enough for podman to be upgraded and restarted
+	defaultReconnectTimeout = 2 * time.Minute
+	podmanPingTimeout       = 10 * time.Second
+)
+
+type podmanConnKey struct{}
+
+// podmanConn holds the connection to a podman socket and replaces it when the
+// socket drops, for example when podman is restarted. Connections it returns
+// carry the podmanConn so that a broken connection can be replaced by any code
+// it is passed to.
+type podmanConn struct {
+	mu      sync.Mutex
+	uri     string
+	conn    context.Context
+	timeout time.Duration
+}
+
+// newPodmanConn connects to the podman socket at uri and returns the connection
+func newPodmanConn(ctx context.Context, uri string) (context.Context, error) {
+	p := &podmanConn{uri: uri, timeout: defaultReconnectTimeout}
+	conn, err := bindings.NewConnection(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	p.conn = context.WithValue(conn, podmanConnKey{}, p)
+	return p.conn, nil
+}
+
+// podmanConnFrom returns the podmanConn of a connection, or nil for a
+// connection which was not created by newPodmanConn
+func podmanConnFrom(conn context.Context) *podmanConn {
+	p, _ := conn.Value(podmanConnKey{}).(*podmanConn)
+	return p
+}
+
+// setReconnectTimeout sets how long a dropped connection is retried, zero disables reconnecting
+func setReconnectTimeout(conn context.Context, timeout time.Duration) {
+	if p := podmanConnFrom(conn); p != nil {
+		p.mu.Lock()
+		p.timeout = timeout
+		p.mu.Unlock()
+	}
+}
+
+// healthyConn checks a connection at the start of a reconcile and returns it,
+// or a replacement when the socket no longer responds
+func healthyConn(conn context.Context) (context.Context, error) {
+	p := podmanConnFrom(conn)
+	if p == nil {
+		return conn, nil
+	}
+	current := p.current()
+	ctx, cancel := context.WithTimeout(current, podmanPingTimeout)
+	defer cancel()
+	if _, err := system.Version(ctx, nil); err == nil {
+		return current, nil
+	} else if !isConnError(err) {
+		return nil, utils.WrapErr(err, "Error checking the podman connection")
+	}
+	return p.reconnect(current)
+}
+
+// reconnectConn replaces a connection which failed with err when err shows
+// the socket dropped, returning false when err is not a connection error
+func reconnectConn(conn context.Context, err error) (context.Context, bool) {
+	p := podmanConnFrom(conn)
+	if p == nil || !isConnError(err) {
+		return conn, false
+	}
+	logger.Infof("Lost connection to podman at %s: %v", p.uri, err)
+	newConn, rErr := p.reconnect(conn)
+	if rErr != nil {
+		logger.Errorf("Error reconnecting to podman: %v", rErr)
+		return conn, false
+	}
+	return newConn, true
+}
+
+func (p *podmanConn) current() context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn
+}
+
+// reconnect replaces the broken connection, retrying with backoff until the
+// reconnect timeout. A connection already replaced by another caller is reused.
+// The lock is only held to read and swap the connection, so callers using a
+// working connection are not held up by the backoff.
+func (p *podmanConn) reconnect(broken context.Context) (context.Context, error) {
+	p.mu.Lock()
+	if p.conn != broken {
+		defer p.mu.Unlock()
+		return p.conn, nil
+	}
+	timeout := p.timeout
+	p.mu.Unlock()
+	if timeout <= 0 {
+		return nil, utils.Classify(utils.ErrTransient, errors.New("connection to podman dropped and reconnecting is disabled"))
+	}
+
+	deadline := time.Now().Add(timeout)
+	delay := time.Second
+	for {
+		conn, err := bindings.NewConnection(context.Background(), p.uri)
+		if err == nil {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.conn == broken {
+				p.conn = context.WithValue(conn, podmanConnKey{}, p)
+				logger.Infof("Reconnected to podman at %s", p.uri)
+			}
+			return p.conn, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, utils.WrapErrClass(utils.ErrTransient, err, "Error reconnecting to podman at %s", p.uri)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > 15*time.Second {
+			delay = 15 * time.Second
+		}
+		// Another caller may have reconnected meanwhile
+		if current := p.current(); current != broken {
+			return current, nil
+		}
+	}
+}
+
+// isConnError reports whether err shows the podman socket itself failed,
+// rather than podman reporting an error for the request
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
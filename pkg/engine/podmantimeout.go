@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/containers/podman/v4/pkg/bindings/system"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+)
+
+const (
+	// defaultPodmanTimeout bounds each call to podman other than image pulls
+	defaultPodmanTimeout = 2 * time.Minute
+	// defaultPullTimeout bounds each image pull
+	defaultPullTimeout = 15 * time.Minute
+)
+
+// podmanTimeout returns the configured bound of a podman call
+func podmanTimeout() time.Duration {
+	if fetchit != nil && fetchit.podmanTimeout > 0 {
+		return fetchit.podmanTimeout
+	}
+	return defaultPodmanTimeout
+}
+
+// pullTimeout returns the configured bound of an image pull
+func pullTimeout() time.Duration {
+	if fetchit != nil && fetchit.pullTimeout > 0 {
+		return fetchit.pullTimeout
+	}
+	return defaultPullTimeout
+}
+
+// parseTimeout parses the timeout of a config field, an invalid or non-positive
+// value is logged and def is used
+func parseTimeout(field, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		logger.Errorf("Invalid %s %s, using %s", field, value, def)
+		return def
+	}
+	return timeout
+}
+
+// withPodman runs fn with a context derived from conn which expires after
+// timeout. The podman bindings send their requests with the context they are
+// given, so a stuck podman socket fails the call instead of blocking the
+// method's runs forever. A call which times out fails with a transient error,
+// so it is retried like any other transient failure. desc completes "Podman did
+// not ..." in the error.
+func withPodman(conn context.Context, timeout time.Duration, desc string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(conn, timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return utils.WrapErrClass(utils.ErrTransient, err, "Podman did not %s within %s", desc, timeout)
+	}
+	return err
+}
+
+// stopBound extends the podman timeout by a container's stop timeout, podman
+// waits that long before it kills the container
+func stopBound(timeout *uint) time.Duration {
+	if timeout == nil {
+		return podmanTimeout()
+	}
+	return podmanTimeout() + time.Duration(*timeout)*time.Second
+}
+
+// containerExists reports whether a container exists, bounded by podmanTimeout
+func containerExists(conn context.Context, name string) (bool, error) {
+	var exists bool
+	err := withPodman(conn, podmanTimeout(), "check container "+name, func(ctx context.Context) error {
+		var err error
+		exists, err = containers.Exists(ctx, name, nil)
+		return err
+	})
+	return exists, err
+}
+
+// inspectContainer inspects a container, bounded by podmanTimeout
+func inspectContainer(conn context.Context, name string) (*define.InspectContainerData, error) {
+	var ctr *define.InspectContainerData
+	err := withPodman(conn, podmanTimeout(), "inspect container "+name, func(ctx context.Context) error {
+		var err error
+		ctr, err = containers.Inspect(ctx, name, nil)
+		return err
+	})
+	return ctr, err
+}
+
+// inspectImage inspects a local image, bounded by podmanTimeout
+func inspectImage(conn context.Context, image string) (*entities.ImageInspectReport, error) {
+	var img *entities.ImageInspectReport
+	err := withPodman(conn, podmanTimeout(), "inspect image "+image, func(ctx context.Context) error {
+		var err error
+		img, err = images.GetImage(ctx, image, nil)
+		return err
+	})
+	return img, err
+}
+
+// podmanInfo returns the info of the podman host, bounded by podmanTimeout
+func podmanInfo(conn context.Context) (*define.Info, error) {
+	var info *define.Info
+	err := withPodman(conn, podmanTimeout(), "report its info", func(ctx context.Context) error {
+		var err error
+		info, err = system.Info(ctx, nil)
+		return err
+	})
+	return info, err
+}
+
+// startContainer starts an existing container, bounded by podmanTimeout
+func startContainer(conn context.Context, name string) error {
+	err := withPodman(conn, podmanTimeout(), "start container "+name, func(ctx context.Context) error {
+		return containers.Start(ctx, name, nil)
+	})
+	audit(conn, auditContainer, name, "", "start", err)
+	return err
+}
+
+// stopContainer stops a container, bounded by stopBound of its stop timeout
+func stopContainer(conn context.Context, name string, timeout *uint) error {
+	opts := new(containers.StopOptions)
+	if timeout != nil {
+		opts = opts.WithTimeout(*timeout)
+	}
+	err := withPodman(conn, stopBound(timeout), "stop container "+name, func(ctx context.Context) error {
+		return containers.Stop(ctx, name, opts)
+	})
+	audit(conn, auditContainer, name, "", "stop", err)
+	return err
+}
@@ -4,29 +4,121 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	// zones are validated against the embedded tz database, the fetchit image
+	// may not include one
+	_ "time/tzdata"
 
 	"github.com/containers/common/libnetwork/types"
+	"github.com/containers/common/pkg/capabilities"
+	"github.com/containers/common/pkg/signal"
 	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/podman/v4/libpod/define"
 	"github.com/containers/podman/v4/pkg/bindings/containers"
+	networks "github.com/containers/podman/v4/pkg/bindings/network"
+	"github.com/containers/podman/v4/pkg/bindings/secrets"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+	"github.com/containers/podman/v4/pkg/errorhandling"
+	"github.com/containers/podman/v4/pkg/namespaces"
 	"github.com/containers/podman/v4/pkg/specgen"
+	"github.com/containers/storage/pkg/idtools"
+	storagetypes "github.com/containers/storage/types"
+	"github.com/docker/go-units"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
 	rawMethod    = "raw"
 	FetchItLabel = "fetchit"
+
+	targetLabel        = "fetchit.target"
+	methodLabel        = "fetchit.method"
+	commitLabel        = "fetchit.commit"
+	refLabel           = "fetchit.ref"
+	commitAuthorLabel  = "fetchit.commit-author"
+	commitSubjectLabel = "fetchit.commit-subject"
+	// specHashLabel holds the hash of the spec a container was created from
+	specHashLabel = "fetchit.spec-hash"
+)
+
+var rawTags = []string{".json", ".yaml", ".yml"}
+
+// Image pull policies of Raw methods
+const (
+	pullAlways       = "Always"
+	pullIfNotPresent = "IfNotPresent"
+	pullNever        = "Never"
 )
 
 // Raw to deploy pods from json or yaml files
 type Raw struct {
 	CommonMethod `mapstructure:",squash"`
-	// Pull images configured in target files each time regardless of if it already exists
+	// Pull images configured in target files each time regardless of if it already exists.
+	// Deprecated, use PullPolicy Always
 	PullImage bool `mapstructure:"pullImage"`
+	// PullPolicy is Always, IfNotPresent or Never, defaults to Always when
+	// PullImage is set and IfNotPresent otherwise
+	PullPolicy string `mapstructure:"pullPolicy"`
+	// Label containers with the author and subject of the commit which deployed them
+	CommitLabels bool `mapstructure:"commitLabels"`
+	// Seconds to wait for containers to stop before they are killed, used for files
+	// which do not set StopTimeout. Defaults to the global stopTimeout
+	StopTimeout *uint `mapstructure:"stopTimeout"`
+	// WatchImages is a cron schedule, separate from the git schedule, on which the
+	// images of deployed containers are checked for a newer digest in their registry.
+	// Containers are recreated when their image tag has moved.
+	WatchImages string `mapstructure:"watchImages"`
+	// Replace containers only once the new container is running and healthy,
+	// restoring the previous container when the new one fails
+	SafeRecreate bool `mapstructure:"safeRecreate"`
+	// Start the new container next to the running one under a temporary name,
+	// and only remove the old container once the new one is healthy. Containers
+	// which cannot run twice at once, such as those publishing host ports, are
+	// replaced as with SafeRecreate.
+	BlueGreen bool `mapstructure:"blueGreen"`
+	// Derive the name of containers whose file does not set Name from the file's
+	// path, e.g. apps/web/colors.yaml is deployed as web-colors
+	DeriveNames bool `mapstructure:"deriveNames"`
+	// Wait for each container to pass its healthcheck after it is started,
+	// failing the deploy when it does not become healthy
+	WaitForHealthy bool `mapstructure:"waitForHealthy"`
+	// Prune containers and pods deployed by this method whose file is no
+	// longer in the repository after each change is applied
+	Prune bool `mapstructure:"prune"`
+	// CrashLoop watches each new container after it starts, and rolls back to
+	// the previous version of its file when the container keeps restarting
+	CrashLoop *crashLoop `mapstructure:"crashLoop"`
+	// crashLooped holds the commit at which each file's container crash looped
+	// and was rolled back, guarded by crashMu as files may be deployed at once
+	crashLooped map[string]string
+	crashMu     sync.Mutex
+	// Systemd generates and enables a systemd unit for each container and pod
+	// deployed by the method, so they are started at boot
+	Systemd *rawSystemd `mapstructure:"systemd"`
+	// Concurrency is how many changed files are deployed at once, defaults to
+	// 1. Files sharing a container, pod, volume or host port are still
+	// deployed one after another.
+	Concurrency int `mapstructure:"concurrency"`
+	// PruneImages removes dangling images after each successful deploy, for
+	// hosts with little disk. Off by default to keep the local image cache.
+	PruneImages bool `mapstructure:"pruneImages"`
+	// Templates renders the files of the method as Go templates with the vars
+	// of the target before they are parsed
+	Templates bool `mapstructure:"templates"`
 }
 
 func (r *Raw) GetKind() string {
@@ -61,12 +153,62 @@ type mount struct {
 	Type        string   `json:"type,omitempty" yaml:"type,omitempty" platform:"linux,solaris,zos"`
 	Source      string   `json:"source,omitempty" yaml:"source,omitempty"`
 	Options     []string `json:"options,omitempty" yaml:"options,omitempty"`
+	// RestartOnChange restarts the container when the host source of a bind mount changes
+	RestartOnChange bool `json:"restartOnChange,omitempty" yaml:"restartOnChange,omitempty"`
 }
 
 type namedVolume struct {
 	Name    string   `json:"name" yaml:"name"`
 	Dest    string   `json:"dest" yaml:"dest"`
 	Options []string `json:"options" yaml:"options"`
+	// Driver creates the volume with a volume driver other than podman's default
+	Driver string `json:"driver" yaml:"driver"`
+	// DriverOptions are the options of the driver, e.g. type, device and o for local volumes
+	DriverOptions map[string]string `json:"driverOptions" yaml:"driverOptions"`
+}
+
+type network struct {
+	Name string `json:"name" yaml:"name"`
+	// Aliases are additional DNS names other containers on the network resolve to this container
+	Aliases []string `json:"aliases" yaml:"aliases"`
+}
+
+// podmanSecret gives a container a podman secret, mounted as a file or set as
+// an environment variable
+type podmanSecret struct {
+	// Name of the podman secret
+	Name string `json:"name" yaml:"name"`
+	// Target is the path of the mounted secret, defaults to /run/secrets/<name>
+	Target string `json:"target" yaml:"target"`
+	// Mode of the mounted secret in octal, e.g. "0400"
+	Mode string `json:"mode" yaml:"mode"`
+	UID  uint32 `json:"uid" yaml:"uid"`
+	GID  uint32 `json:"gid" yaml:"gid"`
+	// Env sets the secret as this environment variable instead of mounting it
+	Env string `json:"env" yaml:"env"`
+}
+
+// healthcheck is run inside the container to determine whether it is healthy
+type healthcheck struct {
+	// Command is run with the container's shell when it has a single element,
+	// otherwise the first element is executed with the rest as its arguments
+	Command []string `json:"command" yaml:"command"`
+	// Interval between checks, e.g. "30s" (default)
+	Interval string `json:"interval" yaml:"interval"`
+	// Timeout of each check, e.g. "30s" (default)
+	Timeout string `json:"timeout" yaml:"timeout"`
+	// Retries is the number of consecutive failures before the container is unhealthy, 3 by default
+	Retries int `json:"retries" yaml:"retries"`
+	// StartPeriod after the container starts during which failures are not counted
+	StartPeriod string `json:"start_period" yaml:"start_period"`
+}
+
+// idMappings map user and group IDs in the container to IDs on the host, each
+// entry takes the form container_id:host_id:size, as podman's --uidmap does
+type idMappings struct {
+	UIDMap []string `json:"uidmap" yaml:"uidmap"`
+	// GIDMap defaults to UIDMap when empty
+	GIDMap []string `json:"gidmap" yaml:"gidmap"`
 }
 
 type RawPod struct {
@@ -78,131 +220,643 @@ type RawPod struct {
 	Volumes []namedVolume     `json:"Volumes" yaml:"Volumes"`
 	CapAdd  []string          `json:"CapAdd" yaml:"CapAdd"`
 	CapDrop []string          `json:"CapDrop" yaml:"CapDrop"`
+	// Platform is the os/arch[/variant] the image is pulled for, e.g. linux/arm64,
+	// defaulting to the platform of the podman host
+	Platform string `json:"Platform" yaml:"Platform"`
+	// ExpectedDigest is the sha256 digest Image must resolve to, e.g. sha256:9f86d08...
+	// A pulled image with any other digest fails the deploy
+	ExpectedDigest string `json:"ExpectedDigest" yaml:"ExpectedDigest"`
+	// EnvFrom maps environment variables to secrets resolved from a configured
+	// secret store at deploy time, e.g. "DB_PASSWORD": "vault:secret/data/app#password"
+	EnvFrom map[string]string `json:"EnvFrom" yaml:"EnvFrom"`
+	// EnvFile are files of KEY=VALUE lines within the repository, merged into Env
+	// with the values of Env taking precedence
+	EnvFile []string `json:"EnvFile" yaml:"EnvFile"`
+	// Tmpfs are in-memory filesystems mounted at each destination, with options
+	// such as size=64m and mode=1777
+	Tmpfs []mount `json:"Tmpfs" yaml:"Tmpfs"`
+	// Runtime selects the OCI runtime for the container, e.g. crun, runc or crun-wasm.
+	// It must be configured in podman's containers.conf on the host, empty uses podman's default
+	Runtime string `json:"Runtime" yaml:"Runtime"`
+	// Memory limit as an absolute amount, e.g. "512m", or a percentage of host memory, e.g. "25%"
+	Memory resourceValue `json:"Memory" yaml:"Memory"`
+	// MemorySwap limits memory plus swap, e.g. "1g", or "-1" for unlimited swap. Requires Memory
+	MemorySwap resourceValue `json:"MemorySwap" yaml:"MemorySwap"`
+	// CPUs limit as a number of CPUs, e.g. 1.5, or a percentage of host CPUs, e.g. "50%"
+	CPUs resourceValue `json:"CPUs" yaml:"CPUs"`
+	// CPUShares is the relative weight of the container's CPU time, 1024 by default
+	CPUShares *uint64 `json:"CPUShares" yaml:"CPUShares"`
+	// PidsLimit limits the number of processes of the container, -1 is unlimited
+	PidsLimit *int64 `json:"PidsLimit" yaml:"PidsLimit"`
+	// ShmSize is the size of /dev/shm, e.g. "1g". Set on the pod for the containers of a pod
+	ShmSize string `json:"ShmSize" yaml:"ShmSize"`
+	// Devices of the host given to the container, in the host[:container][:permissions]
+	// format of podman's --device, e.g. /dev/ttyUSB0:/dev/ttyUSB0:rw
+	Devices []string `json:"Devices" yaml:"Devices"`
+	// Ulimits of the container in the name=soft[:hard] format, e.g. nofile=65536:65536
+	Ulimits []string `json:"Ulimits" yaml:"Ulimits"`
+	// Sysctls are namespaced kernel parameters of the container, e.g. net.core.somaxconn
+	Sysctls map[string]string `json:"Sysctls" yaml:"Sysctls"`
+	// StopTimeout is the seconds to wait for the container to stop before it is killed
+	StopTimeout *uint `json:"StopTimeout" yaml:"StopTimeout"`
+	// StopSignal stops the container in place of the image's, e.g. SIGINT or 2
+	StopSignal string `json:"StopSignal" yaml:"StopSignal"`
+	// Privileged gives the container all capabilities and access to host devices
+	Privileged bool `json:"Privileged" yaml:"Privileged"`
+	// SecurityOpt are security options in the syntax of podman's --security-opt,
+	// e.g. label=disable, seccomp=unconfined or apparmor=profile
+	SecurityOpt []string `json:"SecurityOpt" yaml:"SecurityOpt"`
+	// Secrets are podman secrets mounted into the container or set as environment variables
+	Secrets []podmanSecret `json:"Secrets" yaml:"Secrets"`
+	// Network is the network mode of the container, host, none, bridge or the
+	// name of a network. Empty uses podman's default
+	Network string `json:"Network" yaml:"Network"`
+	// NetworkAliases are DNS aliases of the container on the named Network
+	NetworkAliases []string `json:"NetworkAliases" yaml:"NetworkAliases"`
+	// Networks the container joins, each with optional DNS aliases
+	Networks []network `json:"Networks" yaml:"Networks"`
+	// IPv4, IPv6 and MAC are static addresses of the container on the network
+	// named by Network, or its only entry in Networks
+	IPv4 string `json:"IPv4" yaml:"IPv4"`
+	IPv6 string `json:"IPv6" yaml:"IPv6"`
+	MAC  string `json:"MAC" yaml:"MAC"`
+	// HostAdd are static /etc/hosts entries in the hostname:ip syntax of podman's --add-host
+	HostAdd []string `json:"HostAdd" yaml:"HostAdd"`
+	// NoNewPrivileges prevents processes in the container gaining privileges, e.g. through setuid binaries
+	NoNewPrivileges bool `json:"NoNewPrivileges" yaml:"NoNewPrivileges"`
+	// MaskedPaths are absolute paths within the container which are masked, in addition to podman's defaults
+	MaskedPaths []string `json:"MaskedPaths" yaml:"MaskedPaths"`
+	// ReadOnly mounts the root filesystem of the container read-only
+	ReadOnly bool `json:"ReadOnly" yaml:"ReadOnly"`
+	// Umask of the container's init process, e.g. "0027"
+	Umask string `json:"Umask" yaml:"Umask"`
+	// Timezone of the container, an IANA zone name such as Europe/Berlin or
+	// local to use the timezone of the host
+	Timezone string `json:"Timezone" yaml:"Timezone"`
+	// LogDriver is the log driver of the container, one of journald, k8s-file,
+	// json-file, none or passthrough, empty uses podman's default
+	LogDriver string `json:"LogDriver" yaml:"LogDriver"`
+	// LogOptions of the log driver: path and max-size for k8s-file and
+	// json-file, and tag for every driver which writes logs
+	LogOptions map[string]string `json:"LogOptions" yaml:"LogOptions"`
+	// IDMappings runs the container in a private user namespace with the given mappings
+	IDMappings *idMappings `json:"IDMappings" yaml:"IDMappings"`
+	// UserNS is the user namespace mode of the container, one of auto, auto:options
+	// such as auto:size=65536, keep-id, nomap, host or private. IDMappings may only
+	// be combined with private
+	UserNS string `json:"UserNS" yaml:"UserNS"`
+	// RequiresHostUnit names host systemd units, e.g. a VPN service or a mount unit,
+	// which must be active before the container is created
+	RequiresHostUnit []string `json:"RequiresHostUnit" yaml:"RequiresHostUnit"`
+	// RestartPolicy is one of no, on-failure, always or unless-stopped, defaults to always
+	RestartPolicy string `json:"RestartPolicy" yaml:"RestartPolicy"`
+	// RestartRetries limits the restarts of the on-failure policy
+	RestartRetries *uint `json:"RestartRetries" yaml:"RestartRetries"`
+	// Entrypoint replaces the image's entrypoint, empty uses the image default
+	Entrypoint []string `json:"Entrypoint" yaml:"Entrypoint"`
+	// Command replaces the image's command, which is passed as arguments to the
+	// entrypoint. Empty uses the image default
+	Command []string `json:"Command" yaml:"Command"`
+	// User the container runs as, a user name or uid[:gid], empty uses the image's user
+	User string `json:"User" yaml:"User"`
+	// WorkingDir of the container's process, empty uses the image's working directory
+	WorkingDir string `json:"WorkingDir" yaml:"WorkingDir"`
+	// Labels of the container, the labels set by fetchit take precedence
+	Labels map[string]string `json:"Labels" yaml:"Labels"`
+	// Annotations of the container
+	Annotations map[string]string `json:"Annotations" yaml:"Annotations"`
+	// Healthcheck of the container, replacing any healthcheck of its image
+	Healthcheck *healthcheck `json:"Healthcheck" yaml:"Healthcheck"`
+	// PreDeploy is run in a short-lived container from the new spec before the
+	// running container is replaced, e.g. a migration. A failure keeps the running container
+	PreDeploy []string `json:"PreDeploy" yaml:"PreDeploy"`
+	// PostDeploy is executed in the new container once it has started, e.g. a
+	// smoke test. A failure rolls back to the previous container
+	PostDeploy []string `json:"PostDeploy" yaml:"PostDeploy"`
+	// ReadinessExec is executed in the new container once it has started until
+	// it exits 0, e.g. a check that migrations have run. The deploy fails when
+	// it does not succeed within ReadinessTimeout
+	ReadinessExec []string `json:"ReadinessExec" yaml:"ReadinessExec"`
+	// ReadinessTimeout is how long ReadinessExec has to succeed, e.g. 30s. Defaults to 2m
+	ReadinessTimeout string `json:"ReadinessTimeout" yaml:"ReadinessTimeout"`
+	// Enabled set to false keeps the file in git without deploying it, any
+	// container deployed from it is removed. Defaults to true
+	Enabled *bool `json:"Enabled" yaml:"Enabled"`
+	// Pod groups Containers into a podman pod of this name, sharing the pod's
+	// network. Ports, Labels, networks and Enabled then apply to the pod
+	Pod string `json:"Pod" yaml:"Pod"`
+	// Containers of the pod, a file which is a list of containers is a pod named after the file
+	Containers []RawPod `json:"Containers" yaml:"Containers"`
+	// RemoveVolumesOnDelete removes the named Volumes, and the data within them, when
+	// the file is removed from the repository. Volumes are preserved by default
+	RemoveVolumesOnDelete bool `json:"RemoveVolumesOnDelete" yaml:"RemoveVolumesOnDelete"`
+
+	// nameTemplate is the Name before its tokens were expanded
+	nameTemplate string
+}
+
+func (raw *RawPod) enabled() bool {
+	return raw.Enabled == nil || *raw.Enabled
+}
+
+// validContainerName matches the names podman accepts for containers and pods
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// validate checks the fields podman requires of a raw file, returning every
+// problem found in a single error
+func (raw *RawPod) validate() error {
+	var problems []string
+	if raw.isPod() {
+		if !validContainerName.MatchString(raw.Pod) {
+			problems = append(problems, fmt.Sprintf("Pod %q must start with a letter or digit and contain only letters, digits, _, . and -", raw.Pod))
+		}
+		problems = append(problems, portProblems(raw.Ports)...)
+		if hasNameTokens(raw.Pod) {
+			problems = append(problems, "name tokens such as {{.ShortSHA}} cannot be used in pods")
+		}
+		for i := range raw.Containers {
+			if hasNameTokens(raw.Containers[i].Name) {
+				problems = append(problems, fmt.Sprintf("container %d: name tokens such as {{.ShortSHA}} cannot be used in pods", i+1))
+				continue
+			}
+			for _, p := range raw.Containers[i].problems() {
+				problems = append(problems, fmt.Sprintf("container %d: %s", i+1, p))
+			}
+		}
+	} else {
+		problems = raw.problems()
+	}
+	if len(problems) > 0 {
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("invalid %s: %s", raw.describe(), strings.Join(problems, "; ")))
+	}
+	return nil
+}
+
+// problems returns the problems with the fields of a single container
+func (raw *RawPod) problems() []string {
+	var problems []string
+	if strings.TrimSpace(raw.Image) == "" {
+		problems = append(problems, "Image is required")
+	}
+	if raw.Name == "" {
+		problems = append(problems, "Name is required, or set deriveNames on the method")
+	} else if !validContainerName.MatchString(expandNameTokens(raw.Name, plumbing.ZeroHash.String(), time.Time{})) {
+		problems = append(problems, fmt.Sprintf("Name %q must start with a letter or digit and contain only letters, digits, _, . and -", raw.Name))
+	}
+	problems = append(problems, digestProblems(raw)...)
+	problems = append(problems, portProblems(raw.Ports)...)
+	if _, err := raw.readinessTimeout(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	destinations := map[string]bool{}
+	addDestination := func(field, dest string) {
+		if dest == "" {
+			problems = append(problems, fmt.Sprintf("%s entry has no destination", field))
+			return
+		}
+		dest = filepath.Clean(dest)
+		if destinations[dest] {
+			problems = append(problems, fmt.Sprintf("destination %s is mounted more than once", dest))
+		}
+		destinations[dest] = true
+	}
+	for _, m := range raw.Mounts {
+		addDestination("Mounts", m.Destination)
+	}
+	for _, v := range raw.Volumes {
+		addDestination("Volumes", v.Dest)
+	}
+	for _, t := range raw.Tmpfs {
+		addDestination("Tmpfs", t.Destination)
+	}
+	return problems
+}
+
+func portProblems(ports []port) []string {
+	var problems []string
+	for _, p := range ports {
+		if p.HostPort != 0 && p.ContainerPort == 0 {
+			problems = append(problems, fmt.Sprintf("host port %d has no container_port", p.HostPort))
+		}
+	}
+	return problems
 }
 
 func (r *Raw) Process(ctx context.Context, conn context.Context, skew int) {
 	time.Sleep(time.Duration(skew) * time.Millisecond)
 	target := r.GetTarget()
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	log := methodLogger(ctx, r, "")
+	defer target.lockRun(r)()
 
-	tag := []string{".json", ".yaml", ".yml"}
+	tag := r.fileTags(rawTags)
 
 	if r.initialRun {
-		err := getRepo(target)
+		err := target.retry(ctx, "clone "+target.url, func() error { return getRepo(target) })
 		if err != nil {
-			logger.Errorf("Failed to clone repository %s: %v", target.url, err)
+			log.With("error", err.Error()).Errorf("Failed to clone repository %s: %v", target.url, err)
 			return
 		}
 
-		err = zeroToCurrent(ctx, conn, r, target, &tag)
+		err = target.retry(ctx, "move to current", func() error {
+			return zeroToCurrent(ctx, conn, r, target, tag)
+		})
 		if err != nil {
-			logger.Errorf("Error moving to current: %v", err)
+			log.With("error", err.Error()).Errorf("Error moving to current: %v", err)
 			return
 		}
 	}
 
-	err := currentToLatest(ctx, conn, r, target, &tag)
+	err := target.retry(ctx, "move current to latest", func() error {
+		return currentToLatest(ctx, conn, r, target, tag)
+	})
 	if err != nil {
-		logger.Errorf("Error moving current to latest: %v", err)
+		log.With("error", err.Error()).Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
 	r.initialRun = false
 }
 
-func (r *Raw) rawPodman(ctx, conn context.Context, path string, prev *string) error {
-
-	logger.Infof("Creating podman container from %s", path)
-
-	rawFile, err := ioutil.ReadFile(path)
+func (r *Raw) rawPodman(ctx, conn context.Context, change *object.Change, path string) error {
+	log := methodLogger(ctx, r, changeFile(change))
+	conn = auditConn(ctx, conn, r, changeFile(change))
+	prev, err := getChangeString(change)
 	if err != nil {
 		return err
 	}
 
-	raw, err := rawPodFromBytes(rawFile)
-	if err != nil {
-		return err
-	}
+	var s *specgen.SpecGenerator
+	var deployed *RawPod
+	var mounts []mount
+	var hash string
+	if path != deleteFile {
+		log.Infof("Creating podman container from %s", path)
+
+		rawFile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
 
-	logger.Infof("Identifying if image exists locally")
+		raw, err := r.parseRawPod(rawFile, change.To.Name)
+		if err != nil {
+			return err
+		}
+		warnDeprecatedRawFields(path, rawFile)
+		if raw.enabled() {
+			if err := raw.validate(); err != nil {
+				return utils.WrapErr(err, "Error validating %s", path)
+			}
+			if err := r.GetTarget().checkImages(raw); err != nil {
+				return utils.WrapErr(err, "Error deploying %s, running containers were left in place", path)
+			}
+		}
+		if raw.isPod() {
+			return r.rawPodmanPod(ctx, conn, change, prev, path, raw)
+		}
+		if err := r.checkCrashLooped(ctx, change.To.Name); err != nil {
+			return err
+		}
+		raw.StopTimeout = r.stopTimeout(raw)
+		deployed = raw
 
-	err = detectOrFetchImage(conn, raw.Image, r.PullImage)
-	if err != nil {
-		return err
-	}
+		if !raw.enabled() {
+			return r.disable(conn, change, prev, raw)
+		}
+		r.expandName(ctx, raw)
+		if raw.Privileged {
+			log.Warnf("Container %s from %s is privileged, it has full access to the host", raw.Name, path)
+		}
+		if raw.ReadOnly {
+			log.Infof("Container %s from %s has a read-only root filesystem, only its volumes, mounts and tmpfs are writable", raw.Name, path)
+		}
 
-	// Delete previous file's podxz
-	if prev != nil {
-		raw, err := rawPodFromBytes([]byte(*prev))
+		log.Infof("Identifying if image exists locally")
+
+		if err := r.fetchImage(ctx, conn, raw); err != nil {
+			return err
+		}
+
+		if err := checkRuntime(conn, raw.Runtime); err != nil {
+			return err
+		}
+
+		if err := r.loadEnvFiles(raw); err != nil {
+			return err
+		}
+		if err := waitHostUnits(ctx, raw.Name, raw.RequiresHostUnit); err != nil {
+			return err
+		}
+
+		if err := resolveHostRelative(conn, raw); err != nil {
+			return utils.WrapErr(err, "Error resolving resource limits from %s", path)
+		}
+
+		// Generate the spec before anything is removed so a bad spec leaves the running container in place
+		s, err = createSpecGen(*raw)
 		if err != nil {
+			return utils.WrapErrClass(utils.ErrValidation, err, "Error generating spec from %s", path)
+		}
+		if err := checkNetworks(conn, s); err != nil {
+			return err
+		}
+		if err := checkSecrets(conn, s); err != nil {
+			return err
+		}
+		if err := checkDevices(conn, s.Name, s.Devices); err != nil {
 			return err
 		}
 
-		err = deleteContainer(conn, raw.Name)
+		hash, err = specHash(s)
 		if err != nil {
+			return utils.WrapErr(err, "Error hashing spec for container %s", s.Name)
+		}
+		// Labels which change with every commit are added after hashing, so a
+		// container matches its applied state until its own file changes
+		r.labelCommit(ctx, s.Labels)
+		s.Labels[specHashLabel] = hash
+		dumpSpec(log, path, raw, s)
+		mounts = raw.Mounts
+	}
+
+	if path != deleteFile {
+		// Keep a running container which already matches its file, such as after a
+		// restart or when a commit touches the file without changing its spec
+		matches, err := containerMatches(conn, r.GetTarget(), s, hash)
+		if forceRedeploy(ctx) {
+			matches, err = false, nil
+		}
+		if err != nil {
+			log.Infof("Unable to compare container %s with its file, recreating it: %v", s.Name, err)
+		} else if matches {
+			if err := r.deletePrevious(conn, change, prev, deployed); err != nil {
+				return err
+			}
+			if deployed.nameTemplate != "" {
+				if err := r.deleteInstances(conn, deployed.nameTemplate, s.Name, s.StopTimeout); err != nil {
+					return err
+				}
+			}
+			log.Infof("Container %s already matches %s, skipping redeploy", s.Name, path)
+			if fetchit != nil {
+				fetchit.state.setContainerHash(r.GetTarget(), s.Name, hash)
+			}
+			mountWatches.set(conn, s.Name, s.StopTimeout, mounts)
+			return nil
+		}
+
+		if err := ensureRawVolumes(conn, deployed); err != nil {
 			return err
 		}
+		if err := runPreDeploy(conn, log, s, deployed.PreDeploy); err != nil {
+			return utils.WrapErr(err, "Error running PreDeploy from %s, the running container was kept", path)
+		}
+
+		// A container whose name has tokens never shares a name with the
+		// container it replaces, which is removed first as usual
+		if (r.SafeRecreate || r.BlueGreen) && deployed.nameTemplate == "" {
+			var prevRaw *RawPod
+			if prev != nil {
+				prevRaw, err = r.parsePrevRawPod([]byte(*prev), change.From.Name)
+				if err != nil {
+					return err
+				}
+			}
+			replace := r.safeRecreate
+			if r.BlueGreen {
+				if reason := blueGreenBlocker(deployed, s); reason != "" {
+					log.Infof("Container %s cannot run next to its previous container as %s, stopping the previous container first", s.Name, reason)
+				} else {
+					replace = r.blueGreen
+				}
+			}
+			if err := replace(ctx, conn, s, hash, prevRaw, deployed); err != nil {
+				if isCrashLoop(err) {
+					r.setCrashLooped(ctx, change.To.Name)
+				}
+				return err
+			}
+			mountWatches.set(conn, s.Name, s.StopTimeout, mounts)
+			r.enableUnits(conn, deployed)
+			r.pruneImages(conn)
+			return nil
+		}
+	}
+
+	// Capture the previous container's spec before it is removed, so it can be
+	// recreated if the new container fails to start
+	var rollback *specgen.SpecGenerator
+	var rollbackRaw *RawPod
+	var rollbackHash string
+	if path != deleteFile {
+		rollback, rollbackRaw, rollbackHash = r.rollbackSpec(conn, change, prev)
+	}
 
-		logger.Infof("Deleted podman container %s", raw.Name)
+	if err := r.deletePrevious(conn, change, prev, nil); err != nil {
+		return err
 	}
 
 	if path == deleteFile {
-		return nil
+		return r.removeRawVolumes(conn, change, prev)
+	}
+	if deployed.nameTemplate != "" {
+		if err := r.deleteInstances(conn, deployed.nameTemplate, "", s.StopTimeout); err != nil {
+			return err
+		}
 	}
 
-	err = removeExisting(conn, raw.Name)
+	err = removeExisting(conn, s.Name, s.StopTimeout)
 	if err != nil {
 		return err
 	}
 
-	s := createSpecGen(*raw)
+	if err := createAndStart(conn, s); err != nil {
+		if rollback != nil {
+			r.rollback(conn, s, rollback, rollbackRaw, rollbackHash)
+			return utils.WrapErr(err, "Error starting container %s from %s, the previous container was restored", s.Name, path)
+		}
+		return err
+	}
+	if r.WaitForHealthy {
+		if err := waitHealthy(conn, s.Name); err != nil {
+			if rollback != nil {
+				r.rollback(conn, s, rollback, rollbackRaw, rollbackHash)
+				return utils.WrapErr(err, "Container %s from %s did not become healthy, the previous container was restored", s.Name, path)
+			}
+			return utils.WrapErr(err, "Container %s from %s did not become healthy", s.Name, path)
+		}
+		log.Infof("Container %s is healthy", s.Name)
+	}
+	if err := waitReady(conn, log, s.Name, deployed); err != nil {
+		if rollback != nil {
+			r.rollback(conn, s, rollback, rollbackRaw, rollbackHash)
+			return utils.WrapErr(err, "Container %s from %s did not become ready, the previous container was restored", s.Name, path)
+		}
+		return utils.WrapErr(err, "Container %s from %s did not become ready", s.Name, path)
+	}
+	if err := runPostDeploy(conn, log, s.Name, deployed.PostDeploy); err != nil {
+		if rollback != nil {
+			r.rollback(conn, s, rollback, rollbackRaw, rollbackHash)
+			return utils.WrapErr(err, "Error running PostDeploy from %s, the previous container was restored", path)
+		}
+		return utils.WrapErr(err, "Error running PostDeploy from %s", path)
+	}
+	if err := r.watchCrashLoop(ctx, conn, s.Name); err != nil {
+		if !isCrashLoop(err) {
+			return utils.WrapErr(err, "Container %s from %s was left running unverified", s.Name, path)
+		}
+		r.setCrashLooped(ctx, change.To.Name)
+		if rollback != nil {
+			r.rollback(conn, s, rollback, rollbackRaw, rollbackHash)
+			return utils.WrapErr(err, "Container %s from %s is crash looping, the previous container was restored", s.Name, path)
+		}
+		return utils.WrapErr(err, "Container %s from %s is crash looping", s.Name, path)
+	}
+	if fetchit != nil {
+		fetchit.state.setContainerHash(r.GetTarget(), s.Name, hash)
+	}
+	mountWatches.set(conn, s.Name, s.StopTimeout, mounts)
+	r.enableUnits(conn, deployed)
+	r.pruneImages(conn)
+
+	return nil
+}
 
-	createResponse, err := containers.CreateWithSpec(conn, s, nil)
+// disable removes the containers deployed from the previous and current
+// versions of a file which is now disabled, and deploys nothing in their place
+func (r *Raw) disable(conn context.Context, change *object.Change, prev *string, raw *RawPod) error {
+	log := r.GetTarget().logger()
+	pods := []*RawPod{raw}
+	if prev != nil {
+		prevRaw, err := r.parsePrevRawPod([]byte(*prev), change.From.Name)
+		if err != nil {
+			return err
+		}
+		if !prevRaw.sameDeployment(raw) {
+			pods = append(pods, prevRaw)
+		}
+	}
+	for _, p := range pods {
+		if p.isPod() {
+			if err := r.deletePodOf(conn, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if hasNameTokens(p.Name) {
+			if err := r.deleteInstances(conn, p.Name, "", r.stopTimeout(p)); err != nil {
+				return err
+			}
+			continue
+		}
+		exists, err := containerExists(conn, p.Name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			r.disableUnits(conn, rawUnits(p))
+			if err := deleteContainer(conn, p.Name, r.stopTimeout(p)); err != nil {
+				return err
+			}
+			log.Infof("Removed podman container %s, %s is disabled", p.Name, change.To.Name)
+		}
+		if fetchit != nil {
+			fetchit.state.setContainerHash(r.GetTarget(), p.Name, "")
+		}
+		mountWatches.set(conn, p.Name, nil, nil)
+	}
+	return nil
+}
+
+func createAndStart(conn context.Context, s *specgen.SpecGenerator) error {
+	var createResponse entities.ContainerCreateResponse
+	err := withPodman(conn, podmanTimeout(), "create container "+s.Name, func(ctx context.Context) error {
+		var err error
+		createResponse, err = containers.CreateWithSpec(ctx, s, nil)
+		return err
+	})
+	audit(conn, auditContainer, s.Name, s.Image, "create", err)
 	if err != nil {
+		var model *errorhandling.ErrorModel
+		if s.OCIRuntime != "" && errors.As(err, &model) && model.Because == define.ErrInvalidArg.Error() {
+			return fmt.Errorf("OCI runtime %s is not available in podman, ensure it is configured in containers.conf: %v", s.OCIRuntime, err)
+		}
 		return err
 	}
 	logger.Infof("Container %s created.", s.Name)
 
-	if err := containers.Start(conn, createResponse.ID, nil); err != nil {
+	err = withPodman(conn, podmanTimeout(), "start container "+s.Name, func(ctx context.Context) error {
+		return containers.Start(ctx, createResponse.ID, nil)
+	})
+	audit(conn, auditContainer, s.Name, s.Image, "start", err)
+	if err != nil {
 		return err
 	}
 	logger.Infof("Container %s started....Requeuing", s.Name)
-
 	return nil
 }
 
 func (r *Raw) MethodEngine(ctx context.Context, conn context.Context, change *object.Change, path string) error {
-	prev, err := getChangeString(change)
-	if err != nil {
-		return err
-	}
-	return r.rawPodman(ctx, conn, path, prev)
+	return r.rawPodman(ctx, conn, change, path)
 }
 
 func (r *Raw) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
-	changeMap, err := applyChanges(ctx, r.GetTarget(), r.GetTargetPath(), r.Glob, currentState, desiredState, tags)
+	if err := r.validateCollisions(ctx, desiredState, tags); err != nil {
+		return err
+	}
+	changeMap, err := applyChanges(ctx, &r.CommonMethod, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
 	if err := runChanges(ctx, conn, r, changeMap); err != nil {
 		return err
 	}
+	if r.Prune {
+		return r.pruneOrphans(ctx, conn, desiredState, tags)
+	}
 	return nil
 }
 
-func convertMounts(mounts []mount) []specs.Mount {
+func convertMounts(mounts []mount) ([]specs.Mount, error) {
 	result := []specs.Mount{}
 	for _, m := range mounts {
+		options, err := normalizeMountOptions(mountKind(m.Type), m.Destination, m.Options)
+		if err != nil {
+			return nil, err
+		}
 		toAppend := specs.Mount{
 			Destination: m.Destination,
 			Type:        m.Type,
 			Source:      m.Source,
-			Options:     m.Options,
+			Options:     options,
 		}
 		result = append(result, toAppend)
 	}
-	return result
+	return result, nil
+}
+
+// convertTmpfs converts tmpfs mounts, which only set a destination and options
+func convertTmpfs(mounts []mount) ([]specs.Mount, error) {
+	result := []specs.Mount{}
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.Destination) {
+			return nil, fmt.Errorf("tmpfs destination %q must be an absolute path", m.Destination)
+		}
+		if (m.Type != "" && m.Type != "tmpfs") || m.Source != "" {
+			return nil, fmt.Errorf("tmpfs at %s cannot set a source or another type", m.Destination)
+		}
+		options, err := normalizeMountOptions("Tmpfs", m.Destination, m.Options)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, specs.Mount{
+			Destination: m.Destination,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     options,
+		})
+	}
+	return result, nil
 }
 
 func convertPorts(ports []port) []types.PortMapping {
@@ -220,74 +874,864 @@ func convertPorts(ports []port) []types.PortMapping {
 	return result
 }
 
-func convertVolumes(namedVolumes []namedVolume) []*specgen.NamedVolume {
+func convertVolumes(namedVolumes []namedVolume) ([]*specgen.NamedVolume, error) {
 	result := []*specgen.NamedVolume{}
 	for _, n := range namedVolumes {
+		options, err := normalizeMountOptions("Volumes", n.Dest, n.Options)
+		if err != nil {
+			return nil, err
+		}
 		toAppend := specgen.NamedVolume{
 			Name:    n.Name,
 			Dest:    n.Dest,
-			Options: n.Options,
+			Options: options,
 		}
 		result = append(result, &toAppend)
 	}
-	return result
+	return result, nil
+}
+
+func convertNetworks(networks []network) (map[string]types.PerNetworkOptions, error) {
+	if len(networks) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]types.PerNetworkOptions, len(networks))
+	for _, n := range networks {
+		if n.Name == "" {
+			return nil, errors.New("network name must be set")
+		}
+		for _, alias := range n.Aliases {
+			if errs := validation.IsDNS1123Subdomain(alias); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid alias %q for network %s: %s", alias, n.Name, strings.Join(errs, ", "))
+			}
+		}
+		result[n.Name] = types.PerNetworkOptions{Aliases: n.Aliases}
+	}
+	return result, nil
+}
+
+// networkMode returns the network namespace and networks of a container from
+// its Network mode and Networks, podman's default is used when neither is set
+func networkMode(raw RawPod) (specgen.Namespace, map[string]types.PerNetworkOptions, error) {
+	var ns specgen.Namespace
+	list := raw.Networks
+	switch raw.Network {
+	case "":
+		if len(raw.NetworkAliases) > 0 {
+			return ns, nil, errors.New("NetworkAliases requires Network to name a network")
+		}
+	case string(specgen.Host), string(specgen.NoNetwork):
+		if len(raw.Networks) > 0 || len(raw.NetworkAliases) > 0 || raw.hasStaticAddress() {
+			return ns, nil, fmt.Errorf("Network %s cannot be combined with Networks, NetworkAliases or static addresses", raw.Network)
+		}
+		return specgen.Namespace{NSMode: specgen.NamespaceMode(raw.Network)}, nil, nil
+	case string(specgen.Bridge):
+		if len(raw.NetworkAliases) > 0 {
+			return ns, nil, errors.New("NetworkAliases requires Network to name a network rather than bridge")
+		}
+		ns = specgen.Namespace{NSMode: specgen.Bridge}
+	default:
+		list = append([]network{{Name: raw.Network, Aliases: raw.NetworkAliases}}, list...)
+	}
+
+	result, err := convertNetworks(list)
+	if err != nil {
+		return ns, nil, err
+	}
+	if err := staticAddresses(raw, list, result); err != nil {
+		return ns, nil, err
+	}
+	if result != nil {
+		ns = specgen.Namespace{NSMode: specgen.Bridge}
+	}
+	return ns, result, nil
+}
+
+func (raw *RawPod) hasStaticAddress() bool {
+	return raw.IPv4 != "" || raw.IPv6 != "" || raw.MAC != ""
+}
+
+// staticAddresses sets the static IPv4, IPv6 and MAC addresses of a container
+// on its named network, they are meaningless on podman's default network so a
+// container with static addresses must join exactly one named network or name
+// it with Network
+func staticAddresses(raw RawPod, list []network, result map[string]types.PerNetworkOptions) error {
+	if !raw.hasStaticAddress() {
+		return nil
+	}
+	var name string
+	switch {
+	case raw.Network != "" && raw.Network != string(specgen.Bridge):
+		name = raw.Network
+	case len(list) == 1:
+		name = list[0].Name
+	default:
+		return errors.New("IPv4, IPv6 and MAC require Network to name a network, or a single entry in Networks")
+	}
+	opts := result[name]
+	if raw.IPv4 != "" {
+		ip := net.ParseIP(raw.IPv4)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", raw.IPv4)
+		}
+		opts.StaticIPs = append(opts.StaticIPs, ip)
+	}
+	if raw.IPv6 != "" {
+		ip := net.ParseIP(raw.IPv6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", raw.IPv6)
+		}
+		opts.StaticIPs = append(opts.StaticIPs, ip)
+	}
+	if raw.MAC != "" {
+		mac, err := net.ParseMAC(raw.MAC)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address %q: %v", raw.MAC, err)
+		}
+		opts.StaticMAC = types.HardwareAddr(mac)
+	}
+	result[name] = opts
+	return nil
+}
+
+// convertHostAdd checks /etc/hosts entries in the hostname:ip syntax of
+// podman's --add-host, the IP may be IPv6 as only the first colon separates it
+func convertHostAdd(entries []string) ([]string, error) {
+	for _, entry := range entries {
+		i := strings.Index(entry, ":")
+		if i < 1 || strings.ContainsAny(entry[:i], " \t") {
+			return nil, fmt.Errorf("invalid HostAdd entry %q, must be hostname:ip", entry)
+		}
+		if net.ParseIP(entry[i+1:]) == nil {
+			return nil, fmt.Errorf("invalid IP address %q in HostAdd entry %q", entry[i+1:], entry)
+		}
+	}
+	return entries, nil
+}
+
+// convertSecrets splits podman secrets into those mounted as files and those
+// set as environment variables
+func convertSecrets(list []podmanSecret) ([]specgen.Secret, map[string]string, error) {
+	var mounted []specgen.Secret
+	var env map[string]string
+	for _, secret := range list {
+		if secret.Name == "" {
+			return nil, nil, errors.New("secret name must be set")
+		}
+		if secret.Env != "" {
+			if secret.Target != "" || secret.Mode != "" || secret.UID != 0 || secret.GID != 0 {
+				return nil, nil, fmt.Errorf("secret %s sets env, it cannot also set target, mode, uid or gid", secret.Name)
+			}
+			if env == nil {
+				env = map[string]string{}
+			}
+			env[secret.Env] = secret.Name
+			continue
+		}
+		var mode uint64
+		if secret.Mode != "" {
+			var err error
+			if mode, err = strconv.ParseUint(secret.Mode, 8, 32); err != nil {
+				return nil, nil, fmt.Errorf("invalid mode %q for secret %s, must be an octal value such as 0400", secret.Mode, secret.Name)
+			}
+		}
+		mounted = append(mounted, specgen.Secret{
+			Source: secret.Name,
+			Target: secret.Target,
+			UID:    secret.UID,
+			GID:    secret.GID,
+			Mode:   uint32(mode),
+		})
+	}
+	return mounted, env, nil
+}
+
+// checkSecrets verifies that the podman secrets a container uses exist
+func checkSecrets(conn context.Context, s *specgen.SpecGenerator) error {
+	names := make([]string, 0, len(s.Secrets)+len(s.EnvSecrets))
+	for _, secret := range s.Secrets {
+		names = append(names, secret.Source)
+	}
+	for _, name := range s.EnvSecrets {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		err := withPodman(conn, podmanTimeout(), "inspect secret "+name, func(ctx context.Context) error {
+			_, err := secrets.Inspect(ctx, name, nil)
+			return err
+		})
+		if err != nil {
+			if utils.ClassOf(err) == utils.ErrNotFound {
+				return utils.Classify(utils.ErrNotFound, fmt.Errorf("podman secret %s of container %s does not exist", name, s.Name))
+			}
+			return utils.WrapErr(err, "Error checking podman secret %s", name)
+		}
+	}
+	return nil
+}
+
+// checkNetworks verifies that the networks a container joins exist
+func checkNetworks(conn context.Context, s *specgen.SpecGenerator) error {
+	for name := range s.Networks {
+		exists, err := networks.Exists(conn, name, nil)
+		if err != nil {
+			return utils.WrapErr(err, "Error checking network %s", name)
+		}
+		if !exists {
+			return utils.Classify(utils.ErrNotFound, fmt.Errorf("network %s of container %s does not exist, it must be created before the container is deployed", name, s.Name))
+		}
+	}
+	return nil
+}
+
+// parseIDMap parses container_id:host_id:size mappings
+func parseIDMap(mappings []string) ([]idtools.IDMap, error) {
+	result := make([]idtools.IDMap, 0, len(mappings))
+	for _, m := range mappings {
+		parts := strings.Split(m, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid ID mapping %q, expected container_id:host_id:size", m)
+		}
+		var ids [3]int
+		for i, p := range parts {
+			id, err := strconv.ParseUint(p, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID mapping %q, %s is not a valid ID", m, p)
+			}
+			ids[i] = int(id)
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid ID mapping %q, size must be greater than 0", m)
+		}
+		result = append(result, idtools.IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return result, nil
+}
+
+func convertIDMappings(m *idMappings) (*storagetypes.IDMappingOptions, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if len(m.UIDMap) == 0 {
+		return nil, errors.New("IDMappings requires at least one uidmap entry")
+	}
+	uids, err := parseIDMap(m.UIDMap)
+	if err != nil {
+		return nil, err
+	}
+	gids := uids
+	if len(m.GIDMap) > 0 {
+		if gids, err = parseIDMap(m.GIDMap); err != nil {
+			return nil, err
+		}
+	}
+	return &storagetypes.IDMappingOptions{UIDMap: uids, GIDMap: gids}, nil
+}
+
+// convertUserNS sets the user namespace of raw on the spec. A privileged
+// container keeps the host's user namespace, since its access to the host is
+// what makes it privileged.
+func convertUserNS(s *specgen.SpecGenerator, raw RawPod) error {
+	idMappings, err := convertIDMappings(raw.IDMappings)
+	if err != nil {
+		return err
+	}
+	if raw.UserNS == "" {
+		if idMappings != nil {
+			if raw.Privileged {
+				return errors.New("IDMappings cannot be set on a privileged container")
+			}
+			s.UserNS = specgen.Namespace{NSMode: specgen.Private}
+			s.IDMappings = idMappings
+		}
+		return nil
+	}
+
+	mode := namespaces.UsernsMode(raw.UserNS)
+	ns, err := specgen.ParseUserNamespace(raw.UserNS)
+	if err != nil {
+		return utils.WrapErr(err, "Invalid UserNS %s", raw.UserNS)
+	}
+	switch ns.NSMode {
+	case specgen.Auto, specgen.KeepID, specgen.NoMap, specgen.Private:
+		if raw.Privileged {
+			return fmt.Errorf("UserNS %s cannot be set on a privileged container, it runs in the host's user namespace", raw.UserNS)
+		}
+	case specgen.Host:
+	default:
+		return fmt.Errorf("invalid UserNS %s, must be auto, keep-id, nomap, host or private", raw.UserNS)
+	}
+	if idMappings != nil && ns.NSMode != specgen.Private {
+		return fmt.Errorf("IDMappings can only be combined with UserNS private, not %s", raw.UserNS)
+	}
+	if ns.NSMode == specgen.Auto {
+		// podman parses the options of auto on the client, so they are sent as mappings
+		opts, err := mode.GetAutoOptions()
+		if err != nil {
+			return utils.WrapErr(err, "Invalid UserNS %s", raw.UserNS)
+		}
+		idMappings = &storagetypes.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: *opts}
+	}
+	s.UserNS = ns
+	s.IDMappings = idMappings
+	return nil
+}
+
+// convertTimezone checks a container timezone, either local or a zone of the tz database
+func convertTimezone(tz string) (string, error) {
+	if tz == "" || tz == "local" {
+		return tz, nil
+	}
+	if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+		return "", fmt.Errorf("unknown Timezone %q, must be local or a zone such as Europe/Berlin", tz)
+	}
+	return tz, nil
+}
+
+// convertLogConfig converts a log driver and its options as podman's
+// --log-driver and --log-opt do, returning nil when neither is set so podman's
+// default driver is used
+func convertLogConfig(driver string, options map[string]string) (*specgen.LogConfig, error) {
+	if driver == "" {
+		if len(options) > 0 {
+			return nil, errors.New("LogOptions require LogDriver to be set")
+		}
+		return nil, nil
+	}
+	fileDriver := driver == define.KubernetesLogging || driver == define.JSONLogging
+	switch {
+	case fileDriver, driver == define.JournaldLogging:
+	case driver == define.NoLogging || driver == define.PassthroughLogging:
+		if len(options) > 0 {
+			return nil, fmt.Errorf("LogDriver %s writes no logs and takes no LogOptions", driver)
+		}
+	default:
+		return nil, fmt.Errorf("invalid LogDriver %s, must be journald, k8s-file, json-file, none or passthrough", driver)
+	}
+	config := &specgen.LogConfig{Driver: driver}
+	for k, v := range options {
+		switch {
+		case k == "tag":
+			if config.Options == nil {
+				config.Options = map[string]string{}
+			}
+			config.Options[k] = v
+		case k == "path" && fileDriver:
+			if !filepath.IsAbs(v) {
+				return nil, fmt.Errorf("log path %s must be absolute", v)
+			}
+			config.Path = v
+		case k == "max-size" && fileDriver:
+			size, err := units.FromHumanSize(v)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid log max-size %s, must be a size such as 10mb", v)
+			}
+			config.Size = size
+		case k == "path" || k == "max-size":
+			return nil, fmt.Errorf("log option %s is only supported by the k8s-file and json-file drivers, not %s", k, driver)
+		default:
+			return nil, fmt.Errorf("unknown log option %s, must be path, max-size or tag", k)
+		}
+	}
+	return config, nil
+}
+
+// applyHardening sets the security options of raw on the spec
+func applyHardening(s *specgen.SpecGenerator, raw RawPod) error {
+	for _, p := range raw.MaskedPaths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("masked path %s must be absolute", p)
+		}
+	}
+	if raw.Umask != "" {
+		if _, err := strconv.ParseUint(raw.Umask, 8, 32); err != nil || len(raw.Umask) > 4 {
+			return fmt.Errorf("invalid umask %q, must be an octal value such as 0022", raw.Umask)
+		}
+	}
+	s.NoNewPrivileges = raw.NoNewPrivileges
+	s.Mask = raw.MaskedPaths
+	s.ReadOnlyFilesystem = raw.ReadOnly
+	s.Umask = raw.Umask
+	s.Privileged = raw.Privileged
+	return applySecurityOpts(s, raw.SecurityOpt)
+}
+
+// applySecurityOpts sets security options given in the syntax of podman's
+// --security-opt, e.g. label=disable, seccomp=unconfined or apparmor=profile
+func applySecurityOpts(s *specgen.SpecGenerator, opts []string) error {
+	for _, opt := range opts {
+		if opt == "no-new-privileges" {
+			s.NoNewPrivileges = true
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("invalid security option %q, expected key=value", opt)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "label":
+			s.SelinuxOpts = append(s.SelinuxOpts, value)
+		case "seccomp":
+			if value != "unconfined" && !filepath.IsAbs(value) {
+				return fmt.Errorf("invalid security option %q, the seccomp profile must be unconfined or an absolute path on the host", opt)
+			}
+			s.SeccompProfilePath = value
+		case "apparmor":
+			s.ApparmorProfile = value
+		case "mask":
+			s.Mask = append(s.Mask, strings.Split(value, ":")...)
+		case "unmask":
+			s.Unmask = append(s.Unmask, strings.Split(value, ":")...)
+		case "proc-opts":
+			s.ProcOpts = append(s.ProcOpts, strings.Split(value, ",")...)
+		case "no-new-privileges":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid security option %q, expected true or false", opt)
+			}
+			s.NoNewPrivileges = s.NoNewPrivileges || enabled
+		default:
+			return fmt.Errorf("invalid security option %q, the key must be one of label, seccomp, apparmor, mask, unmask, proc-opts or no-new-privileges", opt)
+		}
+	}
+	return nil
+}
+
+// convertHealthcheck converts a healthcheck to podman's, with podman's defaults
+// for the unset fields
+func convertHealthcheck(h *healthcheck) (*manifest.Schema2HealthConfig, error) {
+	if h == nil {
+		return nil, nil
+	}
+	if len(h.Command) == 0 {
+		return nil, fmt.Errorf("Healthcheck requires a command")
+	}
+	config := &manifest.Schema2HealthConfig{
+		Test:     append([]string{"CMD"}, h.Command...),
+		Interval: 30 * time.Second,
+		Timeout:  30 * time.Second,
+		Retries:  3,
+	}
+	if len(h.Command) == 1 {
+		config.Test = []string{"CMD-SHELL", h.Command[0]}
+	}
+	for _, d := range []struct {
+		field string
+		value string
+		dest  *time.Duration
+	}{
+		{"interval", h.Interval, &config.Interval},
+		{"timeout", h.Timeout, &config.Timeout},
+		{"start_period", h.StartPeriod, &config.StartPeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid Healthcheck %s %q, must be a duration such as 30s", d.field, d.value)
+		}
+		*d.dest = v
+	}
+	if h.Retries < 0 {
+		return nil, fmt.Errorf("invalid Healthcheck retries %d", h.Retries)
+	}
+	if h.Retries > 0 {
+		config.Retries = h.Retries
+	}
+	return config, nil
+}
+
+// labelCommit labels a container or pod with its target, the ref the target
+// follows and the commit deploying it, and with the commit's author and subject
+// when commitLabels is set
+func (r *Raw) labelCommit(ctx context.Context, labels map[string]string) {
+	target := r.GetTarget()
+	labels[targetLabel] = target.displayName()
+	labels[methodLabel] = r.GetName()
+	if ref := target.ref(); ref != "" {
+		labels[refLabel] = ref
+	}
+	result := reconcileResultFrom(ctx)
+	if result == nil {
+		return
+	}
+	labels[commitLabel] = result.Commit
+	if r.CommitLabels && result.Author != "" {
+		labels[commitAuthorLabel] = result.Author
+		labels[commitSubjectLabel] = result.Subject
+	}
+}
+
+// applyRestartPolicy sets the restart policy of a container, always by default
+func applyRestartPolicy(s *specgen.SpecGenerator, raw RawPod) error {
+	policy := raw.RestartPolicy
+	if policy == "" {
+		policy = define.RestartPolicyAlways
+	}
+	switch policy {
+	case define.RestartPolicyNo, define.RestartPolicyOnFailure, define.RestartPolicyAlways, define.RestartPolicyUnlessStopped:
+	default:
+		return fmt.Errorf("invalid RestartPolicy %q, must be one of no, on-failure, always or unless-stopped", raw.RestartPolicy)
+	}
+	if raw.RestartRetries != nil && policy != define.RestartPolicyOnFailure {
+		return fmt.Errorf("RestartRetries can only be set with the on-failure RestartPolicy")
+	}
+	s.RestartPolicy = policy
+	s.RestartRetries = raw.RestartRetries
+	return nil
 }
 
-func createSpecGen(raw RawPod) *specgen.SpecGenerator {
+func createSpecGen(raw RawPod) (*specgen.SpecGenerator, error) {
 	// Create a new container
 	s := specgen.NewSpecGenerator(raw.Image, false)
 	s.Name = raw.Name
-	s.Env = map[string]string(raw.Env)
-	s.Mounts = convertMounts(raw.Mounts)
+	s.Env = make(map[string]string, len(raw.Env)+len(raw.EnvFrom))
+	for k, v := range raw.Env {
+		s.Env[k] = v
+	}
+	for k, ref := range raw.EnvFrom {
+		v, err := resolveSecretRef(ref)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error resolving secret for environment variable %s", k)
+		}
+		s.Env[k] = v
+	}
+	var err error
+	if s.Mounts, err = convertMounts(raw.Mounts); err != nil {
+		return nil, err
+	}
+	tmpfs, err := convertTmpfs(raw.Tmpfs)
+	if err != nil {
+		return nil, err
+	}
+	s.Mounts = append(s.Mounts, tmpfs...)
+	if s.Secrets, s.EnvSecrets, err = convertSecrets(raw.Secrets); err != nil {
+		return nil, err
+	}
+	if err := interpolateEnv(s); err != nil {
+		return nil, err
+	}
 	s.PortMappings = convertPorts(raw.Ports)
-	s.Volumes = convertVolumes(raw.Volumes)
+	if s.Volumes, err = convertVolumes(raw.Volumes); err != nil {
+		return nil, err
+	}
+	if s.NetNS, s.Networks, err = networkMode(raw); err != nil {
+		return nil, err
+	}
+	if s.HostAdd, err = convertHostAdd(raw.HostAdd); err != nil {
+		return nil, err
+	}
 	s.CapAdd = []string(raw.CapAdd)
 	s.CapDrop = []string(raw.CapDrop)
-	s.RestartPolicy = "always"
+	s.OCIRuntime = raw.Runtime
+	s.User = raw.User
+	s.Entrypoint = raw.Entrypoint
+	s.Command = raw.Command
+	s.WorkDir = raw.WorkingDir
+	if s.Timezone, err = convertTimezone(raw.Timezone); err != nil {
+		return nil, err
+	}
+	if s.LogConfiguration, err = convertLogConfig(raw.LogDriver, raw.LogOptions); err != nil {
+		return nil, err
+	}
+	if err := applyHardening(s, raw); err != nil {
+		return nil, err
+	}
+	if err := convertUserNS(s, raw); err != nil {
+		return nil, err
+	}
+	limits, err := resourceLimits(raw)
+	if err != nil {
+		return nil, err
+	}
+	s.ResourceLimits = limits
+	if s.ShmSize, err = convertShmSize(raw.ShmSize); err != nil {
+		return nil, err
+	}
+	if s.Rlimits, err = convertUlimits(raw.Ulimits); err != nil {
+		return nil, err
+	}
+	s.Sysctl = raw.Sysctls
+	if s.Devices, err = convertDevices(raw.Devices); err != nil {
+		return nil, err
+	}
+	s.StopTimeout = raw.StopTimeout
+	if raw.StopSignal != "" {
+		sig, err := signal.ParseSignalNameOrNumber(raw.StopSignal)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Invalid StopSignal %s", raw.StopSignal)
+		}
+		s.StopSignal = &sig
+	}
+	if err := applyRestartPolicy(s, raw); err != nil {
+		return nil, err
+	}
+	if s.HealthConfig, err = convertHealthcheck(raw.Healthcheck); err != nil {
+		return nil, err
+	}
+	s.Labels = make(map[string]string, len(raw.Labels)+1)
+	for k, v := range raw.Labels {
+		s.Labels[k] = v
+	}
 	// add a label to signify ownership of fetchit <--> this container
-	s.Labels = map[string]string{
-		"owned-by": FetchItLabel,
+	s.Labels["owned-by"] = FetchItLabel
+	if raw.nameTemplate != "" {
+		s.Labels[nameTemplateLabel] = raw.nameTemplate
 	}
-	return s
+	s.Annotations = raw.Annotations
+	return s, nil
 }
 
-func deleteContainer(conn context.Context, podName string) error {
-	err := containers.Stop(conn, podName, nil)
-	if err != nil {
+// stopTimeout returns the stop timeout for a container, preferring the file's
+// own value, then the method's and then the global default
+func (r *Raw) stopTimeout(raw *RawPod) *uint {
+	switch {
+	case raw.StopTimeout != nil:
+		return raw.StopTimeout
+	case r.StopTimeout != nil:
+		return r.StopTimeout
+	case fetchit != nil:
+		return fetchit.stopTimeout
+	}
+	return nil
+}
+
+// pullPolicy returns the image pull policy of the method, PullImage maps to Always
+func (r *Raw) pullPolicy() (string, error) {
+	switch {
+	case r.PullPolicy == "" && r.PullImage:
+		return pullAlways, nil
+	case r.PullPolicy == "":
+		return pullIfNotPresent, nil
+	}
+	for _, p := range []string{pullAlways, pullIfNotPresent, pullNever} {
+		if strings.EqualFold(r.PullPolicy, p) {
+			return p, nil
+		}
+	}
+	return "", utils.Classify(utils.ErrValidation, fmt.Errorf("invalid pullPolicy %q for raw method %s, must be %s, %s or %s", r.PullPolicy, r.Name, pullAlways, pullIfNotPresent, pullNever))
+}
+
+// deleteContainer stops and removes a container, a nil timeout uses the
+// stop timeout the container was created with
+func deleteContainer(conn context.Context, podName string, timeout *uint) error {
+	if err := stopContainer(conn, podName, timeout); err != nil {
 		return err
 	}
 
-	containers.Remove(conn, podName, new(containers.RemoveOptions).WithForce(true))
+	err := withPodman(conn, podmanTimeout(), "remove container "+podName, func(ctx context.Context) error {
+		_, err := containers.Remove(ctx, podName, new(containers.RemoveOptions).WithForce(true))
+		return err
+	})
+	audit(conn, auditContainer, podName, "", "remove", err)
+	return err
+}
+
+// deletePrevious deletes the container or pod of the previous version of a file
+// unless keep deploys the same one, a disabled file's container was already removed
+func (r *Raw) deletePrevious(conn context.Context, change *object.Change, prev *string, keep *RawPod) error {
+	if prev == nil {
+		return nil
+	}
+	raw, err := r.parsePrevRawPod([]byte(*prev), change.From.Name)
 	if err != nil {
 		return err
 	}
+	if !raw.enabled() || raw.sameDeployment(keep) {
+		return nil
+	}
+	if raw.isPod() {
+		return r.deletePodOf(conn, raw)
+	}
+	if hasNameTokens(raw.Name) {
+		return r.deleteInstances(conn, raw.Name, "", r.stopTimeout(raw))
+	}
 
+	r.disableUnits(conn, rawUnits(raw))
+	if err := deleteContainer(conn, raw.Name, r.stopTimeout(raw)); err != nil {
+		return err
+	}
+	if fetchit != nil {
+		fetchit.state.setContainerHash(r.GetTarget(), raw.Name, "")
+	}
+	mountWatches.set(conn, raw.Name, nil, nil)
+	r.GetTarget().logger().Infof("Deleted podman container %s", raw.Name)
 	return nil
 }
 
+// parseRawPod renders and parses a raw manifest, file is its path within the target path.
+// When the manifest has no Name and deriveNames is set, the name is derived
+// from the file so that the same name is found when the file is removed.
+func (r *Raw) parseRawPod(b []byte, file string) (*RawPod, error) {
+	return r.parseRawVersion(b, file, false)
+}
+
+// parsePrevRawPod parses the previous version of a raw manifest. The vars it
+// was rendered with may have changed since, so vars which are no longer set
+// render empty rather than failing, and its containers can still be found.
+func (r *Raw) parsePrevRawPod(b []byte, file string) (*RawPod, error) {
+	return r.parseRawVersion(b, file, true)
+}
+
+func (r *Raw) parseRawVersion(b []byte, file string, prev bool) (*RawPod, error) {
+	if r.Templates {
+		var vars map[string]string
+		if target := r.GetTarget(); target != nil {
+			vars = target.vars
+		}
+		var err error
+		if b, err = renderRawTemplate(b, file, vars, prev); err != nil {
+			return nil, utils.WrapErr(err, "Error parsing %s", file)
+		}
+	} else {
+		b = canonicalNameTokens(b)
+	}
+	raw, err := rawPodFromBytes(b)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error parsing %s", file)
+	}
+	if raw.isPod() {
+		if err := r.preparePod(raw, file); err != nil {
+			return nil, utils.WrapErr(err, "Error parsing %s", file)
+		}
+	} else if raw.Name == "" && r.DeriveNames {
+		raw.Name = deriveName(filepath.Join(r.TargetPath, file))
+		logger.Infof("Derived container name %s from %s", raw.Name, file)
+	}
+	if err := r.prefixNames(raw); err != nil {
+		return nil, utils.WrapErr(err, "Error parsing %s", file)
+	}
+	return raw, nil
+}
+
+var validNamePrefix = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// prefixNames prepends the method's NamePrefix to the names of the pod and
+// containers of a raw file, every later lookup of the containers by name then
+// uses the prefixed names
+func (r *Raw) prefixNames(raw *RawPod) error {
+	if r.NamePrefix == "" {
+		return nil
+	}
+	if !validNamePrefix.MatchString(r.NamePrefix) {
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("namePrefix %q of method %s is not a valid container name prefix", r.NamePrefix, r.Name))
+	}
+	if raw.isPod() {
+		raw.Pod = r.NamePrefix + raw.Pod
+		for i := range raw.Containers {
+			raw.Containers[i].Name = r.NamePrefix + raw.Containers[i].Name
+		}
+		return nil
+	}
+	if raw.Name != "" {
+		raw.Name = r.NamePrefix + raw.Name
+	}
+	return nil
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// deriveName derives a container name from a manifest path within the
+// repository, joining its directory and file name without its extension,
+// e.g. apps/web/colors.yaml becomes web-colors and apps/web/api.v2.yaml
+// becomes web-api.v2
+func deriveName(path string) string {
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	name := base
+	if dir := filepath.Base(filepath.Dir(path)); dir != "." && dir != string(filepath.Separator) {
+		name = dir + "-" + base
+	}
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), "-_.")
+	return name
+}
+
 func rawPodFromBytes(b []byte) (*RawPod, error) {
 	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, utils.Classify(utils.ErrValidation, errors.New("file is empty"))
+	}
 	raw := RawPod{}
 	if b[0] == '{' {
 		err := json.Unmarshal(b, &raw)
 		if err != nil {
-			return nil, utils.WrapErr(err, "Unable to unmarshal json")
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to unmarshal json")
+		}
+	} else if b[0] == '[' {
+		// A list of containers is a pod
+		if err := json.Unmarshal(b, &raw.Containers); err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to unmarshal json")
+		}
+	} else if b[0] == '-' && !bytes.HasPrefix(b, []byte("---")) {
+		if err := yaml.Unmarshal(b, &raw.Containers); err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to unmarshal yaml")
 		}
 	} else {
 		err := yaml.Unmarshal(b, &raw)
 		if err != nil {
-			return nil, utils.WrapErr(err, "Unable to unmarshal yaml")
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to unmarshal yaml")
+		}
+	}
+	var err error
+	for _, c := range append([]*RawPod{&raw}, containerRefs(raw.Containers)...) {
+		if c.CapAdd, err = normalizeCapabilities("CapAdd", c.CapAdd); err != nil {
+			return nil, err
+		}
+		if c.CapDrop, err = normalizeCapabilities("CapDrop", c.CapDrop); err != nil {
+			return nil, err
 		}
 	}
 	return &raw, nil
 }
 
+// normalizeCapabilities checks each entry of field is a known Linux capability,
+// returning them upper case with the CAP_ prefix, e.g. net_admin becomes CAP_NET_ADMIN
+func normalizeCapabilities(field string, caps []string) ([]string, error) {
+	var result []string
+	for _, c := range caps {
+		normalized, err := capabilities.NormalizeCapabilities([]string{strings.TrimSpace(c)})
+		if err != nil {
+			return nil, utils.Classify(utils.ErrValidation, fmt.Errorf("invalid capability %q in %s, it is not a known Linux capability", c, field))
+		}
+		result = append(result, normalized...)
+	}
+	return result, nil
+}
+
+// checkRuntime logs when a requested OCI runtime is not podman's default. Podman
+// only reports its default runtime, any other runtime is verified by podman
+// against the runtimes configured in containers.conf when the container is
+// created, and createAndStart reports a runtime podman does not know.
+func checkRuntime(conn context.Context, runtime string) error {
+	if runtime == "" {
+		return nil
+	}
+	info, err := podmanInfo(conn)
+	if err != nil {
+		return utils.WrapErr(err, "Error getting podman info to check OCI runtime %s", runtime)
+	}
+	if def := info.Host.OCIRuntime; def == nil || (def.Name != runtime && def.Path != runtime) {
+		logger.Infof("OCI runtime %s is not the podman default, it must be configured in containers.conf", runtime)
+	}
+	return nil
+}
+
 // Using this might not be necessary
-func removeExisting(conn context.Context, podName string) error {
-	inspectData, err := containers.Inspect(conn, podName, new(containers.InspectOptions).WithSize(true))
+func removeExisting(conn context.Context, podName string, timeout *uint) error {
+	var inspectData *define.InspectContainerData
+	err := withPodman(conn, podmanTimeout(), "inspect container "+podName, func(ctx context.Context) error {
+		var err error
+		inspectData, err = containers.Inspect(ctx, podName, new(containers.InspectOptions).WithSize(true))
+		return err
+	})
+	if utils.IsTransient(err) {
+		return err
+	}
 	if err == nil || inspectData == nil {
 		logger.Infof("A container named %s already exists. Removing the container before redeploy.", podName)
-		err := deleteContainer(conn, podName)
+		err := deleteContainer(conn, podName, timeout)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,875 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/common/libnetwork/types"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/podman/v4/pkg/bindings"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCreateSpecGenUser(t *testing.T) {
+	raw, err := rawPodFromBytes([]byte(`{"Image": "docker.io/library/busybox:latest", "Name": "user", "User": "1001:0", "WorkingDir": "/srv"}`))
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	s, err := createSpecGen(*raw)
+	if err != nil {
+		t.Fatalf("Failed: generating spec returned error: %v", err)
+	}
+	if s.User != "1001:0" {
+		t.Fatalf("Failed: spec user %q != 1001:0", s.User)
+	}
+	if s.WorkDir != "/srv" {
+		t.Fatalf("Failed: spec working directory %q != /srv", s.WorkDir)
+	}
+
+	raw.User = ""
+	if s, err = createSpecGen(*raw); err != nil {
+		t.Fatalf("Failed: generating spec returned error: %v", err)
+	}
+	if s.User != "" {
+		t.Fatalf("Failed: spec user %q set without a User", s.User)
+	}
+}
+
+func TestCreateSpecGenCommand(t *testing.T) {
+	raw, err := rawPodFromBytes([]byte("Image: docker.io/library/busybox:latest\nName: sleeper\nCommand: [\"sleep\", \"3600\"]\n"))
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	s, err := createSpecGen(*raw)
+	if err != nil {
+		t.Fatalf("Failed: generating spec returned error: %v", err)
+	}
+	if len(s.Command) != 2 || s.Command[0] != "sleep" || s.Command[1] != "3600" {
+		t.Fatalf("Failed: spec command %v != [sleep 3600]", s.Command)
+	}
+	// Only the command is overridden, the image's entrypoint is kept
+	if s.Entrypoint != nil {
+		t.Fatalf("Failed: spec entrypoint %v set without an Entrypoint", s.Entrypoint)
+	}
+}
+
+func TestCreateSpecGenTmpfs(t *testing.T) {
+	raw, err := rawPodFromBytes([]byte("Image: docker.io/library/busybox:latest\nName: scratch\nTmpfs:\n- destination: /scratch\n  options: [size=64m, mode=1777]\n"))
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	s, err := createSpecGen(*raw)
+	if err != nil {
+		t.Fatalf("Failed: generating spec returned error: %v", err)
+	}
+	if len(s.Mounts) != 1 {
+		t.Fatalf("Failed: spec has %d mounts, expected the tmpfs only", len(s.Mounts))
+	}
+	m := s.Mounts[0]
+	if m.Type != "tmpfs" || m.Destination != "/scratch" {
+		t.Fatalf("Failed: mount %s of type %s != tmpfs at /scratch", m.Destination, m.Type)
+	}
+	if len(m.Options) != 2 || m.Options[0] != "size=64m" || m.Options[1] != "mode=1777" {
+		t.Fatalf("Failed: tmpfs options %v != [size=64m mode=1777]", m.Options)
+	}
+}
+
+func TestParseRawPodContainers(t *testing.T) {
+	r := &Raw{CommonMethod: CommonMethod{TargetPath: "examples/raw"}}
+	raw, err := r.parseRawPod([]byte("- Image: docker.io/library/nginx:latest\n  Name: web\n- Image: docker.io/library/busybox:latest\n"), "web.yaml")
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	if !raw.isPod() || raw.Pod != "raw-web" {
+		t.Fatalf("Failed: list of containers parsed as pod %q", raw.Pod)
+	}
+	if names := raw.containerNames(); len(names) != 2 || names[0] != "web" || names[1] != "raw-web-2" {
+		t.Fatalf("Failed: pod container names %v != [web raw-web-2]", names)
+	}
+
+	if _, err := r.parseRawPod([]byte(`{"Pod": "web", "Containers": [{"Image": "docker.io/library/nginx:latest", "Ports": [{"container_port": 80, "host_port": 8080}]}]}`), "web.json"); err == nil {
+		t.Fatalf("Failed: container of a pod with Ports parsed without error")
+	}
+}
+
+func TestParseRawPodNamePrefix(t *testing.T) {
+	r := &Raw{CommonMethod: CommonMethod{TargetPath: "examples/raw", NamePrefix: "dev-"}}
+	raw, err := r.parseRawPod([]byte("Image: docker.io/library/nginx:latest\nName: web\n"), "web.yaml")
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	if raw.Name != "dev-web" {
+		t.Fatalf("Failed: prefixed container name %q != dev-web", raw.Name)
+	}
+	raw, err = r.parseRawPod([]byte("- Image: docker.io/library/nginx:latest\n  Name: web\n- Image: docker.io/library/busybox:latest\n"), "web.yaml")
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	if names := raw.containerNames(); raw.Pod != "dev-raw-web" || len(names) != 2 || names[0] != "dev-web" || names[1] != "dev-raw-web-2" {
+		t.Fatalf("Failed: prefixed pod %q with containers %v", raw.Pod, names)
+	}
+
+	r.NamePrefix = "-dev"
+	if _, err := r.parseRawPod([]byte("Image: docker.io/library/nginx:latest\nName: web\n"), "web.yaml"); err == nil {
+		t.Fatalf("Failed: invalid namePrefix parsed without error")
+	}
+}
+
+func TestRawPodValidate(t *testing.T) {
+	raw, err := rawPodFromBytes([]byte(`{"Name": "-web", "Ports": [{"host_port": 8080}], "Volumes": [{"name": "data", "dest": "/data"}], "Tmpfs": [{"destination": "/data/"}]}`))
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	err = raw.validate()
+	if err == nil {
+		t.Fatalf("Failed: invalid raw pod validated without error")
+	}
+	for _, want := range []string{"Image is required", `Name "-web"`, "host port 8080", "destination /data is mounted more than once"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("Failed: validation error %q does not report %q", err, want)
+		}
+	}
+	for _, empty := range []string{"", " \n\t\n"} {
+		if _, err := rawPodFromBytes([]byte(empty)); utils.ClassOf(err) != utils.ErrValidation {
+			t.Errorf("Failed: empty raw file %q returned %v", empty, err)
+		}
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	os.Setenv("FETCHIT_TEST_DOMAIN", "example.com")
+	defer os.Unsetenv("FETCHIT_TEST_DOMAIN")
+	s := specgen.NewSpecGenerator("docker.io/library/nginx:latest", false)
+	s.Env = map[string]string{"URL": "https://${env:FETCHIT_TEST_DOMAIN}/api", "PASSWORD": "${secret:db-password}", "PRICE": "$5"}
+	if err := interpolateEnv(s); err != nil {
+		t.Fatalf("Failed: interpolating env returned error: %v", err)
+	}
+	if s.Env["URL"] != "https://example.com/api" || s.Env["PRICE"] != "$5" {
+		t.Fatalf("Failed: interpolated env %v", s.Env)
+	}
+	if _, ok := s.Env["PASSWORD"]; ok || s.EnvSecrets["PASSWORD"] != "db-password" {
+		t.Fatalf("Failed: secret reference not moved to env secrets: %v %v", s.Env, s.EnvSecrets)
+	}
+
+	s.Env = map[string]string{"URL": "${env:FETCHIT_TEST_UNSET}"}
+	if err := interpolateEnv(s); err == nil {
+		t.Fatalf("Failed: reference to unset variable interpolated without error")
+	}
+}
+
+func TestDigestProblems(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	raw := &RawPod{Image: "quay.io/fetchit/fetchit@" + digest, ExpectedDigest: digest}
+	if problems := digestProblems(raw); len(problems) != 0 {
+		t.Fatalf("Failed: matching digests reported problems %v", problems)
+	}
+	raw.ExpectedDigest = "sha256:" + strings.Repeat("b", 64)
+	if problems := digestProblems(raw); len(problems) != 1 {
+		t.Fatalf("Failed: mismatched digests reported problems %v", problems)
+	}
+	raw = &RawPod{Image: "quay.io/fetchit/fetchit:latest", ExpectedDigest: "latest"}
+	if problems := digestProblems(raw); len(problems) != 1 {
+		t.Fatalf("Failed: malformed digest reported problems %v", problems)
+	}
+}
+
+func TestNormalizeMountOptions(t *testing.T) {
+	opts, err := normalizeMountOptions("Mounts", "/data", []string{"relabel=private", "readonly"})
+	if err != nil {
+		t.Fatalf("Failed: normalizing mount options returned error: %v", err)
+	}
+	if strings.Join(opts, ",") != "Z,ro" {
+		t.Fatalf("Failed: normalized mount options %v != [Z ro]", opts)
+	}
+	for _, opts := range [][]string{{"z", "Z"}, {"rw", "ro"}, {"relabel"}, {"size=64m"}} {
+		if _, err := normalizeMountOptions("Mounts", "/data", opts); err == nil {
+			t.Fatalf("Failed: mount options %v normalized without error", opts)
+		}
+	}
+	if _, err := normalizeMountOptions("Tmpfs", "/scratch", []string{"Z"}); err == nil {
+		t.Fatalf("Failed: tmpfs relabel option normalized without error")
+	}
+	mounts, err := convertMounts([]mount{{Destination: "/scratch", Type: "tmpfs", Options: []string{"size=64m", "mode=1777"}}})
+	if err != nil || strings.Join(mounts[0].Options, ",") != "size=64m,mode=1777" {
+		t.Fatalf("Failed: tmpfs mount options converted to %v, %v", mounts, err)
+	}
+	if _, err := convertMounts([]mount{{Destination: "/data", Type: "bind", Source: "/srv", Options: []string{"size=64m"}}}); err == nil {
+		t.Fatal("Failed: bind mount with a tmpfs option converted without error")
+	}
+}
+
+func TestConvertHostAdd(t *testing.T) {
+	for _, entry := range []string{"db:10.0.0.5", "db.internal:fd00::5"} {
+		if _, err := convertHostAdd([]string{entry}); err != nil {
+			t.Errorf("Failed: HostAdd entry %s returned error: %v", entry, err)
+		}
+	}
+	for _, entry := range []string{"db", ":10.0.0.5", "db:", "db:10.0.0", "my db:10.0.0.5"} {
+		if _, err := convertHostAdd([]string{entry}); err == nil {
+			t.Errorf("Failed: invalid HostAdd entry %s returned no error", entry)
+		}
+	}
+}
+
+func TestStaticAddresses(t *testing.T) {
+	raw := RawPod{Image: "docker.io/library/nginx:latest", Name: "web", Network: "lan", IPv4: "10.89.0.10", IPv6: "fd00::10", MAC: "92:d0:c6:0a:29:33"}
+	s, err := createSpecGen(raw)
+	if err != nil {
+		t.Fatalf("Failed: spec with static addresses returned error: %v", err)
+	}
+	opts, ok := s.Networks["lan"]
+	if !ok {
+		t.Fatalf("Failed: network lan missing from spec networks %v", s.Networks)
+	}
+	if len(opts.StaticIPs) != 2 || !opts.StaticIPs[0].Equal(net.ParseIP("10.89.0.10")) || !opts.StaticIPs[1].Equal(net.ParseIP("fd00::10")) {
+		t.Fatalf("Failed: static IPs %v != [10.89.0.10 fd00::10]", opts.StaticIPs)
+	}
+	if opts.StaticMAC.String() != "92:d0:c6:0a:29:33" {
+		t.Fatalf("Failed: static MAC %s != 92:d0:c6:0a:29:33", opts.StaticMAC.String())
+	}
+
+	for _, bad := range []RawPod{
+		{Image: raw.Image, Name: "web", IPv4: "10.89.0.10"},
+		{Image: raw.Image, Name: "web", Network: "host", IPv4: "10.89.0.10"},
+		{Image: raw.Image, Name: "web", Network: "lan", IPv4: "fd00::10"},
+		{Image: raw.Image, Name: "web", Network: "lan", IPv6: "10.89.0.10"},
+		{Image: raw.Image, Name: "web", Network: "lan", MAC: "92:d0"},
+		{Image: raw.Image, Name: "web", Networks: []network{{Name: "lan"}, {Name: "wan"}}, IPv4: "10.89.0.10"},
+	} {
+		if _, err := createSpecGen(bad); err == nil {
+			t.Errorf("Failed: spec with invalid static addresses %+v returned no error", bad)
+		}
+	}
+}
+
+func TestConvertTimezone(t *testing.T) {
+	for _, tz := range []string{"", "local", "UTC", "Europe/Berlin"} {
+		if got, err := convertTimezone(tz); err != nil || got != tz {
+			t.Errorf("Failed: timezone %q = %q, %v", tz, got, err)
+		}
+	}
+	for _, tz := range []string{"Local", "Mars/Olympus", "../etc/passwd"} {
+		if _, err := convertTimezone(tz); err == nil {
+			t.Errorf("Failed: unknown timezone %q returned no error", tz)
+		}
+	}
+}
+
+func TestCrashLoopLimits(t *testing.T) {
+	r := &Raw{CrashLoop: &crashLoop{}}
+	if restarts, window, err := r.crashLoopLimits(); err != nil || restarts != defaultCrashLoopRestarts || window != defaultCrashLoopWindow {
+		t.Fatalf("Failed: default crash loop limits %d, %s, %v", restarts, window, err)
+	}
+	r.CrashLoop = &crashLoop{Restarts: 5, Window: "30s"}
+	if restarts, window, err := r.crashLoopLimits(); err != nil || restarts != 5 || window.String() != "30s" {
+		t.Fatalf("Failed: crash loop limits %d, %s, %v != 5, 30s", restarts, window, err)
+	}
+	for _, bad := range []crashLoop{{Restarts: -1}, {Window: "0s"}, {Window: "soon"}} {
+		r.CrashLoop = &bad
+		if _, _, err := r.crashLoopLimits(); err == nil {
+			t.Errorf("Failed: invalid crash loop %+v returned no error", bad)
+		}
+	}
+}
+
+func TestWithPodmanTimeout(t *testing.T) {
+	err := withPodman(context.Background(), 10*time.Millisecond, "start container web", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || !utils.IsTransient(err) || !strings.Contains(err.Error(), "did not start container web within 10ms") {
+		t.Fatalf("Failed: timed out podman call returned %v", err)
+	}
+	if err := withPodman(context.Background(), time.Second, "start container web", func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("Failed: podman call returned %v", err)
+	}
+}
+
+func TestShmSizeAndPidsLimit(t *testing.T) {
+	raw := RawPod{Image: "docker.io/library/postgres:latest", Name: "db"}
+	s, err := createSpecGen(raw)
+	if err != nil {
+		t.Fatalf("Failed: spec returned error: %v", err)
+	}
+	if s.ShmSize != nil || s.ResourceLimits != nil {
+		t.Fatalf("Failed: unset ShmSize and PidsLimit changed the spec defaults")
+	}
+
+	pids := int64(512)
+	raw.ShmSize, raw.PidsLimit = "1g", &pids
+	if s, err = createSpecGen(raw); err != nil {
+		t.Fatalf("Failed: spec with ShmSize and PidsLimit returned error: %v", err)
+	}
+	if s.ShmSize == nil || *s.ShmSize != 1<<30 {
+		t.Fatalf("Failed: ShmSize %v != 1g", s.ShmSize)
+	}
+	if s.ResourceLimits == nil || s.ResourceLimits.Pids == nil || s.ResourceLimits.Pids.Limit != 512 {
+		t.Fatalf("Failed: pids limit %+v != 512", s.ResourceLimits)
+	}
+
+	bad := int64(-2)
+	for _, shm := range []string{"lots", "0"} {
+		if _, err := createSpecGen(RawPod{Image: raw.Image, Name: "db", ShmSize: shm}); err == nil {
+			t.Errorf("Failed: invalid ShmSize %q returned no error", shm)
+		}
+	}
+	if _, err := createSpecGen(RawPod{Image: raw.Image, Name: "db", PidsLimit: &bad}); err == nil {
+		t.Errorf("Failed: invalid PidsLimit %d returned no error", bad)
+	}
+}
+
+func TestConvertUserNS(t *testing.T) {
+	for _, userNS := range []string{"auto", "auto:size=65536,uidmapping=0:100000:1000", "keep-id", "nomap", "host", "private"} {
+		s := specgen.NewSpecGenerator("docker.io/library/nginx:latest", false)
+		if err := convertUserNS(s, RawPod{UserNS: userNS}); err != nil {
+			t.Errorf("Failed: UserNS %s returned error: %v", userNS, err)
+		}
+	}
+	s := specgen.NewSpecGenerator("docker.io/library/nginx:latest", false)
+	if err := convertUserNS(s, RawPod{UserNS: "auto:size=65536"}); err != nil || s.IDMappings == nil || !s.IDMappings.AutoUserNs || s.IDMappings.AutoUserNsOpts.Size != 65536 {
+		t.Fatalf("Failed: UserNS auto:size=65536 mapped to %+v, %v", s.IDMappings, err)
+	}
+
+	mappings := &idMappings{UIDMap: []string{"0:100000:65536"}}
+	for _, bad := range []RawPod{
+		{UserNS: "container:db"},
+		{UserNS: "auto:size=lots"},
+		{UserNS: "keep-id", IDMappings: mappings},
+		{UserNS: "auto", Privileged: true},
+		{IDMappings: mappings, Privileged: true},
+	} {
+		if err := convertUserNS(specgen.NewSpecGenerator("docker.io/library/nginx:latest", false), bad); err == nil {
+			t.Errorf("Failed: UserNS %q with IDMappings %v and Privileged %t returned no error", bad.UserNS, bad.IDMappings != nil, bad.Privileged)
+		}
+	}
+}
+
+func TestRawUnits(t *testing.T) {
+	if units := rawUnits(&RawPod{Name: "web"}); len(units) != 1 || units[0] != "container-web.service" {
+		t.Fatalf("Failed: units of container web %v", units)
+	}
+	pod := &RawPod{Pod: "app", Containers: []RawPod{{Name: "app-web"}, {Name: "app-proxy"}}}
+	units := rawUnits(pod)
+	if strings.Join(units, " ") != "pod-app.service container-app-web.service container-app-proxy.service" {
+		t.Fatalf("Failed: units of pod app %v", units)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	for in, want := range map[string]platform{
+		"linux/arm64":    {OS: "linux", Arch: "arm64"},
+		"linux/arm/v7":   {OS: "linux", Arch: "arm", Variant: "v7"},
+		"linux/amd64/v3": {OS: "linux", Arch: "amd64", Variant: "v3"},
+	} {
+		got, err := parsePlatform(in)
+		if err != nil || got != want || got.String() != in {
+			t.Errorf("Failed: platform %s parsed as %+v, %v", in, got, err)
+		}
+	}
+	for _, bad := range []string{"arm64", "linux/", "/arm64", "linux/arm/v7/extra", "linux/arm 64"} {
+		if _, err := parsePlatform(bad); err == nil {
+			t.Errorf("Failed: invalid platform %q returned no error", bad)
+		}
+	}
+}
+
+func TestConvertLogConfig(t *testing.T) {
+	config, err := convertLogConfig("", nil)
+	if err != nil || config != nil {
+		t.Fatalf("Failed: unset log driver returned %+v, %v", config, err)
+	}
+	config, err = convertLogConfig("k8s-file", map[string]string{"max-size": "10mb", "path": "/var/log/app.log", "tag": "app"})
+	if err != nil {
+		t.Fatalf("Failed: k8s-file log config returned error: %v", err)
+	}
+	if config.Driver != "k8s-file" || config.Size != 10000000 || config.Path != "/var/log/app.log" || config.Options["tag"] != "app" {
+		t.Fatalf("Failed: k8s-file log config %+v", config)
+	}
+	for _, bad := range []struct {
+		driver  string
+		options map[string]string
+	}{
+		{"", map[string]string{"tag": "app"}},
+		{"syslog", nil},
+		{"journald", map[string]string{"max-size": "10mb"}},
+		{"none", map[string]string{"tag": "app"}},
+		{"k8s-file", map[string]string{"max-size": "huge"}},
+		{"k8s-file", map[string]string{"path": "app.log"}},
+		{"k8s-file", map[string]string{"max-file": "3"}},
+	} {
+		if _, err := convertLogConfig(bad.driver, bad.options); err == nil {
+			t.Errorf("Failed: log driver %q with options %v returned no error", bad.driver, bad.options)
+		}
+	}
+}
+
+func TestBlueGreenBlocker(t *testing.T) {
+	raw := &RawPod{Name: "web", Ports: []port{{ContainerPort: 80}}}
+	s := &specgen.SpecGenerator{}
+	s.Networks = map[string]types.PerNetworkOptions{"app": {}}
+	if reason := blueGreenBlocker(raw, s); reason != "" {
+		t.Fatalf("Failed: container without host ports blocked from blue-green: %s", reason)
+	}
+	raw.Ports[0].HostPort = 8080
+	if blueGreenBlocker(raw, s) == "" {
+		t.Errorf("Failed: container publishing a host port allowed blue-green")
+	}
+	raw.Ports = nil
+	s.Networks["app"] = types.PerNetworkOptions{StaticIPs: []net.IP{net.ParseIP("10.89.0.10")}}
+	if blueGreenBlocker(raw, s) == "" {
+		t.Errorf("Failed: container with a static IP allowed blue-green")
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	raw := &RawPod{Image: "docker.io/library/postgres:15", Name: "db", ReadinessExec: []string{"pg_isready"}}
+	if timeout, err := raw.readinessTimeout(); err != nil || timeout != defaultReadinessTimeout {
+		t.Fatalf("Failed: default readiness timeout %s, %v", timeout, err)
+	}
+	raw.ReadinessTimeout = "30s"
+	if err := raw.validate(); err != nil {
+		t.Fatalf("Failed: valid ReadinessTimeout returned error: %v", err)
+	}
+	for _, bad := range []string{"soon", "0s", "-5s"} {
+		raw.ReadinessTimeout = bad
+		if err := raw.validate(); err == nil {
+			t.Errorf("Failed: ReadinessTimeout %q returned no error", bad)
+		}
+	}
+	raw.ReadinessExec, raw.ReadinessTimeout = nil, "30s"
+	if err := raw.validate(); err == nil {
+		t.Errorf("Failed: ReadinessTimeout without ReadinessExec returned no error")
+	}
+}
+
+func TestImagePolicy(t *testing.T) {
+	policy, err := newImagePolicy([]string{"quay.io/myorg/**", "docker.io/library/nginx"}, []string{"quay.io/myorg/*:latest"})
+	if err != nil {
+		t.Fatalf("Failed: compiling image policy returned error: %v", err)
+	}
+	for image, allowed := range map[string]bool{
+		"quay.io/myorg/web:1.2": true,
+		"quay.io/myorg/team/api@sha256:" + strings.Repeat("a", 64): true,
+		"docker.io/library/nginx:1.25":                             true,
+		"quay.io/myorg/web:latest":                                 false,
+		"quay.io/other/web:1.2":                                    false,
+		"docker.io/library/redis:7":                                false,
+		"nginx:1.25":                                               false,
+	} {
+		if err := policy.check(image); (err == nil) != allowed {
+			t.Errorf("Failed: image %s allowed %t, want %t: %v", image, err == nil, allowed, err)
+		}
+	}
+	if policy, _ := newImagePolicy(nil, nil); policy.check("nginx") != nil {
+		t.Errorf("Failed: image rejected without an image policy")
+	}
+
+	images, err := kubeImages([]byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  initContainers:
+  - name: init
+    image: quay.io/myorg/init:1
+  containers:
+  - name: web
+    image: quay.io/myorg/web:1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  template:
+    spec:
+      containers:
+      - name: api
+        image: docker.io/library/redis:7
+`))
+	if err != nil || strings.Join(images, " ") != "docker.io/library/redis:7 quay.io/myorg/init:1 quay.io/myorg/web:1" {
+		t.Errorf("Failed: kube images %v, %v", images, err)
+	}
+}
+
+func TestNameTokens(t *testing.T) {
+	b, err := renderRawTemplate([]byte(`{"Image": "docker.io/library/nginx:latest", "Name": "web-{{ .ShortSHA }}-{{ .Timestamp }}"}`), "web.json", nil, false)
+	if err != nil {
+		t.Fatalf("Failed: rendering returned error: %v", err)
+	}
+	raw, err := rawPodFromBytes(b)
+	if err != nil {
+		t.Fatalf("Failed: parsing raw pod returned error: %v", err)
+	}
+	if err := raw.validate(); err != nil {
+		t.Errorf("Failed: name with tokens is invalid: %v", err)
+	}
+
+	r := &Raw{}
+	ctx := context.WithValue(context.Background(), reconcileResultKey{}, &ReconcileResult{Commit: "4b825dc642cb6eb9a060e54bf8d69288fbee4904"})
+	r.expandName(ctx, raw)
+	if raw.stableName() != "web-{{.ShortSHA}}-{{.Timestamp}}" {
+		t.Errorf("Failed: stable name is %q", raw.stableName())
+	}
+	if !strings.HasPrefix(raw.Name, "web-4b825dc64-") || hasNameTokens(raw.Name) {
+		t.Errorf("Failed: expanded name is %q", raw.Name)
+	}
+	s, err := createSpecGen(*raw)
+	if err != nil {
+		t.Fatalf("Failed: generating spec returned error: %v", err)
+	}
+	if s.Name != raw.Name || s.Labels[nameTemplateLabel] != raw.stableName() {
+		t.Errorf("Failed: container %s is labeled %q", s.Name, s.Labels[nameTemplateLabel])
+	}
+
+	static := &RawPod{Image: "docker.io/library/nginx:latest", Name: "web"}
+	r.expandName(ctx, static)
+	if s, _ := createSpecGen(*static); s.Name != "web" || s.Labels[nameTemplateLabel] != "" {
+		t.Errorf("Failed: name without tokens changed to %s, labeled %q", s.Name, s.Labels[nameTemplateLabel])
+	}
+
+	pod := &RawPod{Pod: "web", Containers: []RawPod{{Image: "docker.io/library/nginx:latest", Name: "web-{{.Commit}}"}}}
+	if err := pod.validate(); err == nil || !strings.Contains(err.Error(), "cannot be used in pods") {
+		t.Errorf("Failed: pod container with name tokens was accepted: %v", err)
+	}
+}
+
+func TestLoadEnvFilesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	outside := filepath.Join(dir, "secrets.env")
+	if err := os.WriteFile(outside, []byte("TOKEN=secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join("repo", "env"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("repo", "env", "app.env"), []byte("PORT=8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("app.env", filepath.Join("repo", "env", "link.env")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join("repo", "env", "escape.env")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Raw{CommonMethod: CommonMethod{target: &Target{url: "https://github.com/containers/repo.git"}}}
+	raw := &RawPod{Name: "web", EnvFile: []string{"env/link.env"}}
+	if err := r.loadEnvFiles(raw); err != nil || raw.Env["PORT"] != "8080" {
+		t.Errorf("Failed: env file linked within the repository loaded %v, %v", raw.Env, err)
+	}
+	raw = &RawPod{Name: "web", EnvFile: []string{"env/escape.env"}}
+	if err := r.loadEnvFiles(raw); err == nil || raw.Env["TOKEN"] != "" {
+		t.Errorf("Failed: env file linked outside of the repository loaded %v", raw.Env)
+	}
+}
+
+func TestPreDeploySpecStaticAddresses(t *testing.T) {
+	raw := RawPod{Image: "docker.io/library/postgres:15", Name: "db", Network: "lan", IPv4: "10.89.0.10", IPv6: "fd00::10", MAC: "92:d0:c6:0a:29:33",
+		Ports: []port{{HostPort: 5432, ContainerPort: 5432}}, PreDeploy: []string{"migrate up"}}
+	s, err := createSpecGen(raw)
+	if err != nil {
+		t.Fatalf("Failed: generating spec returned error: %v", err)
+	}
+	h := preDeploySpec(s, raw.PreDeploy)
+	if h.Name != "db-predeploy" || len(h.PortMappings) != 0 {
+		t.Errorf("Failed: PreDeploy container %s publishes %v", h.Name, h.PortMappings)
+	}
+	opts, ok := h.Networks["lan"]
+	if !ok {
+		t.Fatalf("Failed: PreDeploy container is not on network lan: %v", h.Networks)
+	}
+	if len(opts.StaticIPs) != 0 || len(opts.StaticMAC) != 0 {
+		t.Errorf("Failed: PreDeploy container takes the static addresses %v %s of the running container", opts.StaticIPs, opts.StaticMAC)
+	}
+	if len(s.Networks["lan"].StaticIPs) != 2 || len(s.Networks["lan"].StaticMAC) == 0 {
+		t.Errorf("Failed: PreDeploy spec changed the static addresses of the container spec")
+	}
+}
+
+func TestHealthDeadline(t *testing.T) {
+	h, err := convertHealthcheck(&healthcheck{Command: []string{"true"}, Interval: "10s", Timeout: "5s", Retries: 3, StartPeriod: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := healthDeadline(h); got != 105*time.Second {
+		t.Errorf("Failed: health deadline %s, want 1m45s", got)
+	}
+	if got := healthDeadline(&manifest.Schema2HealthConfig{}); got != defaultHealthInterval {
+		t.Errorf("Failed: health deadline without settings %s, want %s", got, defaultHealthInterval)
+	}
+}
+
+func TestSystemdImageSupports(t *testing.T) {
+	old := map[string]string{}
+	current := map[string]string{systemdActionsLabel: "enable restart stop disable"}
+	for _, action := range []string{"enable", "restart", "stop"} {
+		if !systemdImageSupports(old, action) {
+			t.Errorf("every helper image should run %s", action)
+		}
+	}
+	if systemdImageSupports(old, "disable") {
+		t.Error("a helper image without the actions label should not run disable")
+	}
+	if systemdImageSupports(map[string]string{systemdActionsLabel: "enable restart"}, "disable") {
+		t.Error("a helper image whose label omits disable should not run it")
+	}
+	if !systemdImageSupports(current, "disable") {
+		t.Error("a helper image labeled with disable should run it")
+	}
+}
+
+func TestWatchPullPolicy(t *testing.T) {
+	for policy, want := range map[string]string{pullAlways: "always", pullIfNotPresent: "newer"} {
+		if got := watchPullPolicy(policy); got != want {
+			t.Errorf("Failed: image watch policy for %s is %q, want %q", policy, got, want)
+		}
+	}
+}
+
+func TestRawTemplatesOptIn(t *testing.T) {
+	r := &Raw{}
+	raw, err := r.parseRawPod([]byte(`{"Image": "docker.io/library/nginx:latest", "Name": "web-{{ .ShortSHA }}", "Command": ["echo", "{{ literal }}"]}`), "web.json")
+	if err != nil {
+		t.Fatalf("Failed: a file with literal braces returned error without templates: %v", err)
+	}
+	if raw.Name != "web-"+shortSHAToken || raw.Command[1] != "{{ literal }}" {
+		t.Errorf("Failed: file without templates parsed as %q %v", raw.Name, raw.Command)
+	}
+
+	r.Templates = true
+	r.target = &Target{vars: map[string]string{}}
+	file := []byte(`{"Image": "docker.io/library/nginx:latest", "Name": "web{{ .Vars.suffix }}"}`)
+	if _, err := r.parseRawPod(file, "web.json"); err == nil {
+		t.Error("Failed: a file referencing an unset var should fail to deploy")
+	}
+	prev, err := r.parsePrevRawPod(file, "web.json")
+	if err != nil {
+		t.Fatalf("Failed: the previous version returned error after its var was removed: %v", err)
+	}
+	if prev.Name != "web" {
+		t.Errorf("Failed: previous version is named %q, want web", prev.Name)
+	}
+}
+
+func TestUnknownRuntime(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	conn, _ := fakePodman(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"cause":"invalid argument","message":"cannot find OCI runtime \"my-crun\": invalid argument","response":500}`))
+	})
+	s := specgen.NewSpecGenerator("docker.io/library/nginx:latest", false)
+	s.Name = "web"
+	s.OCIRuntime = "my-crun"
+	err := createAndStart(conn, s)
+	if err == nil || !strings.Contains(err.Error(), "OCI runtime my-crun is not available in podman") {
+		t.Fatalf("Failed: unknown runtime returned %v", err)
+	}
+}
+
+func TestRedactRaw(t *testing.T) {
+	raw := &RawPod{Pod: "web", Containers: []RawPod{{Name: "app", Env: map[string]string{"DB_PASSWORD": "hunter2"}}}}
+	s := &specgen.SpecGenerator{}
+	s.Env = map[string]string{"API_KEY": "from-env-file"}
+	if got := redactRaw(raw).Containers[0].Env["DB_PASSWORD"]; got != redacted {
+		t.Errorf("Failed: container env dumped as %q", got)
+	}
+	if got := redactSpec(s).Env["API_KEY"]; got != redacted {
+		t.Errorf("Failed: spec env dumped as %q", got)
+	}
+	if raw.Containers[0].Env["DB_PASSWORD"] != "hunter2" || s.Env["API_KEY"] != "from-env-file" {
+		t.Error("Failed: redacting changed the environment that is deployed")
+	}
+}
+
+func TestIsCrashLoop(t *testing.T) {
+	if isCrashLoop(utils.WrapErr(context.Canceled, "Error watching container web")) {
+		t.Error("Failed: a cancelled watch is taken for a crash loop")
+	}
+	err := utils.WrapErr(utils.Classify(utils.ErrValidation, &crashLoopError{"container web exited with code 1"}), "Error replacing container web")
+	if !isCrashLoop(err) {
+		t.Error("Failed: a wrapped crash loop is not recognized")
+	}
+}
+
+func TestDeriveName(t *testing.T) {
+	for path, want := range map[string]string{
+		"apps/web/colors.yaml": "web-colors",
+		"apps/web/api.v2.yaml": "web-api.v2",
+		"web.json":             "web",
+	} {
+		if got := deriveName(path); got != want {
+			t.Errorf("Failed: %s derives name %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestHookCommand(t *testing.T) {
+	entrypoint, command := hookCommand([]string{"./migrate up && ./seed"})
+	if strings.Join(entrypoint, " ") != "/bin/sh -c" || len(command) != 1 || command[0] != "./migrate up && ./seed" {
+		t.Errorf("Failed: single element hook split into %v %v", entrypoint, command)
+	}
+	entrypoint, command = hookCommand([]string{"/app/migrate", "up", "--timeout", "30s"})
+	if strings.Join(entrypoint, " ") != "/app/migrate" || strings.Join(command, " ") != "up --timeout 30s" {
+		t.Errorf("Failed: hook split into %v %v", entrypoint, command)
+	}
+}
+
+func TestHookLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	w := &hookLog{log: zap.New(core).Sugar(), prefix: "PostDeploy web"}
+	w.Write([]byte("checking /healthz\nstatus 2"))
+	w.Write([]byte("00\nsmoke test "))
+	if logs.Len() != 2 {
+		t.Fatalf("Failed: %d lines logged before the hook finished, want 2", logs.Len())
+	}
+	w.Close()
+	var lines []string
+	for _, entry := range logs.All() {
+		lines = append(lines, entry.Message)
+	}
+	want := []string{"PostDeploy web: checking /healthz", "PostDeploy web: status 200", "PostDeploy web: smoke test "}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Failed: hook output logged as %q, want %q", lines, want)
+	}
+}
+
+// fakePodman serves handler as the podman API and returns a connection to it,
+// along with the method and path of each request handler received
+func TestStuckPodman(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	prev := fetchit
+	defer func() { fetchit = prev }()
+	fetchit = &Fetchit{podmanTimeout: 50 * time.Millisecond}
+	// a socket which accepts requests but never answers
+	conn, _ := fakePodman(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	if _, err := containerExists(conn, "web"); !utils.IsTransient(err) {
+		t.Errorf("Failed: checking a container on a stuck socket returned %v", err)
+	}
+	if err := stopContainer(conn, "web", nil); !utils.IsTransient(err) {
+		t.Errorf("Failed: stopping a container on a stuck socket returned %v", err)
+	}
+	if err := waitHealthy(conn, "web"); !utils.IsTransient(err) {
+		t.Errorf("Failed: waiting for a container on a stuck socket returned %v", err)
+	}
+}
+
+func fakePodman(t *testing.T, handler http.HandlerFunc) (context.Context, *[]string) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_ping") {
+			w.Header().Set("Libpod-API-Version", "4.2.0")
+			w.Write([]byte("OK"))
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	conn, err := bindings.NewConnection(context.Background(), "tcp://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, &requests
+}
+
+func TestRawVolumes(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	raw := &RawPod{Pod: "app", RemoveVolumesOnDelete: true, Containers: []RawPod{
+		{Name: "db", Volumes: []namedVolume{{Name: "scratch", Dest: "/tmp/scratch", Driver: "local", DriverOptions: map[string]string{"type": "tmpfs", "device": "tmpfs"}}}},
+		{Name: "web", Volumes: []namedVolume{{Name: "static", Dest: "/srv"}}},
+	}}
+	vols := rawVolumes(raw)
+	if len(vols) != 2 || vols[0].Name != "scratch" || vols[0].Options["type"] != "tmpfs" || vols[1].Name != "static" || !vols[1].RemoveOnDelete {
+		t.Fatalf("Failed: volumes of pod %+v", vols)
+	}
+
+	var created entities.VolumeCreateOptions
+	conn, requests := fakePodman(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/exists"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	if err := ensureVolume(conn, vols[0]); err != nil {
+		t.Fatalf("Failed: creating volume returned error: %v", err)
+	}
+	if created.Name != "scratch" || created.Driver != "local" || created.Options["device"] != "tmpfs" || created.Labels["owned-by"] != FetchItLabel {
+		t.Errorf("Failed: volume created as %+v", created)
+	}
+
+	*requests = nil
+	if err := removeVolume(conn, &RawVolume{Name: "scratch"}); err != nil || len(*requests) != 0 {
+		t.Errorf("Failed: volume without RemoveOnDelete removed with requests %v, %v", *requests, err)
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger = zap.New(core).Sugar()
+	defer func() { logger = zap.NewNop().Sugar() }()
+	var query string
+	conn, requests := fakePodman(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(`[{"Id":"sha256:4b825dc642cb","Size":2000000}]`))
+	})
+
+	r := &Raw{CommonMethod: CommonMethod{Name: "apps", target: &Target{}}}
+	r.pruneImages(conn)
+	if len(*requests) != 0 {
+		t.Fatalf("Failed: images pruned without pruneImages: %v", *requests)
+	}
+
+	r.PruneImages = true
+	r.pruneImages(conn)
+	if len(*requests) != 1 || !strings.HasSuffix((*requests)[0], "/images/prune") {
+		t.Fatalf("Failed: pruning images made requests %v", *requests)
+	}
+	if !strings.Contains(query, "all=false") {
+		t.Errorf("Failed: images used by no container pruned as well as dangling ones, query %q", query)
+	}
+	if logs.FilterMessage("Pruned 1 dangling images, reclaimed 2MB").Len() != 1 {
+		t.Errorf("Failed: reclaimed space not logged, logged %v", logs.All())
+	}
+}
+
+func TestPullKey(t *testing.T) {
+	web := (&CommonMethod{RegistryUsername: "web", RegistryPassword: "secret"}).pullOptions()
+	db := (&CommonMethod{AuthFile: "/opt/mount/auth.json"}).pullOptions()
+	image := "quay.io/example/app:latest"
+	if pullKey(image, "", web) == pullKey(image, "", db) || pullKey(image, "", web) == pullKey(image, "", nil) {
+		t.Errorf("Failed: pulls with different credentials share a key")
+	}
+	if pullKey(image, "", web) != pullKey(image, "", (&CommonMethod{RegistryUsername: "web", RegistryPassword: "secret"}).pullOptions()) {
+		t.Errorf("Failed: pulls with the same credentials do not share a key")
+	}
+}
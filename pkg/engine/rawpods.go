@@ -0,0 +1,363 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/pods"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// isPod reports whether a raw file groups its Containers into a pod
+func (raw *RawPod) isPod() bool {
+	return len(raw.Containers) > 0
+}
+
+// containerNames returns the names of the containers deployed from a raw file
+func (raw *RawPod) containerNames() []string {
+	if !raw.isPod() {
+		if raw.Name == "" {
+			return nil
+		}
+		return []string{raw.Name}
+	}
+	names := make([]string, 0, len(raw.Containers))
+	for _, c := range raw.Containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func containerRefs(list []RawPod) []*RawPod {
+	refs := make([]*RawPod, 0, len(list))
+	for i := range list {
+		refs = append(refs, &list[i])
+	}
+	return refs
+}
+
+// describe names what a raw file deploys, for logs
+func (raw *RawPod) describe() string {
+	if raw.isPod() {
+		return "pod " + raw.Pod
+	}
+	return "container " + raw.Name
+}
+
+// sameDeployment reports whether two versions of a raw file deploy the same pod or container
+func (raw *RawPod) sameDeployment(other *RawPod) bool {
+	if other == nil || raw.isPod() != other.isPod() {
+		return false
+	}
+	if raw.isPod() {
+		return raw.Pod == other.Pod
+	}
+	return raw.stableName() == other.stableName()
+}
+
+// preparePod names a pod and its containers and checks that the fields of the
+// pod and its containers can be combined. A pod without a name is named after
+// its file, and a container without a name after the pod and its position.
+func (r *Raw) preparePod(raw *RawPod, file string) error {
+	if raw.Image != "" || raw.Name != "" {
+		return utils.Classify(utils.ErrValidation, fmt.Errorf("Image and Name cannot be set with Containers, they are set on each container"))
+	}
+	if raw.Pod == "" {
+		raw.Pod = deriveName(filepath.Join(r.TargetPath, file))
+	}
+	for i := range raw.Containers {
+		c := &raw.Containers[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s-%d", raw.Pod, i+1)
+		}
+		if len(c.Ports) > 0 || c.Network != "" || len(c.NetworkAliases) > 0 || len(c.Networks) > 0 || len(c.HostAdd) > 0 || c.hasStaticAddress() {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("container %s of pod %s shares the pod's network, set Ports, networks and HostAdd on the pod", c.Name, raw.Pod))
+		}
+		if c.ShmSize != "" {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("container %s of pod %s shares the pod's /dev/shm, set ShmSize on the pod", c.Name, raw.Pod))
+		}
+		if c.isPod() || c.Pod != "" || c.Enabled != nil {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("container %s of pod %s cannot set Pod, Containers or Enabled", c.Name, raw.Pod))
+		}
+		if len(c.PreDeploy) > 0 || len(c.PostDeploy) > 0 || len(c.ReadinessExec) > 0 {
+			return utils.Classify(utils.ErrValidation, fmt.Errorf("container %s of pod %s cannot set PreDeploy, PostDeploy or ReadinessExec, hooks are not supported in pods", c.Name, raw.Pod))
+		}
+	}
+	return nil
+}
+
+// podSpecGen generates the spec of a pod, its Ports, networks, HostAdd and
+// ShmSize apply to every container in the pod
+func podSpecGen(raw *RawPod) (*specgen.PodSpecGenerator, error) {
+	p := specgen.NewPodSpecGenerator()
+	p.Name = raw.Pod
+	p.PortMappings = convertPorts(raw.Ports)
+	var err error
+	if p.NetNS, p.Networks, err = networkMode(*raw); err != nil {
+		return nil, err
+	}
+	if p.HostAdd, err = convertHostAdd(raw.HostAdd); err != nil {
+		return nil, err
+	}
+	if p.ShmSize, err = convertShmSize(raw.ShmSize); err != nil {
+		return nil, err
+	}
+	p.Labels = make(map[string]string, len(raw.Labels)+1)
+	for k, v := range raw.Labels {
+		p.Labels[k] = v
+	}
+	p.Labels["owned-by"] = FetchItLabel
+	return p, nil
+}
+
+// podHash hashes the specs of a pod and its containers
+func podHash(p *specgen.PodSpecGenerator, specs []*specgen.SpecGenerator) (string, error) {
+	b, err := json.Marshal(struct {
+		Pod        *specgen.PodSpecGenerator
+		Containers []*specgen.SpecGenerator
+	}{p, specs})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// rawPodmanPod deploys a raw file grouping several containers into a pod. The
+// pod and its containers are replaced together whenever their specs change.
+func (r *Raw) rawPodmanPod(ctx, conn context.Context, change *object.Change, prev *string, path string, raw *RawPod) error {
+	log := r.GetTarget().logger()
+	if !raw.enabled() {
+		return r.disable(conn, change, prev, raw)
+	}
+
+	p, err := podSpecGen(raw)
+	if err != nil {
+		return utils.WrapErrClass(utils.ErrValidation, err, "Error generating pod spec from %s", path)
+	}
+	specs := make([]*specgen.SpecGenerator, 0, len(raw.Containers))
+	for i := range raw.Containers {
+		c := &raw.Containers[i]
+		c.StopTimeout = r.stopTimeout(c)
+		if c.Privileged {
+			log.Warnf("Container %s of pod %s from %s is privileged, it has full access to the host", c.Name, raw.Pod, path)
+		}
+		if c.ReadOnly {
+			log.Infof("Container %s of pod %s from %s has a read-only root filesystem, only its volumes, mounts and tmpfs are writable", c.Name, raw.Pod, path)
+		}
+		if err := r.fetchImage(ctx, conn, c); err != nil {
+			return err
+		}
+		if err := checkRuntime(conn, c.Runtime); err != nil {
+			return err
+		}
+		if err := r.loadEnvFiles(c); err != nil {
+			return err
+		}
+		if err := waitHostUnits(ctx, c.Name, c.RequiresHostUnit); err != nil {
+			return err
+		}
+		if err := resolveHostRelative(conn, c); err != nil {
+			return utils.WrapErr(err, "Error resolving resource limits from %s", path)
+		}
+		s, err := createSpecGen(*c)
+		if err != nil {
+			return utils.WrapErrClass(utils.ErrValidation, err, "Error generating spec of container %s from %s", c.Name, path)
+		}
+		joinPod(s, raw.Pod)
+		if err := checkSecrets(conn, s); err != nil {
+			return err
+		}
+		if err := checkDevices(conn, s.Name, s.Devices); err != nil {
+			return err
+		}
+		specs = append(specs, s)
+	}
+	if err := checkNetworks(conn, &specgen.SpecGenerator{ContainerNetworkConfig: specgen.ContainerNetworkConfig{Networks: p.Networks}}); err != nil {
+		return err
+	}
+
+	hash, err := podHash(p, specs)
+	if err != nil {
+		return utils.WrapErr(err, "Error hashing spec of pod %s", raw.Pod)
+	}
+	r.labelCommit(ctx, p.Labels)
+	p.Labels[specHashLabel] = hash
+	for i, s := range specs {
+		r.labelCommit(ctx, s.Labels)
+		dumpSpec(log, path, &raw.Containers[i], s)
+	}
+
+	matches, err := podMatches(conn, raw.Pod, hash, specs)
+	if forceRedeploy(ctx) {
+		matches, err = false, nil
+	}
+	if err != nil {
+		log.Infof("Unable to compare pod %s with its file, recreating it: %v", raw.Pod, err)
+	} else if matches {
+		if err := r.deletePrevious(conn, change, prev, raw); err != nil {
+			return err
+		}
+		log.Infof("Pod %s already matches %s, skipping redeploy", raw.Pod, path)
+		r.watchPodMounts(conn, raw)
+		return nil
+	}
+
+	if err := ensureRawVolumes(conn, raw); err != nil {
+		return err
+	}
+	if err := r.deletePrevious(conn, change, prev, nil); err != nil {
+		return err
+	}
+	if err := r.deletePodOf(conn, raw); err != nil {
+		return err
+	}
+	for _, s := range specs {
+		if err := removeExisting(conn, s.Name, s.StopTimeout); err != nil {
+			return err
+		}
+	}
+
+	err = withPodman(conn, podmanTimeout(), "create pod "+raw.Pod, func(ctx context.Context) error {
+		_, err := pods.CreatePodFromSpec(ctx, &entities.PodSpec{PodSpecGen: *p})
+		return err
+	})
+	audit(conn, auditPod, raw.Pod, "", "create", err)
+	if err != nil {
+		return utils.WrapErr(err, "Error creating pod %s", raw.Pod)
+	}
+	log.Infof("Pod %s created", raw.Pod)
+	for _, s := range specs {
+		if err := createAndStart(conn, s); err != nil {
+			return err
+		}
+		if r.WaitForHealthy {
+			if err := waitHealthy(conn, s.Name); err != nil {
+				return utils.WrapErr(err, "Container %s of pod %s from %s did not become healthy", s.Name, raw.Pod, path)
+			}
+			log.Infof("Container %s is healthy", s.Name)
+		}
+	}
+	r.watchPodMounts(conn, raw)
+	r.enableUnits(conn, raw)
+	r.pruneImages(conn)
+	return nil
+}
+
+// joinPod places a container in a pod, where it shares the pod's network namespace
+func joinPod(s *specgen.SpecGenerator, pod string) {
+	s.Pod = pod
+	s.NetNS = specgen.Namespace{}
+	s.Networks = nil
+	s.PortMappings = nil
+}
+
+func (r *Raw) watchPodMounts(conn context.Context, raw *RawPod) {
+	for _, c := range raw.Containers {
+		mountWatches.set(conn, c.Name, c.StopTimeout, c.Mounts)
+	}
+}
+
+// podMatches reports whether a running pod was created from the same specs and
+// each of its containers is running the current local image
+func podMatches(conn context.Context, name, hash string, specs []*specgen.SpecGenerator) (bool, error) {
+	exists, err := podExists(conn, name)
+	if err != nil || !exists {
+		return false, err
+	}
+	var pod *entities.PodInspectReport
+	err = withPodman(conn, podmanTimeout(), "inspect pod "+name, func(ctx context.Context) error {
+		var err error
+		pod, err = pods.Inspect(ctx, name, nil)
+		return err
+	})
+	if err != nil {
+		return false, utils.WrapErr(err, "Error inspecting pod %s", name)
+	}
+	if pod.Labels[specHashLabel] != hash || len(pod.Containers) != len(specs)+1 {
+		return false, nil
+	}
+	for _, s := range specs {
+		ctr, err := inspectContainer(conn, s.Name)
+		if err != nil {
+			return false, utils.WrapErr(err, "Error inspecting container %s", s.Name)
+		}
+		if ctr.State == nil || !ctr.State.Running || ctr.Pod != pod.ID {
+			return false, nil
+		}
+		img, err := inspectImage(conn, s.Image)
+		if err != nil {
+			return false, utils.WrapErr(err, "Error inspecting image %s", s.Image)
+		}
+		if img.ID != ctr.Image {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deletePodOf deletes the pod of a raw file, waiting for the longest stop timeout of its containers
+func (r *Raw) deletePodOf(conn context.Context, raw *RawPod) error {
+	var timeout *uint
+	for i := range raw.Containers {
+		if t := r.stopTimeout(&raw.Containers[i]); t != nil && (timeout == nil || *t > *timeout) {
+			timeout = t
+		}
+	}
+	r.disableUnits(conn, rawUnits(raw))
+	if err := deletePod(conn, raw.Pod, timeout); err != nil {
+		return err
+	}
+	for _, name := range raw.containerNames() {
+		mountWatches.set(conn, name, nil, nil)
+	}
+	return nil
+}
+
+// podExists reports whether a pod exists, bounded by podmanTimeout
+func podExists(conn context.Context, name string) (bool, error) {
+	var exists bool
+	err := withPodman(conn, podmanTimeout(), "check pod "+name, func(ctx context.Context) error {
+		var err error
+		exists, err = pods.Exists(ctx, name, nil)
+		return err
+	})
+	return exists, err
+}
+
+// deletePod stops and removes a pod with all of its containers, when it exists
+func deletePod(conn context.Context, name string, timeout *uint) error {
+	exists, err := podExists(conn, name)
+	if err != nil || !exists {
+		return err
+	}
+	opts := new(pods.StopOptions)
+	if timeout != nil {
+		opts = opts.WithTimeout(int(*timeout))
+	}
+	err = withPodman(conn, stopBound(timeout), "stop pod "+name, func(ctx context.Context) error {
+		_, err := pods.Stop(ctx, name, opts)
+		return err
+	})
+	audit(conn, auditPod, name, "", "stop", err)
+	if err != nil {
+		return utils.WrapErr(err, "Error stopping pod %s", name)
+	}
+	err = withPodman(conn, podmanTimeout(), "remove pod "+name, func(ctx context.Context) error {
+		_, err := pods.Remove(ctx, name, new(pods.RemoveOptions).WithForce(true))
+		return err
+	})
+	audit(conn, auditPod, name, "", "remove", err)
+	if err != nil {
+		return utils.WrapErr(err, "Error removing pod %s", name)
+	}
+	logger.Infof("Pod %s removed", name)
+	return nil
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/containers/podman/v4/pkg/bindings/pods"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+	"github.com/containers/podman/v4/pkg/domain/entities/reports"
+	"github.com/docker/go-units"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// ownedFilters selects the containers and pods deployed by a Raw method of a target
+func (r *Raw) ownedFilters() map[string][]string {
+	return map[string][]string{"label": {
+		fmt.Sprintf("%s=%s", targetLabel, r.GetTarget().displayName()),
+		fmt.Sprintf("%s=%s", methodLabel, r.GetName()),
+	}}
+}
+
+// pruneOrphans removes the containers and pods labeled as deployed by this
+// method whose file is no longer in the repository at desiredState, such as
+// those left behind when a file was removed while fetchit was not running.
+// Containers without this method's labels are never touched.
+func (r *Raw) pruneOrphans(ctx, conn context.Context, desiredState plumbing.Hash, tags *[]string) error {
+	log := r.GetTarget().logger()
+	conn = auditConn(ctx, conn, r, "")
+	all, err := applyChanges(ctx, &r.CommonMethod, plumbing.ZeroHash, desiredState, tags)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	// names with tokens, whose containers are matched by their label
+	templates := map[string]bool{}
+	podNames := map[string]bool{}
+	for change := range all {
+		_, to, err := change.Files()
+		if err != nil || to == nil {
+			continue
+		}
+		contents, err := to.Contents()
+		if err != nil {
+			return utils.WrapErr(err, "Error reading %s", change.To.Name)
+		}
+		// A file which cannot be parsed may still own a container, so nothing is pruned
+		raw, err := r.parseRawPod([]byte(contents), change.To.Name)
+		if err != nil {
+			return utils.WrapErr(err, "Error parsing %s, not pruning containers", change.To.Name)
+		}
+		if !raw.enabled() {
+			continue
+		}
+		for _, name := range raw.containerNames() {
+			names[name] = true
+		}
+		if hasNameTokens(raw.Name) {
+			templates[raw.Name] = true
+		}
+		if raw.isPod() {
+			podNames[raw.Pod] = true
+		}
+	}
+
+	var owned []entities.ListContainer
+	err = withPodman(conn, podmanTimeout(), "list containers", func(ctx context.Context) error {
+		var err error
+		owned, err = containers.List(ctx, new(containers.ListOptions).WithAll(true).WithFilters(r.ownedFilters()))
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error listing containers of %s", r.GetName())
+	}
+	timeout := r.stopTimeout(&RawPod{})
+	for _, c := range owned {
+		// Containers in a pod are pruned with their pod
+		if len(c.Names) == 0 || c.Pod != "" || names[c.Names[0]] || templates[c.Labels[nameTemplateLabel]] {
+			continue
+		}
+		name := c.Names[0]
+		if r.GetTarget().dryRun {
+			log.Infof("Dry run: would prune container %s, its file is no longer in %s", name, r.TargetPath)
+			continue
+		}
+		r.disableUnits(conn, []string{containerUnit(name)})
+		if err := deleteContainer(conn, name, timeout); err != nil {
+			return utils.WrapErr(err, "Error pruning container %s", name)
+		}
+		if fetchit != nil {
+			fetchit.state.setContainerHash(r.GetTarget(), name, "")
+		}
+		mountWatches.set(conn, name, nil, nil)
+		log.Infof("Pruned container %s, its file is no longer in %s", name, r.TargetPath)
+	}
+
+	var ownedPods []*entities.ListPodsReport
+	err = withPodman(conn, podmanTimeout(), "list pods", func(ctx context.Context) error {
+		var err error
+		ownedPods, err = pods.List(ctx, new(pods.ListOptions).WithFilters(r.ownedFilters()))
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error listing pods of %s", r.GetName())
+	}
+	for _, p := range ownedPods {
+		if podNames[p.Name] {
+			continue
+		}
+		if r.GetTarget().dryRun {
+			log.Infof("Dry run: would prune pod %s, its file is no longer in %s", p.Name, r.TargetPath)
+			continue
+		}
+		units := []string{podUnit(p.Name)}
+		for _, c := range p.Containers {
+			if c.Id != p.InfraId {
+				units = append(units, containerUnit(c.Names))
+			}
+		}
+		r.disableUnits(conn, units)
+		if err := deletePod(conn, p.Name, timeout); err != nil {
+			return utils.WrapErr(err, "Error pruning pod %s", p.Name)
+		}
+		for _, c := range p.Containers {
+			mountWatches.set(conn, c.Names, nil, nil)
+		}
+		log.Infof("Pruned pod %s, its file is no longer in %s", p.Name, r.TargetPath)
+	}
+	return nil
+}
+
+// pruneImages removes dangling images after a successful deploy, such as the
+// previous image of a tag which was pulled again. Podman never prunes an image
+// used by a container, and a failure is only logged as the deploy succeeded.
+func (r *Raw) pruneImages(conn context.Context) {
+	if !r.PruneImages {
+		return
+	}
+	log := r.GetTarget().logger()
+	var pruned []*reports.PruneReport
+	err := withPodman(conn, podmanTimeout(), "prune images", func(ctx context.Context) error {
+		var err error
+		pruned, err = images.Prune(ctx, new(images.PruneOptions).WithAll(false).WithExternal(false))
+		return err
+	})
+	if err != nil {
+		log.Errorf("Unable to prune dangling images: %v", err)
+		return
+	}
+	for _, err := range reports.PruneReportsErrs(pruned) {
+		log.Errorf("Unable to prune dangling image: %v", err)
+	}
+	if ids := reports.PruneReportsIds(pruned); len(ids) > 0 {
+		log.Infof("Pruned %d dangling images, reclaimed %s", len(ids), units.HumanSize(float64(reports.PruneReportsSize(pruned))))
+	}
+}
@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/generate"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+)
+
+// rawUnitDir is where generated units are written in the fetchit volume before
+// they are copied to the host
+const rawUnitDir = "/opt/.fetchit-systemd"
+
+// rawSystemd has the containers and pods of a Raw method started by systemd,
+// so they come back after a reboot and can be managed with systemctl
+type rawSystemd struct {
+	// Root installs the units in /etc/systemd/system for containers of rootful
+	// podman, otherwise in ~/.config/systemd/user for a rootless session
+	Root bool `mapstructure:"root"`
+}
+
+func containerUnit(name string) string {
+	return "container-" + name + ".service"
+}
+
+func podUnit(name string) string {
+	return "pod-" + name + ".service"
+}
+
+// rawUnits returns the units podman generates for a raw file, the unit which
+// is enabled comes first
+func rawUnits(raw *RawPod) []string {
+	if !raw.isPod() {
+		return []string{containerUnit(raw.Name)}
+	}
+	units := []string{podUnit(raw.Pod)}
+	for _, name := range raw.containerNames() {
+		units = append(units, containerUnit(name))
+	}
+	return units
+}
+
+// unitMethod returns the systemd method which enables and disables the units of r
+func (r *Raw) unitMethod() *Systemd {
+	return &Systemd{
+		Root: r.Systemd.Root,
+		CommonMethod: CommonMethod{
+			Name:   r.Name,
+			target: r.GetTarget(),
+		},
+	}
+}
+
+// installUnits generates the units of a container or pod which was just
+// created, as podman generate systemd does, copies them to the host and enables
+// them. The units start and stop the existing container rather than creating
+// a new one, so fetchit still owns the container and replaces the units each
+// time it recreates it.
+func (r *Raw) installUnits(conn context.Context, raw *RawPod) error {
+	if r.Systemd == nil {
+		return nil
+	}
+	log := r.GetTarget().logger()
+	name := raw.Name
+	if raw.isPod() {
+		name = raw.Pod
+	}
+	dest, err := systemdDest(r.Systemd.Root)
+	if err != nil {
+		return err
+	}
+	var report *entities.GenerateSystemdReport
+	err = withPodman(conn, podmanTimeout(), "generate units of "+name, func(ctx context.Context) error {
+		var err error
+		report, err = generate.Systemd(ctx, name, new(generate.SystemdOptions).WithUseName(true).WithNew(false))
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error generating systemd units of %s", name)
+	}
+
+	dir := filepath.Join(rawUnitDir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for unit, content := range report.Units {
+		if err := ioutil.WriteFile(filepath.Join(dir, unit+".service"), []byte(content), 0644); err != nil {
+			return utils.WrapErr(err, "Error writing systemd unit %s", unit)
+		}
+	}
+	s := generateSpec(rawMethod, "systemd-"+name, dir+"/ "+dest, dest, r.Name)
+	createResponse, err := createAndStartContainer(conn, s)
+	if err != nil {
+		return utils.WrapErr(err, "Error copying systemd units of %s to %s", name, dest)
+	}
+	if err := waitAndRemoveContainer(conn, createResponse.ID); err != nil {
+		return utils.WrapErr(err, "Error copying systemd units of %s to %s", name, dest)
+	}
+
+	unit := rawUnits(raw)[0]
+	if err := r.unitMethod().enableRestartSystemdService(conn, "enable", dest, unit); err != nil {
+		return utils.WrapErr(err, "Error enabling systemd unit %s", unit)
+	}
+	log.Infof("Systemd unit %s of %s enabled", unit, raw.describe())
+	return nil
+}
+
+// removeUnits disables and removes the units of containers and pods which are
+// about to be deleted, so systemd does not start them again
+func (r *Raw) removeUnits(conn context.Context, units []string) error {
+	if r.Systemd == nil {
+		return nil
+	}
+	dest, err := systemdDest(r.Systemd.Root)
+	if err != nil {
+		return err
+	}
+	sd := r.unitMethod()
+	for _, unit := range units {
+		if err := sd.enableRestartSystemdService(conn, "disable", dest, unit); err != nil {
+			return utils.WrapErr(err, "Error disabling systemd unit %s", unit)
+		}
+	}
+	return nil
+}
+
+// enableUnits installs the units of a deployed container or pod. The deploy
+// already succeeded, so a failure is logged and the container keeps running
+// without being started at boot.
+func (r *Raw) enableUnits(conn context.Context, raw *RawPod) {
+	if err := r.installUnits(conn, raw); err != nil {
+		r.GetTarget().logger().Errorf("Systemd units of %s not installed, it is running but will not be started at boot: %v", raw.describe(), err)
+	}
+}
+
+// disableUnits removes the units of a container or pod before it is deleted, a
+// failure is logged and the container is still deleted
+func (r *Raw) disableUnits(conn context.Context, units []string) {
+	if err := r.removeUnits(conn, units); err != nil {
+		r.GetTarget().logger().Errorf("Unable to remove systemd units %v: %v", units, err)
+	}
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"sync"
+	"text/template"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+// rawTemplateData is available to the template actions of raw files, e.g.
+// {{ .Vars.port }} or {{ .Hostname }}
+type rawTemplateData struct {
+	// Vars are the vars of the target
+	Vars map[string]string
+	// Hostname is the hostname of the host podman runs on
+	Hostname string
+	// Arch is the architecture of the host, as GOARCH e.g. amd64 or arm64
+	Arch string
+	// ShortSHA, Commit and Timestamp render as themselves, they are name
+	// tokens expanded when the container is created
+	ShortSHA, Commit, Timestamp string
+}
+
+var (
+	hostFactsOnce sync.Once
+	hostHostname  string
+)
+
+// hostname returns the hostname of the podman host, fetchit's own hostname is
+// that of its container so podman is asked
+func hostname() string {
+	hostFactsOnce.Do(func() {
+		if fetchit != nil && fetchit.conn != nil {
+			if info, err := podmanInfo(fetchit.conn); err == nil && info.Host != nil {
+				hostHostname = info.Host.Hostname
+				return
+			}
+		}
+		hostHostname, _ = os.Hostname()
+	})
+	return hostHostname
+}
+
+// renderRawTemplate executes a raw file as a text/template with the target's
+// vars and host facts. Files without template actions are returned unchanged,
+// and a reference to a var which is not set is an error unless lenient is set,
+// when it renders empty.
+func renderRawTemplate(b []byte, file string, vars map[string]string, lenient bool) ([]byte, error) {
+	if !bytes.Contains(b, []byte("{{")) {
+		return b, nil
+	}
+	missingkey := "missingkey=error"
+	if lenient {
+		missingkey = "missingkey=zero"
+	}
+	tmpl, err := template.New(file).Option(missingkey).Parse(string(b))
+	if err != nil {
+		return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to parse template")
+	}
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	data := rawTemplateData{
+		Vars:      vars,
+		Hostname:  hostname(),
+		Arch:      runtime.GOARCH,
+		ShortSHA:  shortSHAToken,
+		Commit:    commitToken,
+		Timestamp: timestampToken,
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to render template")
+	}
+	return out.Bytes(), nil
+}
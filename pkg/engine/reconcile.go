@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// ReconcileHook configures a command executed, and a URL notified, after each
+// reconcile which applied changes or failed. The ReconcileResult is passed to the
+// command as JSON on stdin and POSTed to the URL. A failing command or
+// notification is logged but does not fail the reconcile.
+type ReconcileHook struct {
+	// Command and arguments to execute within the fetchit container
+	Command []string `mapstructure:"command"`
+	// URL the result is POSTed to as JSON, e.g. a webhook receiver or a Slack incoming webhook
+	URL string `mapstructure:"url"`
+	// Slack posts a Slack message summarising the result to URL in place of the JSON
+	Slack bool `mapstructure:"slack"`
+	// Timeout for the command and the POST, e.g. 30s (default)
+	Timeout string `mapstructure:"timeout"`
+	// Digest is a window, e.g. 1h, over which results are aggregated into a
+	// single ReconcileDigest passed to the command instead of each result
+	Digest string `mapstructure:"digest"`
+}
+
+// ReconcileResult is the structured outcome of applying a commit for a method
+type ReconcileResult struct {
+	Target  string            `json:"target"`
+	Method  string            `json:"method"`
+	Name    string            `json:"name"`
+	From    string            `json:"from,omitempty"`
+	Commit  string            `json:"commit"`
+	Author  string            `json:"author,omitempty"`
+	Subject string            `json:"subject,omitempty"`
+	Time    time.Time         `json:"time"`
+	Actions []ReconcileAction `json:"actions"`
+	Error   string            `json:"error,omitempty"`
+	// ErrorClass is the class of Error, e.g. auth, transient, not found, validation or podman
+	ErrorClass string `json:"errorClass,omitempty"`
+
+	mu sync.Mutex
+}
+
+// ReconcileAction is the outcome for a single changed file
+type ReconcileAction struct {
+	File   string `json:"file"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+type reconcileResultKey struct{}
+
+// newReconcileResult starts a result for applying desired over current, the
+// returned context carries the result so file level actions can be recorded
+func newReconcileResult(ctx context.Context, m Method, target *Target, current, desired plumbing.Hash) (context.Context, *ReconcileResult) {
+	result := &ReconcileResult{
+		Target:  target.displayName(),
+		Method:  m.GetKind(),
+		Name:    m.GetName(),
+		Commit:  desired.String(),
+		Actions: []ReconcileAction{},
+	}
+	if !current.IsZero() {
+		result.From = current.String()
+	}
+	result.Author, result.Subject = commitInfo(target, desired)
+	return context.WithValue(ctx, reconcileResultKey{}, result), result
+}
+
+func reconcileResultFrom(ctx context.Context) *ReconcileResult {
+	result, _ := ctx.Value(reconcileResultKey{}).(*ReconcileResult)
+	return result
+}
+
+// recordAction adds the outcome of a changed file to the result carried by ctx
+func recordAction(ctx context.Context, change *object.Change, err error) {
+	result := reconcileResultFrom(ctx)
+	if result == nil || change == nil {
+		return
+	}
+	action := ReconcileAction{
+		File:   changeFile(change),
+		Action: changeAction(change),
+	}
+	if err != nil {
+		action.Error = err.Error()
+	}
+	result.mu.Lock()
+	defer result.mu.Unlock()
+	result.Actions = append(result.Actions, action)
+}
+
+// finish records the overall error and hands the result to the configured hook
+func (r *ReconcileResult) finish(err error) {
+	r.mu.Lock()
+	r.Time = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+		r.ErrorClass = utils.ClassName(err)
+	}
+	r.mu.Unlock()
+
+	if fetchit != nil && fetchit.reconcileHook != nil {
+		if _, ok := fetchit.reconcileHook.digestWindow(); ok {
+			digests.add(r)
+			return
+		}
+		go fetchit.reconcileHook.run(r)
+	}
+}
+
+// digestWindow returns the digest window of the hook, ok is false when the
+// hook is not in digest mode
+func (h *ReconcileHook) digestWindow() (time.Duration, bool) {
+	if h.Digest == "" {
+		return 0, false
+	}
+	window, err := time.ParseDuration(h.Digest)
+	if err != nil || window <= 0 {
+		return 0, false
+	}
+	return window, true
+}
+
+func (h *ReconcileHook) run(result *ReconcileResult) {
+	if len(h.Command) == 0 && h.URL == "" {
+		return
+	}
+	result.mu.Lock()
+	payload, err := json.Marshal(result)
+	text := result.summary()
+	result.mu.Unlock()
+	if err != nil {
+		logger.Errorf("Error marshalling reconcile result for hook: %v", err)
+		return
+	}
+	h.send(payload, text, fmt.Sprintf("%s %s", result.Method, result.Name))
+}
+
+// send executes the hook command with payload on stdin and POSTs payload to the
+// hook's URL, or text as a Slack message. desc names the payload in logs.
+func (h *ReconcileHook) send(payload []byte, text, desc string) {
+	if len(h.Command) == 0 && h.URL == "" {
+		return
+	}
+	var err error
+	timeout := defaultHookTimeout
+	if h.Timeout != "" {
+		if timeout, err = time.ParseDuration(h.Timeout); err != nil {
+			logger.Errorf("Invalid reconcile hook timeout %s: %v", h.Timeout, err)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if h.URL != "" {
+		h.post(ctx, payload, text, desc)
+	}
+	if len(h.Command) == 0 {
+		return
+	}
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Errorf("Reconcile hook %s for %s failed: %v: %s", h.Command[0], desc, err, out)
+		return
+	}
+	logger.Debugf("Reconcile hook %s for %s completed: %s", h.Command[0], desc, out)
+}
+
+// post POSTs payload to the hook's URL, or text as a Slack message
+func (h *ReconcileHook) post(ctx context.Context, payload []byte, text, desc string) {
+	if h.Slack {
+		var err error
+		if payload, err = json.Marshal(map[string]string{"text": text}); err != nil {
+			logger.Errorf("Error marshalling Slack message for %s: %v", desc, err)
+			return
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		logger.Errorf("Invalid reconcile hook url: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Errorf("Reconcile hook notification for %s failed: %v", desc, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Errorf("Reconcile hook notification for %s failed: %s", desc, resp.Status)
+		return
+	}
+	logger.Debugf("Reconcile hook notification for %s delivered", desc)
+}
+
+// summaryMaxActions caps the files listed in the summary of a result
+const summaryMaxActions = 20
+
+// summary describes a result in a few lines of text, for chat notifications
+func (r *ReconcileResult) summary() string {
+	var b strings.Builder
+	if r.Error != "" {
+		fmt.Fprintf(&b, "%s %s of %s failed to apply %s: %s", r.Method, r.Name, r.Target, r.describe(), r.Error)
+	} else {
+		fmt.Fprintf(&b, "%s %s of %s applied %s", r.Method, r.Name, r.Target, r.describe())
+	}
+	for i, a := range r.Actions {
+		if i == summaryMaxActions {
+			fmt.Fprintf(&b, "\n... and %d more files", len(r.Actions)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n%s %s", a.Action, a.File)
+		if a.Error != "" {
+			fmt.Fprintf(&b, " failed: %s", a.Error)
+		}
+	}
+	return b.String()
+}
+
+// commitInfo returns the author and subject line of a commit, both are empty
+// when the commit cannot be read
+func commitInfo(target *Target, hash plumbing.Hash) (string, string) {
+	repo, err := git.PlainOpen(getDirectory(target))
+	if err != nil {
+		return "", ""
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return "", ""
+	}
+	subject := strings.TrimSpace(strings.SplitN(commit.Message, "\n", 2)[0])
+	return fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email), subject
+}
+
+// describe summarises the commit of the result for deploy logs
+func (r *ReconcileResult) describe() string {
+	if r.Author == "" {
+		return r.Commit[:hashReportLen]
+	}
+	return fmt.Sprintf("%s (%s: %q)", r.Commit[:hashReportLen], r.Author, r.Subject)
+}
+
+// changeFile returns the file of a change, its previous name when it was deleted
+func changeFile(change *object.Change) string {
+	if change.To.Name == "" {
+		return change.From.Name
+	}
+	return change.To.Name
+}
+
+// changeAction describes the kind of change made to a file
+func changeAction(change *object.Change) string {
+	switch {
+	case change.From.Name == "" && change.To.Name != "":
+		return "create"
+	case change.From.Name != "" && change.To.Name == "":
+		return "delete"
+	case change.From.Name != change.To.Name:
+		return "rename"
+	default:
+		return "update"
+	}
+}
@@ -0,0 +1,368 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containers/common/libnetwork/types"
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	// retiredSuffix is appended to the name of a container being replaced
+	// until its replacement is verified
+	retiredSuffix = "-fetchit-old"
+	// greenSuffix is appended to the name of a blue-green container until the
+	// container it replaces is removed
+	greenSuffix = "-fetchit-new"
+	// safeRecreateSettle is how long a container without a healthcheck must keep running
+	safeRecreateSettle = 5 * time.Second
+	// defaultHealthInterval is podman's interval between healthchecks when a
+	// healthcheck does not set one
+	defaultHealthInterval = 30 * time.Second
+)
+
+type retiredContainer struct {
+	name    string
+	timeout *uint
+}
+
+// safeRecreate replaces the containers named by prev and s with a container
+// created from s, only removing the old containers once the new one is verified.
+// The old containers are stopped and renamed aside first so that host ports are
+// free for the new container. If the new container fails to start or become
+// healthy or ready, or its PostDeploy command fails, it is removed and the old
+// containers are restored and restarted.
+func (r *Raw) safeRecreate(ctx, conn context.Context, s *specgen.SpecGenerator, hash string, prev, deployed *RawPod) error {
+	candidates := []retiredContainer{{name: s.Name, timeout: s.StopTimeout}}
+	if prev != nil && prev.Name != s.Name {
+		candidates = append(candidates, retiredContainer{name: prev.Name, timeout: r.stopTimeout(prev)})
+	}
+
+	var retired []retiredContainer
+	for _, c := range candidates {
+		exists, err := containerExists(conn, c.name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		// Remove anything left aside by an earlier interrupted recreate
+		if leftover, _ := containerExists(conn, c.name+retiredSuffix); leftover {
+			if err := deleteContainer(conn, c.name+retiredSuffix, c.timeout); err != nil {
+				return utils.WrapErr(err, "Error removing leftover container %s", c.name+retiredSuffix)
+			}
+		}
+		if err := stopContainer(conn, c.name, c.timeout); err != nil {
+			return utils.WrapErr(err, "Error stopping container %s", c.name)
+		}
+		if err := renameContainer(conn, c.name, c.name+retiredSuffix); err != nil {
+			startContainer(conn, c.name)
+			return utils.WrapErr(err, "Error renaming container %s aside", c.name)
+		}
+		retired = append(retired, c)
+	}
+
+	err := createAndStart(conn, s)
+	if err == nil {
+		err = waitHealthy(conn, s.Name)
+	}
+	if err == nil {
+		err = waitReady(conn, r.GetTarget().logger(), s.Name, deployed)
+	}
+	if err == nil {
+		err = runPostDeploy(conn, r.GetTarget().logger(), s.Name, deployed.PostDeploy)
+	}
+	if err == nil {
+		err = r.watchCrashLoop(ctx, conn, s.Name)
+	}
+	if err != nil {
+		logger.Infof("Container %s failed verification, restoring the previous container", s.Name)
+		if exists, _ := containerExists(conn, s.Name); exists {
+			if rmErr := deleteContainer(conn, s.Name, s.StopTimeout); rmErr != nil {
+				logger.Errorf("Error removing failed container %s: %v", s.Name, rmErr)
+			}
+		}
+		for _, c := range retired {
+			if rErr := renameContainer(conn, c.name+retiredSuffix, c.name); rErr != nil {
+				logger.Errorf("Error restoring container %s: %v", c.name, rErr)
+				continue
+			}
+			if sErr := startContainer(conn, c.name); sErr != nil {
+				logger.Errorf("Error restarting container %s: %v", c.name, sErr)
+			}
+		}
+		return utils.WrapErr(err, "Error replacing container %s, the previous container was kept", s.Name)
+	}
+
+	for _, c := range retired {
+		if err := deleteContainer(conn, c.name+retiredSuffix, c.timeout); err != nil {
+			logger.Errorf("Error removing replaced container %s: %v", c.name+retiredSuffix, err)
+		}
+		if c.name != s.Name {
+			r.disableUnits(conn, []string{containerUnit(c.name)})
+			if fetchit != nil {
+				fetchit.state.setContainerHash(r.GetTarget(), c.name, "")
+			}
+		}
+	}
+	if fetchit != nil {
+		fetchit.state.setContainerHash(r.GetTarget(), s.Name, hash)
+	}
+	logger.Infof("Container %s verified and replaced its previous container", s.Name)
+	return nil
+}
+
+// blueGreenBlocker returns why a container cannot run next to its previous
+// container, such as a host port both would bind, or "" when it can
+func blueGreenBlocker(raw *RawPod, s *specgen.SpecGenerator) string {
+	if len(hostBindings(raw.Ports)) > 0 {
+		return "it publishes host ports"
+	}
+	if s.NetNS.NSMode == specgen.Host {
+		return "it uses the host network"
+	}
+	for name, opts := range s.Networks {
+		if len(opts.StaticIPs) > 0 || len(opts.StaticMAC) > 0 {
+			return "it has a static address on network " + name
+		}
+	}
+	return ""
+}
+
+// blueGreen replaces the containers named by prev and s without stopping them
+// first. The new container is created from s under a temporary name, with the
+// name of s as a network alias on each of its networks, and the old containers
+// are only removed once it is verified, after which it is renamed into place.
+// If the new container fails to start or become healthy or ready, or its
+// PostDeploy command fails, it is removed and the old containers are left running.
+func (r *Raw) blueGreen(ctx, conn context.Context, s *specgen.SpecGenerator, hash string, prev, deployed *RawPod) error {
+	log := r.GetTarget().logger()
+	green := *s
+	green.Name = s.Name + greenSuffix
+	green.Networks = make(map[string]types.PerNetworkOptions, len(s.Networks))
+	for name, opts := range s.Networks {
+		opts.Aliases = append(append([]string{}, opts.Aliases...), s.Name)
+		green.Networks[name] = opts
+	}
+
+	// Remove anything left by an earlier interrupted deploy
+	if leftover, _ := containerExists(conn, green.Name); leftover {
+		if err := deleteContainer(conn, green.Name, s.StopTimeout); err != nil {
+			return utils.WrapErr(err, "Error removing leftover container %s", green.Name)
+		}
+	}
+
+	err := createAndStart(conn, &green)
+	if err == nil {
+		err = waitHealthy(conn, green.Name)
+	}
+	if err == nil {
+		err = waitReady(conn, log, green.Name, deployed)
+	}
+	if err == nil {
+		err = runPostDeploy(conn, log, green.Name, deployed.PostDeploy)
+	}
+	if err == nil {
+		err = r.watchCrashLoop(ctx, conn, green.Name)
+	}
+	if err != nil {
+		log.Infof("Container %s failed verification, keeping the previous container", green.Name)
+		if exists, _ := containerExists(conn, green.Name); exists {
+			if rmErr := deleteContainer(conn, green.Name, s.StopTimeout); rmErr != nil {
+				log.Errorf("Error removing failed container %s: %v", green.Name, rmErr)
+			}
+		}
+		return utils.WrapErr(err, "Error replacing container %s, the previous container was kept", s.Name)
+	}
+
+	old := []retiredContainer{{name: s.Name, timeout: s.StopTimeout}}
+	if prev != nil && prev.Name != s.Name {
+		old = append(old, retiredContainer{name: prev.Name, timeout: r.stopTimeout(prev)})
+	}
+	for _, c := range old {
+		exists, err := containerExists(conn, c.name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if c.name != s.Name {
+			r.disableUnits(conn, []string{containerUnit(c.name)})
+		}
+		if err := deleteContainer(conn, c.name, c.timeout); err != nil {
+			return utils.WrapErr(err, "Error removing container %s replaced by %s", c.name, green.Name)
+		}
+		if fetchit != nil && c.name != s.Name {
+			fetchit.state.setContainerHash(r.GetTarget(), c.name, "")
+		}
+	}
+	if err := renameContainer(conn, green.Name, s.Name); err != nil {
+		return utils.WrapErr(err, "Error renaming container %s to %s, it is running under its temporary name", green.Name, s.Name)
+	}
+	if fetchit != nil {
+		fetchit.state.setContainerHash(r.GetTarget(), s.Name, hash)
+	}
+	log.Infof("Container %s verified next to its previous container and replaced it", s.Name)
+	return nil
+}
+
+// renameContainer renames a container, recording it in the audit log under
+// the name it is given
+func renameContainer(conn context.Context, from, to string) error {
+	err := withPodman(conn, podmanTimeout(), "rename container "+from, func(ctx context.Context) error {
+		return containers.Rename(ctx, from, new(containers.RenameOptions).WithName(to))
+	})
+	audit(conn, auditContainer, to, "", "rename", err)
+	return err
+}
+
+// waitHealthy waits for a container to pass its healthcheck, or when it has
+// no healthcheck, to keep running for safeRecreateSettle. The healthcheck is
+// run at its interval, and the container fails only once podman reports it
+// unhealthy, after Retries consecutive failures outside of its start period,
+// or when it is not healthy within healthDeadline.
+func waitHealthy(conn context.Context, name string) error {
+	ctr, err := inspectContainer(conn, name)
+	if err != nil {
+		return err
+	}
+	if ctr.Config == nil || ctr.Config.Healthcheck == nil {
+		time.Sleep(safeRecreateSettle)
+		ctr, err = inspectContainer(conn, name)
+		if err != nil {
+			return err
+		}
+		if ctr.State == nil || !ctr.State.Running {
+			return fmt.Errorf("container %s exited after starting", name)
+		}
+		return nil
+	}
+
+	interval := ctr.Config.Healthcheck.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := healthDeadline(ctr.Config.Healthcheck)
+	deadline := time.Now().Add(timeout)
+	for {
+		var result *define.HealthCheckResults
+		err := withPodman(conn, podmanTimeout(), "run healthcheck of container "+name, func(ctx context.Context) error {
+			var err error
+			result, err = containers.RunHealthCheck(ctx, name, nil)
+			return err
+		})
+		if err != nil {
+			return utils.WrapErr(err, "Error running healthcheck of container %s", name)
+		}
+		if result.Status == define.HealthCheckHealthy {
+			return nil
+		}
+		// A failed check is reported as unhealthy, the state of the container
+		// only becomes unhealthy once podman counted Retries failures
+		ctr, err := inspectContainer(conn, name)
+		if err != nil {
+			return err
+		}
+		if ctr.State != nil && ctr.State.Health.Status == define.HealthCheckUnhealthy {
+			return fmt.Errorf("container %s is unhealthy after %d failed healthchecks", name, ctr.State.Health.FailingStreak)
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return fmt.Errorf("container %s did not become healthy within %s", name, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// healthDeadline is how long a container has to become healthy, its start
+// period followed by Retries checks at its interval, each taking up to its
+// timeout
+func healthDeadline(h *manifest.Schema2HealthConfig) time.Duration {
+	interval := h.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	retries := h.Retries
+	if retries < 1 {
+		retries = 1
+	}
+	return h.StartPeriod + time.Duration(retries)*(interval+h.Timeout)
+}
+
+// rollbackSpec generates the spec of the container deployed from the previous
+// version of a file, so it can be recreated if its replacement fails to start.
+// It returns nil when there is no previous container to roll back to.
+func (r *Raw) rollbackSpec(conn context.Context, change *object.Change, prev *string) (*specgen.SpecGenerator, *RawPod, string) {
+	if prev == nil {
+		return nil, nil, ""
+	}
+	log := r.GetTarget().logger()
+	raw, err := r.parsePrevRawPod([]byte(*prev), change.From.Name)
+	if err != nil || !raw.enabled() || raw.isPod() {
+		return nil, nil, ""
+	}
+	if exists, err := containerExists(conn, raw.Name); err != nil || !exists {
+		return nil, nil, ""
+	}
+	raw.StopTimeout = r.stopTimeout(raw)
+	if err := resolveHostRelative(conn, raw); err != nil {
+		log.Infof("Unable to prepare rollback of container %s: %v", raw.Name, err)
+		return nil, nil, ""
+	}
+	if err := r.loadEnvFiles(raw); err != nil {
+		log.Infof("Unable to prepare rollback of container %s: %v", raw.Name, err)
+		return nil, nil, ""
+	}
+	s, err := createSpecGen(*raw)
+	if err != nil {
+		log.Infof("Unable to prepare rollback of container %s: %v", raw.Name, err)
+		return nil, nil, ""
+	}
+	hash, err := specHash(s)
+	if err != nil {
+		log.Infof("Unable to prepare rollback of container %s: %v", raw.Name, err)
+		return nil, nil, ""
+	}
+	s.Labels[targetLabel] = r.GetTarget().displayName()
+	s.Labels[methodLabel] = r.GetName()
+	s.Labels[specHashLabel] = hash
+	return s, raw, hash
+}
+
+// rollback removes a container which failed to start and recreates the
+// container of the previous version of its file from rollbackSpec
+func (r *Raw) rollback(conn context.Context, failed, s *specgen.SpecGenerator, raw *RawPod, hash string) {
+	log := r.GetTarget().logger()
+	for _, name := range []string{failed.Name, s.Name} {
+		if exists, _ := containerExists(conn, name); exists {
+			if err := deleteContainer(conn, name, failed.StopTimeout); err != nil {
+				log.Errorf("Error removing container %s before rollback: %v", name, err)
+			}
+		}
+	}
+	if err := createAndStart(conn, s); err != nil {
+		log.Errorf("Error rolling back container %s to its previous spec: %v", s.Name, err)
+		return
+	}
+	if failed.Name != s.Name {
+		r.disableUnits(conn, []string{containerUnit(failed.Name)})
+	}
+	// the units of the previous container were removed when it was deleted
+	r.enableUnits(conn, raw)
+	if fetchit != nil {
+		if failed.Name != s.Name {
+			fetchit.state.setContainerHash(r.GetTarget(), failed.Name, "")
+		}
+		fetchit.state.setContainerHash(r.GetTarget(), s.Name, hash)
+	}
+	mountWatches.set(conn, s.Name, s.StopTimeout, raw.Mounts)
+	log.Warnf("Container %s failed, rolled back to container %s from the previous version of its file", failed.Name, s.Name)
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+type forceRedeployKey struct{}
+
+// forceRedeploy reports whether containers are recreated even when they already
+// match their file
+func forceRedeploy(ctx context.Context) bool {
+	force, _ := ctx.Value(forceRedeployKey{}).(bool)
+	return force
+}
+
+// redeploy recreates the containers and pods of the method's files at the
+// commit currently applied, or only those of file when it is set, even though
+// they match their files. The caller must not be a run of the method.
+func (r *Raw) redeploy(ctx, conn context.Context, file string) (int, error) {
+	target := r.GetTarget()
+	defer target.lockRun(r)()
+	ctx, release := holdCheckout(ctx, target)
+	defer release()
+
+	current, err := getCurrent(target, rawMethod, r.GetName())
+	if err != nil {
+		return 0, utils.WrapErr(err, "Failed to get current commit")
+	}
+	if current == plumbing.ZeroHash {
+		return 0, nil
+	}
+	all, err := applyChanges(ctx, &r.CommonMethod, plumbing.ZeroHash, current, r.fileTags(rawTags))
+	if err != nil {
+		return 0, err
+	}
+	changeMap := map[*object.Change]string{}
+	for change, path := range all {
+		if path != deleteFile && (file == "" || change.To.Name == file) {
+			changeMap[change] = path
+		}
+	}
+	if len(changeMap) == 0 {
+		return 0, nil
+	}
+
+	target.logger().Infof("Redeploying %d files of %s %s at %s", len(changeMap), r.GetKind(), r.GetName(), current.String()[:hashReportLen])
+	ctx, result := newReconcileResult(context.WithValue(ctx, forceRedeployKey{}, true), r, target, current, current)
+	err = runChanges(ctx, conn, r, changeMap)
+	result.finish(err)
+	return len(changeMap), err
+}
+
+// redeployHandler recreates the containers of the target named by the target
+// query parameter from the commit currently applied, or only the container of
+// the repository file named by the file query parameter. The request waits for
+// the target's running reconcile, if any, and for the redeploy to finish.
+func redeployHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, target := controlTarget(w, r)
+		if target == nil {
+			return
+		}
+		file := r.URL.Query().Get("file")
+		conn, err := target.podmanConn(f.conn)
+		if err == nil {
+			conn, err = healthyConn(conn)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("podman is unavailable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		redeployed := 0
+		for _, m := range currentConfig().methods[target] {
+			raw, ok := m.(*Raw)
+			if !ok {
+				continue
+			}
+			// The redeploy finishes even if the client disconnects
+			n, err := raw.redeploy(context.Background(), conn, file)
+			redeployed += n
+			if err != nil {
+				target.logger().Errorf("Error redeploying %s %s: %v", raw.GetKind(), raw.GetName(), err)
+				http.Error(w, fmt.Sprintf("redeploying %s failed: %v", raw.GetName(), err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if redeployed == 0 {
+			http.Error(w, "nothing is deployed from the target or file", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "redeployed %d files of target %s\n", redeployed, target.displayName())
+	}
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/containers/podman/v4/pkg/bindings/play"
+)
+
+// pullOptions returns the options to pull images of the method with its
+// registry credentials. Without credentials podman's default auth file is used.
+// TLS verification is skipped only when the target sets insecureSkipTLS.
+func (m *CommonMethod) pullOptions() *images.PullOptions {
+	opts := new(images.PullOptions)
+	if m.AuthFile != "" {
+		opts = opts.WithAuthfile(m.AuthFile)
+	}
+	if m.RegistryUsername != "" {
+		opts = opts.WithUsername(m.RegistryUsername).WithPassword(m.RegistryPassword)
+	}
+	if m.target != nil && m.target.insecureSkipTLS {
+		opts = opts.WithSkipTLSVerify(true)
+	}
+	return opts
+}
+
+// kubeOptions returns the options to play kube files with the method's registry credentials
+func (m *CommonMethod) kubeOptions() *play.KubeOptions {
+	opts := new(play.KubeOptions)
+	if m.AuthFile != "" {
+		opts = opts.WithAuthfile(m.AuthFile)
+	}
+	if m.RegistryUsername != "" {
+		opts = opts.WithUsername(m.RegistryUsername).WithPassword(m.RegistryPassword)
+	}
+	if m.target != nil && m.target.insecureSkipTLS {
+		opts = opts.WithSkipTLSVerify(true)
+	}
+	return opts
+}
+
+// pullKey identifies a pull of image which concurrent callers may share, only
+// pulls for the same platform with the same policy and credentials are shared
+// so no caller pulls with another method's credentials or gets its auth error
+func pullKey(image, policy string, opts *images.PullOptions) string {
+	key := policy + ":" + image
+	if p, ok := pullPlatform(opts); ok {
+		key += " " + p.String()
+	}
+	if opts != nil {
+		key += fmt.Sprintf(" authfile=%s user=%s skiptls=%t", opts.GetAuthfile(), opts.GetUsername(), opts.GetSkipTLSVerify())
+	}
+	return key
+}
+
+// logRegistryAuth logs which credentials are used to pull image, never the secret itself
+func logRegistryAuth(image string, opts *images.PullOptions) {
+	if opts == nil || (opts.GetAuthfile() == "" && opts.GetUsername() == "") {
+		return
+	}
+	registry := "unknown registry"
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		registry = reference.Domain(named)
+	}
+	if opts.GetUsername() != "" {
+		logger.Infof("Pulling %s from %s as user %s", image, registry, opts.GetUsername())
+		return
+	}
+	logger.Infof("Pulling %s from %s with credentials from %s", image, registry, opts.GetAuthfile())
+}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// cpuPeriod is the CFS period used to express CPU limits, matching podman's --cpus
+const cpuPeriod = 100000
+
+// resourceValue is either an absolute resource amount or a percentage of the
+// host's resources, e.g. "512m" or "25%" for memory and 1.5 or "50%" for CPUs
+type resourceValue string
+
+func (v *resourceValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = resourceValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("resource value must be a string or a number, got %s", b)
+	}
+	*v = resourceValue(n.String())
+	return nil
+}
+
+// percent returns the percentage held by v and whether v is a percentage
+func (v resourceValue) percent() (float64, bool, error) {
+	s := strings.TrimSpace(string(v))
+	if !strings.HasSuffix(s, "%") {
+		return 0, false, nil
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, true, fmt.Errorf("invalid percentage %q, must be greater than 0%% and at most 100%%", s)
+	}
+	return p, true, nil
+}
+
+// resolveHostRelative replaces percentage based resource values in raw with
+// absolute values calculated from the resources of the podman host
+func resolveHostRelative(conn context.Context, raw *RawPod) error {
+	memPercent, memRelative, err := raw.Memory.percent()
+	if err != nil {
+		return utils.WrapErr(err, "Invalid Memory value")
+	}
+	cpuPercent, cpuRelative, err := raw.CPUs.percent()
+	if err != nil {
+		return utils.WrapErr(err, "Invalid CPUs value")
+	}
+	if !memRelative && !cpuRelative {
+		return nil
+	}
+
+	info, err := podmanInfo(conn)
+	if err != nil {
+		return utils.WrapErr(err, "Error getting host resources from podman")
+	}
+	if memRelative {
+		mem := int64(float64(info.Host.MemTotal) * memPercent / 100)
+		logger.Infof("Container %s Memory %s of host memory resolved to %s", raw.Name, raw.Memory, units.BytesSize(float64(mem)))
+		raw.Memory = resourceValue(strconv.FormatInt(mem, 10))
+	}
+	if cpuRelative {
+		cpus := strconv.FormatFloat(float64(info.Host.CPUs)*cpuPercent/100, 'f', 2, 64)
+		logger.Infof("Container %s CPUs %s of %d host CPUs resolved to %s", raw.Name, raw.CPUs, info.Host.CPUs, cpus)
+		raw.CPUs = resourceValue(cpus)
+	}
+	return nil
+}
+
+// resourceLimits converts the absolute resource values of raw into the linux
+// resources of the spec, returning nil when no limits are set
+func resourceLimits(raw RawPod) (*specs.LinuxResources, error) {
+	if raw.Memory == "" && raw.MemorySwap == "" && raw.CPUs == "" && raw.CPUShares == nil && raw.PidsLimit == nil {
+		return nil, nil
+	}
+	limits := &specs.LinuxResources{}
+	if raw.Memory != "" {
+		mem, err := units.RAMInBytes(string(raw.Memory))
+		if err != nil {
+			return nil, utils.WrapErr(err, "Invalid Memory value %s", raw.Memory)
+		}
+		limits.Memory = &specs.LinuxMemory{Limit: &mem}
+	}
+	if raw.MemorySwap != "" {
+		if limits.Memory == nil {
+			return nil, fmt.Errorf("MemorySwap requires Memory to be set")
+		}
+		// As with podman's --memory-swap, -1 allows unlimited swap
+		swap := int64(-1)
+		if raw.MemorySwap != "-1" {
+			var err error
+			if swap, err = units.RAMInBytes(string(raw.MemorySwap)); err != nil {
+				return nil, utils.WrapErr(err, "Invalid MemorySwap value %s", raw.MemorySwap)
+			}
+			if swap < *limits.Memory.Limit {
+				return nil, fmt.Errorf("MemorySwap %s must be at least Memory %s, it limits memory plus swap", raw.MemorySwap, raw.Memory)
+			}
+		}
+		limits.Memory.Swap = &swap
+	}
+	if raw.CPUs != "" {
+		cpus, err := strconv.ParseFloat(string(raw.CPUs), 64)
+		if err != nil || cpus <= 0 {
+			return nil, fmt.Errorf("invalid CPUs value %s, must be a positive number or a percentage", raw.CPUs)
+		}
+		period := uint64(cpuPeriod)
+		quota := int64(cpus * cpuPeriod)
+		limits.CPU = &specs.LinuxCPU{Period: &period, Quota: &quota}
+	}
+	if raw.CPUShares != nil {
+		if *raw.CPUShares < 2 || *raw.CPUShares > 262144 {
+			return nil, fmt.Errorf("invalid CPUShares value %d, must be between 2 and 262144", *raw.CPUShares)
+		}
+		if limits.CPU == nil {
+			limits.CPU = &specs.LinuxCPU{}
+		}
+		limits.CPU.Shares = raw.CPUShares
+	}
+	if raw.PidsLimit != nil {
+		if *raw.PidsLimit < -1 {
+			return nil, fmt.Errorf("invalid PidsLimit value %d, must be -1 for unlimited or a number of processes", *raw.PidsLimit)
+		}
+		limits.Pids = &specs.LinuxPids{Limit: *raw.PidsLimit}
+	}
+	return limits, nil
+}
+
+// convertShmSize parses the size of /dev/shm like a Memory limit, returning
+// nil when it is not set so podman's default is kept
+func convertShmSize(size string) (*int64, error) {
+	if size == "" {
+		return nil, nil
+	}
+	shm, err := units.RAMInBytes(size)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Invalid ShmSize value %s", size)
+	}
+	if shm <= 0 {
+		return nil, fmt.Errorf("invalid ShmSize value %s, must be positive", size)
+	}
+	return &shm, nil
+}
+
+// convertUlimits parses ulimits in the name=soft[:hard] format of podman's
+// --ulimit, e.g. nofile=65536:65536. A limit of -1 is unlimited
+func convertUlimits(ulimits []string) ([]specs.POSIXRlimit, error) {
+	var result []specs.POSIXRlimit
+	for _, u := range ulimits {
+		ulimit, err := units.ParseUlimit(u)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Invalid ulimit %s", u)
+		}
+		result = append(result, specs.POSIXRlimit{
+			Type: "RLIMIT_" + strings.ToUpper(ulimit.Name),
+			Soft: rlimitValue(ulimit.Soft),
+			Hard: rlimitValue(ulimit.Hard),
+		})
+	}
+	return result, nil
+}
+
+func rlimitValue(v int64) uint64 {
+	if v < 0 {
+		return math.MaxUint64
+	}
+	return uint64(v)
+}
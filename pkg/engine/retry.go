@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+const (
+	// defaultRetryAttempts is how many times each step of a poll is attempted
+	defaultRetryAttempts = 3
+	// defaultRetryDelay is the delay before the first retry, doubling for each retry after
+	defaultRetryDelay = 5 * time.Second
+)
+
+// retry runs fn, retrying it with a doubling delay while it fails with an error
+// which may be transient, up to the target's retryAttempts. The retries are part
+// of the method's run, so the next poll of the method waits for them.
+func (t *Target) retry(ctx context.Context, desc string, fn func() error) error {
+	attempts, delay := t.retryAttempts, t.retryDelay
+	if attempts < 1 {
+		attempts = defaultRetryAttempts
+	}
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return err
+		}
+		t.logger().Infof("Attempt %d of %d to %s failed, retrying in %s: %v", attempt, attempts, desc, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retryable reports whether a failed poll step is worth retrying, errors which
+// will fail again without a change to the config or repository are not
+func retryable(err error) bool {
+	switch utils.ClassOf(err) {
+	case utils.ErrAuth, utils.ErrNotFound, utils.ErrValidation:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/specgen"
+)
+
+// SecretResolver resolves a reference to a secret held in an external store.
+// References take the form <scheme>:<reference>, the scheme selects the resolver
+// and the remainder of the reference is passed to Resolve.
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretStores configures the external secret stores used to resolve EnvFrom
+// references within raw pod files
+type SecretStores struct {
+	Vault *VaultStore `mapstructure:"vault"`
+}
+
+// VaultStore resolves references of the form vault:<path>#<key> against the
+// HashiCorp Vault HTTP API. Both KV version 1 and version 2 engines are supported,
+// for version 2 the path must include the data/ segment, e.g. vault:secret/data/app#password
+type VaultStore struct {
+	// Address of the vault server, e.g. https://vault.example.com:8200
+	Address string `mapstructure:"address"`
+	// Token used to authenticate with vault
+	Token string `mapstructure:"token"`
+	// TokenEnv is the environment variable holding the token, used when Token is not set
+	TokenEnv string `mapstructure:"tokenEnv"`
+}
+
+// vaultClient reads secrets from vault, bounded so that an unresponsive vault
+// fails the deploy rather than blocking the method's runs
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+var (
+	secretResolversMu sync.RWMutex
+	secretResolvers   = map[string]SecretResolver{}
+)
+
+func registerSecretResolver(scheme string, r SecretResolver) {
+	secretResolversMu.Lock()
+	defer secretResolversMu.Unlock()
+	secretResolvers[scheme] = r
+}
+
+// register replaces any previously configured resolvers with those in the config
+func (s *SecretStores) register() {
+	secretResolversMu.Lock()
+	secretResolvers = map[string]SecretResolver{}
+	secretResolversMu.Unlock()
+	if s == nil {
+		return
+	}
+	if s.Vault != nil {
+		registerSecretResolver("vault", s.Vault)
+	}
+}
+
+// envReference matches the ${env:NAME} and ${secret:NAME} references of environment values
+var envReference = regexp.MustCompile(`\$\{(env|secret):([^}]*)\}`)
+
+// interpolateEnv expands references in the environment of a spec at deploy
+// time. ${env:NAME} is replaced by the variable of fetchit's own environment,
+// and a value which is exactly ${secret:NAME} is set from the podman secret NAME
+// when the container starts, so the secret's value is never read by fetchit.
+func interpolateEnv(s *specgen.SpecGenerator) error {
+	keys := make([]string, 0, len(s.Env))
+	for k := range s.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := s.Env[k]
+		if !strings.Contains(v, "${") {
+			continue
+		}
+		if m := envReference.FindStringSubmatch(v); m != nil && m[0] == v && m[1] == "secret" {
+			if m[2] == "" {
+				return fmt.Errorf("environment variable %s references a secret without a name", k)
+			}
+			if s.EnvSecrets == nil {
+				s.EnvSecrets = map[string]string{}
+			}
+			s.EnvSecrets[k] = m[2]
+			delete(s.Env, k)
+			continue
+		}
+		var err error
+		s.Env[k] = envReference.ReplaceAllStringFunc(v, func(ref string) string {
+			m := envReference.FindStringSubmatch(ref)
+			if m[1] == "secret" {
+				if err == nil {
+					err = fmt.Errorf("environment variable %s must be exactly ${secret:%s} to use the secret", k, m[2])
+				}
+				return ref
+			}
+			value, ok := os.LookupEnv(m[2])
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s references %s, which is not set in fetchit's environment", k, m[2])
+			}
+			return value
+		})
+		if err != nil {
+			return utils.Classify(utils.ErrValidation, err)
+		}
+	}
+	return nil
+}
+
+// resolveSecretRef resolves a <scheme>:<reference> secret reference using the
+// resolver registered for the scheme
+func resolveSecretRef(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid secret reference %q, expected <store>:<reference>", ref)
+	}
+	secretResolversMu.RLock()
+	r, ok := secretResolvers[parts[0]]
+	secretResolversMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("no secret store configured for %q", parts[0])
+	}
+	return r.Resolve(parts[1])
+}
+
+func (v *VaultStore) Resolve(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid vault reference %q, expected <path>#<key>", ref)
+	}
+	path, key := strings.Trim(parts[0], "/"), parts[1]
+
+	token := v.Token
+	if token == "" && v.TokenEnv != "" {
+		token = os.Getenv(v.TokenEnv)
+	}
+	if token == "" {
+		return "", fmt.Errorf("no vault token configured")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(v.Address, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", utils.WrapErrClass(utils.ErrTransient, err, "Error reading %s from vault", path)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", utils.Classify(utils.ErrAuth, fmt.Errorf("vault returned %s reading %s", resp.Status, path))
+	case http.StatusNotFound:
+		return "", utils.Classify(utils.ErrNotFound, fmt.Errorf("vault returned %s reading %s", resp.Status, path))
+	default:
+		return "", fmt.Errorf("vault returned %s reading %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("unable to decode vault response for %s: %v", path, err)
+	}
+	data := body.Data
+	// KV version 2 nests the secret within a second data object
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in vault secret %s", key, path)
+	}
+	return fmt.Sprintf("%v", value), nil
+}
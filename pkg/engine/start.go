@@ -6,6 +6,8 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // This file will be created within the fetchit pod
@@ -21,7 +23,17 @@ var startCmd = &cobra.Command{
 	},
 }
 
-var logger *zap.SugaredLogger
+var (
+	logger *zap.SugaredLogger
+	// baseLogger logs at every level, the global logger and target loggers
+	// raise it to their own level
+	baseLogger *zap.Logger
+	// logSink is stdout and the log file, opened once, and logCore is the
+	// core of the current log format writing to it
+	logSinkOnce sync.Once
+	logSink     zapcore.WriteSyncer
+	logCore     atomic.Value
+)
 
 func init() {
 	fetchitConfig = newFetchitConfig()
@@ -29,16 +41,40 @@ func init() {
 }
 
 func InitLogger() {
-	syncer := zap.CombineWriteSyncers(os.Stdout, getLogWriter())
-	encoder := getEncoder()
+	initLogger(getEncoder())
+	logger.Debug("Fetchit debug logging enabled.")
+}
+
+// initLogger switches the loggers to write with encoder to stdout and the log
+// file. The log file is opened and the global and base loggers are created on
+// the first call, later calls only swap the encoder the loggers write with.
+func initLogger(encoder zapcore.Encoder) {
+	logSinkOnce.Do(func() {
+		logSink = zap.CombineWriteSyncers(os.Stdout, getLogWriter())
+	})
+	logCore.Store(zapcore.NewCore(encoder, logSink, zap.NewAtomicLevelAt(zap.DebugLevel)))
+	if baseLogger != nil {
+		return
+	}
 	level := zap.InfoLevel
 	if os.Getenv("FETCHIT_DEBUG") != "" {
 		level = zap.DebugLevel
 	}
-	core := zapcore.NewCore(encoder, syncer, zap.NewAtomicLevelAt(level))
-	l := zap.New(core, zap.AddCaller())
-	logger = l.Sugar()
-	logger.Debug("Fetchit debug logging enabled.")
+	baseLogger = zap.New(&formatCore{LevelEnabler: zap.DebugLevel}, zap.AddCaller())
+	logger = baseLogger.WithOptions(zap.IncreaseLevel(level)).Sugar()
+}
+
+// newTargetLogger returns a logger for a target's reconcile output at its own
+// level, independent of the global level
+func newTargetLogger(name, level string) (*zap.SugaredLogger, error) {
+	l, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	if baseLogger == nil {
+		return logger, nil
+	}
+	return baseLogger.WithOptions(zap.IncreaseLevel(l)).Sugar().With("target", name), nil
 }
 
 func getEncoder() zapcore.Encoder {
@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/specgen"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// defaultStatePath is within the fetchit volume so it survives restarts of fetchit
+const defaultStatePath = "/opt/.cache/state.json"
+
+// appliedState is the minimal record of what fetchit has applied, persisted so a
+// restarted fetchit does not recreate containers which already match their files.
+// A nil appliedState records nothing.
+type appliedState struct {
+	mu      sync.Mutex
+	path    string
+	Targets map[string]*targetState `json:"targets"`
+}
+
+type targetState struct {
+	// Commits maps each method, as kind/name, to its last applied commit
+	Commits map[string]string `json:"commits"`
+	// Containers maps each container name to the hash of the spec it was created from
+	Containers map[string]string `json:"containers"`
+}
+
+// loadState reads the state at path, an unreadable state is logged and replaced
+func loadState(path string) *appliedState {
+	state := &appliedState{path: path, Targets: map[string]*targetState{}}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Infof("Unable to read applied state from %s, starting fresh: %v", path, err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		logger.Infof("Unable to parse applied state from %s, starting fresh: %v", path, err)
+		return &appliedState{path: path, Targets: map[string]*targetState{}}
+	}
+	if state.Targets == nil {
+		state.Targets = map[string]*targetState{}
+	}
+	return state
+}
+
+func (a *appliedState) target(t *Target) *targetState {
+	ts, ok := a.Targets[t.displayName()]
+	if !ok {
+		ts = &targetState{Commits: map[string]string{}, Containers: map[string]string{}}
+		a.Targets[t.displayName()] = ts
+	}
+	return ts
+}
+
+func (a *appliedState) recordCommit(t *Target, m Method, commit string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.target(t).Commits[m.GetKind()+"/"+m.GetName()] = commit
+	a.save()
+}
+
+// commit returns the last commit recorded for a method, or "" when none is
+func (a *appliedState) commit(t *Target, m Method) string {
+	if a == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.target(t).Commits[m.GetKind()+"/"+m.GetName()]
+}
+
+// restoreCurrent puts back the current commit of a method from the applied
+// state when its clone has none, e.g. after a corrupt clone was cloned again,
+// so the method moves on from the commit it last applied, removing what was
+// deleted since, rather than applying the repository from scratch
+func restoreCurrent(ctx context.Context, target *Target, m Method) {
+	if fetchit == nil {
+		return
+	}
+	recorded := fetchit.state.commit(target, m)
+	if recorded == "" {
+		return
+	}
+	log := target.logger()
+	target.exclusive(func() {
+		current, err := getCurrent(target, m.GetKind(), m.GetName())
+		if err != nil || current != plumbing.ZeroHash {
+			return
+		}
+		hash := plumbing.NewHash(recorded)
+		repo, err := git.PlainOpen(getDirectory(target))
+		if err != nil {
+			return
+		}
+		if _, err := repo.CommitObject(hash); err != nil {
+			log.Infof("Commit %s last applied by %s %s is not in the clone, applying it from scratch", hash.String()[:hashReportLen], m.GetKind(), m.GetName())
+			return
+		}
+		if err := updateCurrent(ctx, target, hash, m.GetKind(), m.GetName()); err != nil {
+			log.Errorf("Error restoring the current commit of %s %s: %v", m.GetKind(), m.GetName(), err)
+			return
+		}
+		log.Infof("Restored the current commit of %s %s to %s from the applied state", m.GetKind(), m.GetName(), hash.String()[:hashReportLen])
+	})
+}
+
+func (a *appliedState) containerHash(t *Target, name string) string {
+	if a == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.target(t).Containers[name]
+}
+
+// setContainerHash records the spec hash of a container, an empty hash removes it
+func (a *appliedState) setContainerHash(t *Target, name, hash string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if hash == "" {
+		delete(a.target(t).Containers, name)
+	} else {
+		a.target(t).Containers[name] = hash
+	}
+	a.save()
+}
+
+// save writes the state through a temporary file so a crash cannot leave it truncated
+func (a *appliedState) save() {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		logger.Errorf("Error marshalling applied state: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		logger.Errorf("Error creating directory for applied state %s: %v", a.path, err)
+		return
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		logger.Errorf("Error writing applied state %s: %v", a.path, err)
+		return
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		logger.Errorf("Error replacing applied state %s: %v", a.path, err)
+	}
+}
+
+func specHash(s *specgen.SpecGenerator) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// containerMatches reports whether a running container was created from the
+// same spec, as recorded by its spec hash label, and runs the current local image
+func containerMatches(conn context.Context, t *Target, s *specgen.SpecGenerator, hash string) (bool, error) {
+	if hash == "" {
+		return false, nil
+	}
+	var exists bool
+	var ctr *define.InspectContainerData
+	err := withPodman(conn, podmanTimeout(), "inspect container "+s.Name, func(ctx context.Context) error {
+		var err error
+		if exists, err = containers.Exists(ctx, s.Name, nil); err != nil || !exists {
+			return err
+		}
+		ctr, err = containers.Inspect(ctx, s.Name, nil)
+		return err
+	})
+	if err != nil {
+		return false, utils.WrapErr(err, "Error inspecting container %s", s.Name)
+	}
+	if !exists {
+		return false, nil
+	}
+	if ctr.State == nil || !ctr.State.Running {
+		return false, nil
+	}
+	// Containers created before the spec hash label are matched by the applied state
+	var labelled string
+	if ctr.Config != nil {
+		labelled = ctr.Config.Labels[specHashLabel]
+	}
+	if labelled != hash && (labelled != "" || fetchit == nil || fetchit.state.containerHash(t, s.Name) != hash) {
+		return false, nil
+	}
+	img, err := inspectImage(conn, s.Image)
+	if err != nil {
+		return false, utils.WrapErr(err, "Error inspecting image %s", s.Image)
+	}
+	return img.ID == ctr.Image, nil
+}
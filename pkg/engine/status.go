@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	phaseIdle     = "idle"
+	phaseFetching = "fetching"
+	phaseApplying = "applying"
+)
+
+// TargetStatus is a point in time view of a target's reconcile state.
+// It is guarded by its own lock rather than the target mutex, so it can be
+// read while a reconcile is in progress.
+type TargetStatus struct {
+	// Phase is the current reconcile phase of the target
+	Phase string `json:"phase"`
+	// Method is the kind and name of the method currently reconciling, if any
+	Method string `json:"method,omitempty"`
+	// LastRun is when a method last finished reconciling the target
+	LastRun time.Time `json:"lastRun,omitempty"`
+	// LastCommit is the last commit successfully applied
+	LastCommit string `json:"lastCommit,omitempty"`
+	// LastError is the error from the last reconcile, empty on success
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorClass is the class of the last error, e.g. auth, transient, not found, validation or podman
+	LastErrorClass string `json:"lastErrorClass,omitempty"`
+	// Cloned is set once the target's repository has been cloned or loaded
+	Cloned bool `json:"cloned"`
+	// Paused is set while the target is paused, its scheduled runs are skipped
+	Paused bool `json:"paused"`
+}
+
+// displayName identifies the target in logs and reports, using the configured
+// name when set and otherwise the repository url or device
+func (t *Target) displayName() string {
+	switch {
+	case t.name != "":
+		return t.name
+	case t.url != "":
+		return t.url
+	default:
+		return t.device
+	}
+}
+
+// logger returns the target's logger when it has its own log level, otherwise the global logger
+func (t *Target) logger() *zap.SugaredLogger {
+	if t != nil && t.log != nil {
+		return t.log
+	}
+	return logger
+}
+
+// Status returns a copy of the target's status without waiting on a running reconcile
+func (t *Target) Status() TargetStatus {
+	t.statusMu.RLock()
+	defer t.statusMu.RUnlock()
+	status := t.status
+	if status.Phase == "" {
+		status.Phase = phaseIdle
+	}
+	status.Paused = isPaused(t)
+	return status
+}
+
+func (t *Target) setPhase(m Method, phase string) {
+	t.statusMu.Lock()
+	defer t.statusMu.Unlock()
+	t.status.Phase = phase
+	t.status.Method = m.GetKind() + "/" + m.GetName()
+}
+
+// setCloned records that the target's repository is available
+func (t *Target) setCloned() {
+	t.statusMu.Lock()
+	defer t.statusMu.Unlock()
+	t.status.Cloned = true
+}
+
+// finishRun records the outcome of a reconcile and returns the target to idle
+func (t *Target) finishRun(commit string, err error) {
+	t.statusMu.Lock()
+	defer t.statusMu.Unlock()
+	t.status.Phase = phaseIdle
+	t.status.Method = ""
+	t.status.LastRun = time.Now()
+	t.status.LastError = ""
+	t.status.LastErrorClass = ""
+	if err != nil {
+		t.status.LastError = err.Error()
+		t.status.LastErrorClass = utils.ClassName(err)
+		return
+	}
+	if commit != "" {
+		t.status.LastCommit = commit
+	}
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"path"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// updateSubmodules initializes and checks out the submodules of a target's
+// checked out commit, including nested submodules, fetching them with the
+// target's credentials
+func updateSubmodules(target *Target, wt *git.Worktree) error {
+	subs, err := wt.Submodules()
+	if err != nil {
+		return utils.WrapErr(err, "Error reading submodules of %s", target.url)
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+	auth, err := gitAuth(target)
+	if err != nil {
+		return err
+	}
+	err = subs.Update(&git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Auth:              auth,
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error updating submodules of %s", target.url)
+	}
+	return nil
+}
+
+// expandSubmodules replaces each change of a submodule's commit with the
+// changes of the files within the submodule, named by their path in the
+// parent tree, so methods deploy the files of submodules like any other file.
+// st is the storage of the repository the changes were read from and prefix is
+// the path of their tree in that repository.
+func expandSubmodules(st storage.Storer, prefix string, changes object.Changes) (object.Changes, error) {
+	var result object.Changes
+	for _, change := range changes {
+		fromSub := change.From.Name != "" && change.From.TreeEntry.Mode == filemode.Submodule
+		toSub := change.To.Name != "" && change.To.TreeEntry.Mode == filemode.Submodule
+		if !fromSub && !toSub {
+			result = append(result, change)
+			continue
+		}
+		// a file replaced by a submodule, or a submodule by a file, keeps the
+		// change of its file
+		if !fromSub && change.From.Name != "" {
+			result = append(result, &object.Change{From: change.From})
+		}
+		if !toSub && change.To.Name != "" {
+			result = append(result, &object.Change{To: change.To})
+		}
+
+		name := change.To.Name
+		if !toSub {
+			name = change.From.Name
+		}
+		subPath := path.Join(prefix, name)
+		subSt, err := submoduleStorer(st, subPath)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error opening submodule %s", subPath)
+		}
+		fromTree, toTree := &object.Tree{}, &object.Tree{}
+		if fromSub {
+			if fromTree, err = submoduleTree(subSt, subPath, change.From.TreeEntry); err != nil {
+				return nil, err
+			}
+		}
+		if toSub {
+			if toTree, err = submoduleTree(subSt, subPath, change.To.TreeEntry); err != nil {
+				return nil, err
+			}
+		}
+		subChanges, err := fromTree.Diff(toTree)
+		if err != nil {
+			return nil, utils.WrapErr(err, "Error getting diff of submodule %s", subPath)
+		}
+		if subChanges, err = expandSubmodules(subSt, "", subChanges); err != nil {
+			return nil, err
+		}
+		for _, c := range subChanges {
+			if c.From.Name != "" {
+				c.From.Name = path.Join(name, c.From.Name)
+			}
+			if c.To.Name != "" {
+				c.To.Name = path.Join(name, c.To.Name)
+			}
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// submoduleStorer returns the storage of the submodule at subPath, which is
+// named after its path unless the repository's config names it otherwise
+func submoduleStorer(st storage.Storer, subPath string) (storage.Storer, error) {
+	name := subPath
+	if cfg, err := st.Config(); err == nil {
+		for n, sub := range cfg.Submodules {
+			if sub.Path == subPath {
+				name = n
+			}
+		}
+	}
+	return st.Module(name)
+}
+
+// submoduleTree returns the tree of the commit a submodule entry points at
+func submoduleTree(st storage.Storer, subPath string, entry object.TreeEntry) (*object.Tree, error) {
+	commit, err := object.GetCommit(st, entry.Hash)
+	if err != nil {
+		return nil, utils.WrapErrClass(utils.ErrNotFound, err, "Error getting commit %s of submodule %s, it may not have been fetched", entry.Hash.String()[:hashReportLen], subPath)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error getting tree of submodule %s", subPath)
+	}
+	return tree, nil
+}
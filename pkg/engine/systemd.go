@@ -6,10 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/containers/fetchit/pkg/engine/utils"
 	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/containers/podman/v4/pkg/domain/entities"
 	"github.com/containers/podman/v4/pkg/specgen"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -24,8 +27,14 @@ const (
 	systemdPathRoot         = "/etc/systemd/system"
 	systemdMethod           = "systemd"
 	systemdImage            = "quay.io/fetchit/fetchit-systemd:latest"
+	// systemdActionsLabel of the systemd helper image lists the actions it
+	// runs beyond enable, restart and stop, which every build runs
+	systemdActionsLabel = "io.fetchit.systemd-actions"
 )
 
+// baseSystemdActions are run by every build of the systemd helper image
+var baseSystemdActions = map[string]bool{"enable": true, "restart": true, "stop": true}
+
 // Systemd to place and/or enable systemd unit files on host
 type Systemd struct {
 	CommonMethod `mapstructure:",squash"`
@@ -87,41 +96,50 @@ func (sd *Systemd) GetKind() string {
 
 func (sd *Systemd) Process(ctx, conn context.Context, skew int) {
 	target := sd.GetTarget()
+	log := target.logger()
 	time.Sleep(time.Duration(skew) * time.Millisecond)
-	target.mu.Lock()
-	defer target.mu.Unlock()
+	defer target.lockRun(sd)()
 
 	if sd.autoUpdateAll && !sd.initialRun {
 		return
 	}
-	tag := []string{".service"}
+	tag := sd.fileTags([]string{".service"})
 	if sd.Restart {
 		sd.Enable = true
 	}
 	if sd.initialRun {
 		if sd.autoUpdateAll {
+			if target.dryRun {
+				log.Infof("Dry run: would enable podman-auto-update.service")
+				sd.initialRun = false
+				return
+			}
 			if err := sd.MethodEngine(ctx, conn, nil, ""); err != nil {
-				logger.Infof("Failed to start podman-auto-update.service: %v", err)
+				log.Infof("Failed to start podman-auto-update.service: %v", err)
 			}
 			sd.initialRun = false
 			return
 		}
-		err := getRepo(target)
+		err := target.retry(ctx, "clone "+target.url, func() error { return getRepo(target) })
 		if err != nil {
-			logger.Errorf("Failed to clone repository %s: %v", target.url, err)
+			log.Errorf("Failed to clone repository %s: %v", target.url, err)
 			return
 		}
 
-		err = zeroToCurrent(ctx, conn, sd, target, &tag)
+		err = target.retry(ctx, "move to current", func() error {
+			return zeroToCurrent(ctx, conn, sd, target, tag)
+		})
 		if err != nil {
-			logger.Errorf("Error moving to current: %v", err)
+			log.Errorf("Error moving to current: %v", err)
 			return
 		}
 	}
 
-	err := currentToLatest(ctx, conn, sd, target, &tag)
+	err := target.retry(ctx, "move current to latest", func() error {
+		return currentToLatest(ctx, conn, sd, target, tag)
+	})
 	if err != nil {
-		logger.Errorf("Error moving current to latest: %v", err)
+		log.Errorf("Error moving current to latest: %v", err)
 		return
 	}
 
@@ -139,29 +157,11 @@ func (sd *Systemd) MethodEngine(ctx context.Context, conn context.Context, chang
 		if change.To.Name != "" {
 			curr = &change.To.Name
 		}
-		if change.From.Name == "" && change.To.Name != "" {
-			changeType = "create"
-		}
-		if change.From.Name != "" && change.To.Name != "" {
-			if change.From.Name == change.To.Name {
-				changeType = "update"
-			} else {
-				changeType = "rename"
-			}
-		}
-		if change.From.Name != "" && change.To.Name == "" {
-			changeType = "delete"
-		}
+		changeType = changeAction(change)
 	}
-	nonRootHomeDir := os.Getenv("HOME")
-	if nonRootHomeDir == "" {
-		return fmt.Errorf("Could not determine $HOME for host, must set $HOME on host machine for non-root systemd method")
-	}
-	var dest string
-	if sd.Root {
-		dest = systemdPathRoot
-	} else {
-		dest = filepath.Join(nonRootHomeDir, ".config", "systemd", "user")
+	dest, err := systemdDest(sd.Root)
+	if err != nil {
+		return err
 	}
 	if change != nil {
 		sd.initialRun = true
@@ -169,8 +169,21 @@ func (sd *Systemd) MethodEngine(ctx context.Context, conn context.Context, chang
 	return sd.systemdPodman(ctx, conn, path, dest, prev, curr, &changeType)
 }
 
+// systemdDest returns the directory of system units, or of the user units of
+// the user running fetchit
+func systemdDest(root bool) (string, error) {
+	if root {
+		return systemdPathRoot, nil
+	}
+	nonRootHomeDir := os.Getenv("HOME")
+	if nonRootHomeDir == "" {
+		return "", fmt.Errorf("Could not determine $HOME for host, must set $HOME on host machine for non-root systemd method")
+	}
+	return filepath.Join(nonRootHomeDir, ".config", "systemd", "user"), nil
+}
+
 func (sd *Systemd) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
-	changeMap, err := applyChanges(ctx, sd.GetTarget(), sd.GetTargetPath(), sd.Glob, currentState, desiredState, tags)
+	changeMap, err := applyChanges(ctx, &sd.CommonMethod, currentState, desiredState, tags)
 	if err != nil {
 		return err
 	}
@@ -181,7 +194,8 @@ func (sd *Systemd) Apply(ctx, conn context.Context, currentState, desiredState p
 }
 
 func (sd *Systemd) systemdPodman(ctx context.Context, conn context.Context, path, dest string, prev *string, curr *string, changeType *string) error {
-	logger.Infof("Deploying systemd file(s) %s", path)
+	log := sd.GetTarget().logger()
+	log.Infof("Deploying systemd file(s) %s", path)
 	if sd.autoUpdateAll {
 		if !sd.initialRun {
 			return nil
@@ -202,7 +216,7 @@ func (sd *Systemd) systemdPodman(ctx context.Context, conn context.Context, path
 		}
 	}
 	if !sd.Enable {
-		logger.Infof("Systemd target %s successfully processed", sd.Name)
+		log.Infof("Systemd target %s successfully processed", sd.Name)
 		return nil
 	}
 	if *changeType == "create" {
@@ -224,17 +238,21 @@ func (sd *Systemd) systemdPodman(ctx context.Context, conn context.Context, path
 	if *changeType == "delete" {
 		return sd.enableRestartSystemdService(conn, "stop", dest, filepath.Base(*prev))
 	}
-	logger.Infof("Systemd target %s %s not processed", sd.Name, *changeType)
+	log.Infof("Systemd target %s %s not processed", sd.Name, *changeType)
 	return nil
 }
 
 func (sd *Systemd) enableRestartSystemdService(conn context.Context, action, dest, service string) error {
+	log := sd.GetTarget().logger()
 	act := action
 	if action == "autoupdate" {
 		act = "enable"
 	}
-	logger.Infof("Systemd target: %s, running systemctl %s %s", sd.Name, act, service)
-	if err := detectOrFetchImage(conn, systemdImage, false); err != nil {
+	log.Infof("Systemd target: %s, running systemctl %s %s", sd.Name, act, service)
+	if err := detectOrFetchImage(conn, systemdImage, pullIfNotPresent, nil); err != nil {
+		return err
+	}
+	if err := checkSystemdImage(conn, act); err != nil {
 		return err
 	}
 
@@ -288,6 +306,51 @@ func (sd *Systemd) enableRestartSystemdService(conn context.Context, action, des
 	if err != nil {
 		return err
 	}
-	logger.Infof("Systemd target %s-%s %s complete", sd.Name, act, service)
+	log.Infof("Systemd target %s-%s %s complete", sd.Name, act, service)
 	return nil
 }
+
+// systemdImageSupports reports whether a systemd helper image with labels runs action
+func systemdImageSupports(labels map[string]string, action string) bool {
+	if baseSystemdActions[action] {
+		return true
+	}
+	for _, a := range strings.Fields(labels[systemdActionsLabel]) {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSystemdImage fails when the local systemd helper image is a build which
+// does not run action, as it would exit without doing anything. The image is
+// pulled again first, in case it was pulled before the action was added.
+func checkSystemdImage(conn context.Context, action string) error {
+	if baseSystemdActions[action] {
+		return nil
+	}
+	supported := func() (bool, error) {
+		var img *entities.ImageInspectReport
+		err := withPodman(conn, podmanTimeout(), "inspect image "+systemdImage, func(ctx context.Context) error {
+			var err error
+			img, err = images.GetImage(ctx, systemdImage, nil)
+			return err
+		})
+		if err != nil {
+			return false, utils.WrapErr(err, "Error inspecting image %s", systemdImage)
+		}
+		return img.ImageData != nil && systemdImageSupports(img.Labels, action), nil
+	}
+	if ok, err := supported(); err != nil || ok {
+		return err
+	}
+	logger.Infof("Image %s does not support systemctl %s, pulling it again", systemdImage, action)
+	if err := detectOrFetchImage(conn, systemdImage, pullAlways, nil); err != nil {
+		return err
+	}
+	if ok, err := supported(); err != nil || ok {
+		return err
+	}
+	return utils.Classify(utils.ErrValidation, fmt.Errorf("image %s does not support systemctl %s, a build labeled %s=\"... %s\" is required", systemdImage, action, systemdActionsLabel, action))
+}
@@ -3,10 +3,13 @@ package engine
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/go-co-op/gocron"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpproxy"
 )
 
 type Method interface {
@@ -26,6 +29,19 @@ type FetchitConfig struct {
 	Prune            *Prune            `mapstructure:"prune"`
 	PodmanAutoUpdate *PodmanAutoUpdate `mapstructure:"podmanAutoUpdate"`
 	Images           []*Image          `mapstructure:"images"`
+	SecretStores     *SecretStores     `mapstructure:"secretStores"`
+	ReconcileHook    *ReconcileHook    `mapstructure:"reconcileHook"`
+	StopTimeout      *uint             `mapstructure:"stopTimeout"`
+	ReconnectTimeout string            `mapstructure:"reconnectTimeout"`
+	PodmanTimeout    string            `mapstructure:"podmanTimeout"`
+	PullTimeout      string            `mapstructure:"pullTimeout"`
+	DryRun           bool              `mapstructure:"dryRun"`
+	MetricsAddress   string            `mapstructure:"metricsAddress"`
+	Webhook          *Webhook          `mapstructure:"webhook"`
+	ControlToken     string            `mapstructure:"controlToken"`
+	CAFile           string            `mapstructure:"caFile"`
+	LogFormat        string            `mapstructure:"logFormat"`
+	AuditLog         *AuditLog         `mapstructure:"auditLog"`
 	conn             context.Context
 	scheduler        *gocron.Scheduler
 }
@@ -37,11 +53,36 @@ type TargetConfig struct {
 	Disconnected      bool               `mapstructure:"disconnected"`
 	VerifyCommitsInfo *VerifyCommitsInfo `mapstructure:"verifyCommitsInfo"`
 	Branch            string             `mapstructure:"branch"`
+	Tag               string             `mapstructure:"tag"`
+	Schedule          string             `mapstructure:"schedule"`
+	PollInterval      string             `mapstructure:"pollInterval"`
+	Revision          string             `mapstructure:"revision"`
+	Depth             int                `mapstructure:"depth"`
+	RecurseSubmodules bool               `mapstructure:"recurseSubmodules"`
+	AllowedImages     []string           `mapstructure:"allowedImages"`
+	DeniedImages      []string           `mapstructure:"deniedImages"`
+	LogLevel          string             `mapstructure:"logLevel"`
+	User              string             `mapstructure:"user"`
+	RetryAttempts     int                `mapstructure:"retryAttempts"`
+	RetryDelay        string             `mapstructure:"retryDelay"`
+	Vars              map[string]string  `mapstructure:"vars"`
+	DryRun            bool               `mapstructure:"dryRun"`
+	SSHKeyFile        string             `mapstructure:"sshKeyFile"`
+	SSHKeyPassphrase  string             `mapstructure:"sshKeyPassphrase"`
+	SSHHostKey        string             `mapstructure:"sshHostKey"`
+	SkipHostKeyCheck  bool               `mapstructure:"skipHostKeyCheck"`
+	ImageSignatureKey string             `mapstructure:"imageSignatureKey"`
+	HTTPProxy         string             `mapstructure:"httpProxy"`
+	HTTPSProxy        string             `mapstructure:"httpsProxy"`
+	NoProxy           string             `mapstructure:"noProxy"`
+	CAFile            string             `mapstructure:"caFile"`
+	InsecureSkipTLS   bool               `mapstructure:"insecureSkipTLS"`
 	Ansible           []*Ansible         `mapstructure:"ansible"`
 	FileTransfer      []*FileTransfer    `mapstructure:"filetransfer"`
 	Kube              []*Kube            `mapstructure:"kube"`
 	Raw               []*Raw             `mapstructure:"raw"`
 	Systemd           []*Systemd         `mapstructure:"systemd"`
+	Volume            []*Volume          `mapstructure:"volume"`
 
 	image        *Image
 	prune        *Prune
@@ -50,20 +91,75 @@ type TargetConfig struct {
 }
 
 type Target struct {
-	ssh             bool
-	sshKey          string
-	url             string
-	pat             string
-	envSecret       string
-	username        string
-	password        string
-	device          string
-	localPath       string
-	branch          string
-	mu              sync.Mutex
+	ssh       bool
+	sshKey    string
+	url       string
+	pat       string
+	envSecret string
+	username  string
+	password  string
+	device    string
+	localPath string
+	branch    string
+	tag       string
+	revision  string
+	// mu guards the clone of the target. Cloning, fetching, checking out and
+	// moving the current tag of a method hold it exclusively, while methods
+	// reading files from the checkout share it. fetchMu serializes the fetches
+	// of shared holders deepening a shallow clone.
+	mu              sync.RWMutex
+	fetchMu         sync.Mutex
 	disconnected    bool
 	gitsignVerify   bool
 	gitsignRekorURL string
+	commitKeys      *commitKeys
+
+	// runs serializes the runs of each method, keyed by dryRunKey
+	runsMu sync.Mutex
+	runs   map[string]*sync.Mutex
+	// statusMu guards status so that it can be read while a reconcile is in progress
+	statusMu sync.RWMutex
+	status   TargetStatus
+	name     string
+	depth    int
+	// submodules checks out the repository's submodules and deploys their files
+	submodules bool
+	// imagePolicy restricts the images the target deploys, nil allows any image
+	imagePolicy *imagePolicy
+	// log is set when the target has its own log level
+	log *zap.SugaredLogger
+	// user is the user whose rootless podman session the target deploys into,
+	// "" deploys through fetchit's own connection. userConn is connected to the
+	// session by the first run which finds its socket.
+	user     string
+	userMu   sync.Mutex
+	userConn context.Context
+	// sshPassphrase, sshHostKey and sshInsecureHostKey are set with a target's own deploy key
+	sshPassphrase      string
+	sshHostKey         string
+	sshInsecureHostKey bool
+	// retryAttempts and retryDelay bound the retries of each step of a poll
+	retryAttempts int
+	retryDelay    time.Duration
+	// vars are rendered into the template actions of raw files
+	vars map[string]string
+	// raws are the raw methods of the target, whose files are checked together
+	// for colliding container names and host ports
+	raws []*Raw
+	// dryRun reports the changes of the target's methods without applying them,
+	// dryRunCommits holds the commit last reported for each method
+	dryRun        bool
+	dryRunCommits map[string]plumbing.Hash
+	// imageSignatureKey is the public key the images of raw containers must be signed with
+	imageSignatureKey string
+	// schedule is the cron schedule of the target's methods which do not set their own
+	schedule string
+	// proxy is the proxy of the target's git operations, nil uses the environment of fetchit
+	proxy *httpproxy.Config
+	// caBundle holds the PEM certificates trusted for the target's git and registry endpoints
+	caBundle []byte
+	// insecureSkipTLS skips verifying the TLS certificates of the target's endpoints
+	insecureSkipTLS bool
 }
 
 type SchedInfo struct {
@@ -77,4 +173,10 @@ type VerifyCommitsInfo struct {
 	GitsignVerify bool
 	// default is https://rekor.sigstore.dev
 	GitsignRekorURL string
+	// GPGKeyring is an armored keyring of the GPG public keys allowed to sign
+	// deployed commits
+	GPGKeyring string
+	// SSHAllowedSigners is a file of the SSH public keys allowed to sign
+	// deployed commits, in git's allowed signers format
+	SSHAllowedSigners string
 }
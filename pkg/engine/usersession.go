@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+)
+
+// userRuntimeDir holds the runtime directory of each user session on the host,
+// it must be mounted into fetchit for targets which deploy as a user
+const userRuntimeDir = "/run/user"
+
+// userUID resolves a UID or a user name to a UID, names are resolved from
+// /etc/passwd as seen by fetchit
+func userUID(name string) (string, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return name, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", utils.WrapErrClass(utils.ErrValidation, err, "Error resolving user %s, use a UID or mount the host's /etc/passwd", name)
+	}
+	return u.Uid, nil
+}
+
+// userConnection connects to the rootless podman socket of a user's session,
+// user is a UID or a user name
+func userConnection(ctx context.Context, name string) (context.Context, error) {
+	uid, err := userUID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := filepath.Join(userRuntimeDir, uid, "podman", "podman.sock")
+	if _, err := os.Stat(socket); err != nil {
+		return nil, utils.Classify(utils.ErrTransient, fmt.Errorf("podman socket of user %s not found at %s, enable lingering with loginctl enable-linger and the user's podman.socket: %w", name, socket, err))
+	}
+	conn, err := newPodmanConn(ctx, "unix://"+socket)
+	if err != nil {
+		return nil, utils.WrapErr(err, "Error connecting to the podman socket of user %s", name)
+	}
+	return conn, nil
+}
+
+// podmanConn returns the podman connection the target deploys through, conn
+// for fetchit's own. The session of the target's user is connected to on the
+// first call which finds its socket, so a session started after fetchit is
+// picked up by the next run, and healthyConn replaces it when podman restarts.
+func (t *Target) podmanConn(conn context.Context) (context.Context, error) {
+	if t == nil || t.user == "" {
+		return conn, nil
+	}
+	t.userMu.Lock()
+	defer t.userMu.Unlock()
+	if t.userConn == nil {
+		c, err := userConnection(context.Background(), t.user)
+		if err != nil {
+			return nil, err
+		}
+		if fetchit != nil {
+			setReconnectTimeout(c, fetchit.reconnectTimeout)
+		}
+		t.userConn = c
+	}
+	return t.userConn, nil
+}
@@ -1,8 +1,113 @@
 package utils
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 
+	"github.com/containers/podman/v4/pkg/errorhandling"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Error classes, test for them with errors.Is or find the class of an error with ClassOf
+var (
+	ErrAuth       = errors.New("auth")
+	ErrTransient  = errors.New("transient")
+	ErrNotFound   = errors.New("not found")
+	ErrValidation = errors.New("validation")
+	ErrPodman     = errors.New("podman")
+)
+
+// WrapErr adds a message to an error, the wrapped error can still be
+// examined with errors.Is and errors.As
 func WrapErr(e error, msg string, args ...interface{}) error {
 	final_msg := fmt.Sprintf(msg, args...)
-	return fmt.Errorf("%s: %s", final_msg, e)
+	return fmt.Errorf("%s: %w", final_msg, e)
+}
+
+// WrapErrClass wraps an error as WrapErr does and marks it with an error class
+func WrapErrClass(class, e error, msg string, args ...interface{}) error {
+	return Classify(class, WrapErr(e, msg, args...))
+}
+
+// Classify marks an error with an error class without changing its message
+func Classify(class, e error) error {
+	if e == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: e}
+}
+
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// ClassOf returns the class of an error, either as marked by Classify or inferred
+// from the podman, git and network errors it wraps. nil is returned when the
+// class is unknown.
+func ClassOf(e error) error {
+	if e == nil {
+		return nil
+	}
+	for _, class := range []error{ErrAuth, ErrNotFound, ErrValidation, ErrTransient, ErrPodman} {
+		if errors.Is(e, class) {
+			return class
+		}
+	}
+
+	var model *errorhandling.ErrorModel
+	if errors.As(e, &model) {
+		switch code := model.Code(); {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return ErrAuth
+		case code == http.StatusNotFound:
+			return ErrNotFound
+		case code == http.StatusBadRequest || code == http.StatusConflict:
+			return ErrValidation
+		default:
+			return ErrPodman
+		}
+	}
+
+	switch {
+	case errors.Is(e, transport.ErrAuthenticationRequired), errors.Is(e, transport.ErrAuthorizationFailed):
+		return ErrAuth
+	case errors.Is(e, transport.ErrRepositoryNotFound):
+		return ErrNotFound
+	case errors.Is(e, context.DeadlineExceeded):
+		return ErrTransient
+	}
+	var netErr net.Error
+	if errors.As(e, &netErr) {
+		return ErrTransient
+	}
+	return nil
+}
+
+// ClassName returns the name of the class of an error, or an empty string when it is unknown
+func ClassName(e error) string {
+	if class := ClassOf(e); class != nil {
+		return class.Error()
+	}
+	return ""
+}
+
+// IsTransient reports whether an operation failing with e may succeed if retried
+func IsTransient(e error) bool {
+	return ClassOf(e) == ErrTransient
 }
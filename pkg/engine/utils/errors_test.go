@@ -2,7 +2,11 @@ package utils
 
 import (
 	"errors"
+	"net"
 	"testing"
+
+	"github.com/containers/podman/v4/pkg/errorhandling"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
 func TestWrapErr(t *testing.T) {
@@ -22,3 +26,36 @@ func TestWrapErr(t *testing.T) {
 		t.Fatalf("Failed: err: %s != %s", err, expected)
 	}
 }
+
+func TestWrapErrUnwrap(t *testing.T) {
+	e := errors.New("other_err")
+	err := WrapErr(WrapErr(e, "inner"), "outer")
+	if !errors.Is(err, e) {
+		t.Fatalf("Failed: %v does not wrap %v", err, e)
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"unclassified", errors.New("other_err"), nil},
+		{"classified", Classify(ErrValidation, errors.New("bad spec")), ErrValidation},
+		{"wrapped classified", WrapErr(WrapErrClass(ErrAuth, errors.New("denied"), "Error"), "outer"), ErrAuth},
+		{"podman not found", WrapErr(&errorhandling.ErrorModel{ResponseCode: 404}, "Error"), ErrNotFound},
+		{"podman internal", &errorhandling.ErrorModel{ResponseCode: 500}, ErrPodman},
+		{"git auth", WrapErr(transport.ErrAuthenticationRequired, "Error cloning"), ErrAuth},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrTransient},
+		{"nil", nil, nil},
+	}
+	for _, tt := range tests {
+		if got := ClassOf(tt.err); got != tt.want {
+			t.Errorf("%s: ClassOf(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+	if err := Classify(ErrNotFound, errors.New("missing")); err.Error() != "missing" {
+		t.Fatalf("Failed: Classify changed message to %s", err.Error())
+	}
+}
@@ -0,0 +1,305 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/containers/fetchit/pkg/engine/utils"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/bindings/volumes"
+	"github.com/containers/podman/v4/pkg/domain/entities"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gopkg.in/yaml.v3"
+)
+
+const volumeMethod = "volume"
+
+// Volume to create and remove podman volumes from json or yaml files
+type Volume struct {
+	CommonMethod `mapstructure:",squash"`
+}
+
+/* below is an example volume.yaml file:
+Name: data
+Driver: local
+Options:
+  type: tmpfs
+  device: tmpfs
+  o: size=100m
+Labels:
+  app: colors
+RemoveOnDelete: false
+*/
+
+type RawVolume struct {
+	Name    string            `json:"Name" yaml:"Name"`
+	Driver  string            `json:"Driver" yaml:"Driver"`
+	Options map[string]string `json:"Options" yaml:"Options"`
+	Labels  map[string]string `json:"Labels" yaml:"Labels"`
+	// RemoveOnDelete removes the volume, and the data within it, when its file is
+	// removed from the repository. Volumes in use by a container are never removed.
+	RemoveOnDelete bool `json:"RemoveOnDelete" yaml:"RemoveOnDelete"`
+}
+
+func (v *Volume) GetKind() string {
+	return volumeMethod
+}
+
+func (v *Volume) Process(ctx, conn context.Context, skew int) {
+	time.Sleep(time.Duration(skew) * time.Millisecond)
+	target := v.GetTarget()
+	log := target.logger()
+	defer target.lockRun(v)()
+
+	tag := v.fileTags([]string{".json", ".yaml", ".yml"})
+
+	if v.initialRun {
+		err := target.retry(ctx, "clone "+target.url, func() error { return getRepo(target) })
+		if err != nil {
+			log.Errorf("Failed to clone repository %s: %v", target.url, err)
+			return
+		}
+
+		err = target.retry(ctx, "move to current", func() error {
+			return zeroToCurrent(ctx, conn, v, target, tag)
+		})
+		if err != nil {
+			log.Errorf("Error moving to current: %v", err)
+			return
+		}
+	}
+
+	err := target.retry(ctx, "move current to latest", func() error {
+		return currentToLatest(ctx, conn, v, target, tag)
+	})
+	if err != nil {
+		log.Errorf("Error moving current to latest: %v", err)
+		return
+	}
+
+	v.initialRun = false
+}
+
+func (v *Volume) MethodEngine(ctx, conn context.Context, change *object.Change, path string) error {
+	prev, err := getChangeString(change)
+	if err != nil {
+		return err
+	}
+	return v.volumePodman(ctx, conn, path, prev)
+}
+
+func (v *Volume) Apply(ctx, conn context.Context, currentState, desiredState plumbing.Hash, tags *[]string) error {
+	changeMap, err := applyChanges(ctx, &v.CommonMethod, currentState, desiredState, tags)
+	if err != nil {
+		return err
+	}
+	if err := runChanges(ctx, conn, v, changeMap); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v *Volume) volumePodman(ctx, conn context.Context, path string, prev *string) error {
+	var vol *RawVolume
+	if path != deleteFile {
+		volFile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		vol, err = rawVolumeFromBytes(volFile)
+		if err != nil {
+			return utils.WrapErr(err, "Error reading volume from %s", path)
+		}
+	}
+
+	// Only remove the previous volume when it was deleted or renamed
+	if prev != nil {
+		prevVol, err := rawVolumeFromBytes([]byte(*prev))
+		if err != nil {
+			return err
+		}
+		if vol == nil || prevVol.Name != vol.Name {
+			if err := removeVolume(conn, prevVol); err != nil {
+				return err
+			}
+		}
+	}
+
+	if vol == nil {
+		return nil
+	}
+	return ensureVolume(conn, vol)
+}
+
+// ensureVolume creates the volume if it does not exist. Podman cannot change the
+// driver, options or labels of an existing volume, so differences are reported
+// rather than recreating a volume which may hold data.
+func ensureVolume(conn context.Context, vol *RawVolume) error {
+	exists, err := volumeExists(conn, vol.Name)
+	if err != nil {
+		return utils.WrapErr(err, "Error checking for volume %s", vol.Name)
+	}
+	labels := map[string]string{"owned-by": FetchItLabel}
+	for k, val := range vol.Labels {
+		labels[k] = val
+	}
+
+	if exists {
+		var existing *entities.VolumeConfigResponse
+		err := withPodman(conn, podmanTimeout(), "inspect volume "+vol.Name, func(ctx context.Context) error {
+			var err error
+			existing, err = volumes.Inspect(ctx, vol.Name, nil)
+			return err
+		})
+		if err != nil {
+			return utils.WrapErr(err, "Error inspecting volume %s", vol.Name)
+		}
+		if vol.Driver != "" && existing.Driver != vol.Driver {
+			logger.Infof("Volume %s exists with driver %s, podman cannot change it to %s", vol.Name, existing.Driver, vol.Driver)
+		}
+		if len(vol.Options) > 0 && !reflect.DeepEqual(existing.Options, vol.Options) {
+			logger.Infof("Volume %s exists with different options, podman cannot update them in place", vol.Name)
+		}
+		for k, val := range labels {
+			if existing.Labels[k] != val {
+				logger.Infof("Volume %s exists with different labels, podman cannot update them in place", vol.Name)
+				break
+			}
+		}
+		return nil
+	}
+
+	err = withPodman(conn, podmanTimeout(), "create volume "+vol.Name, func(ctx context.Context) error {
+		_, err := volumes.Create(ctx, entities.VolumeCreateOptions{
+			Name:    vol.Name,
+			Driver:  vol.Driver,
+			Labels:  labels,
+			Options: vol.Options,
+		}, nil)
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error creating volume %s", vol.Name)
+	}
+	logger.Infof("Volume %s created", vol.Name)
+	return nil
+}
+
+// volumeExists reports whether a volume exists, bounded by podmanTimeout
+func volumeExists(conn context.Context, name string) (bool, error) {
+	var exists bool
+	err := withPodman(conn, podmanTimeout(), "check volume "+name, func(ctx context.Context) error {
+		var err error
+		exists, err = volumes.Exists(ctx, name, nil)
+		return err
+	})
+	return exists, err
+}
+
+// removeVolume removes a volume which opted in to removal and is not used by any container
+func removeVolume(conn context.Context, vol *RawVolume) error {
+	if !vol.RemoveOnDelete {
+		logger.Infof("Preserving volume %s, set RemoveOnDelete to remove it with its file", vol.Name)
+		return nil
+	}
+	exists, err := volumeExists(conn, vol.Name)
+	if err != nil {
+		return utils.WrapErr(err, "Error checking for volume %s", vol.Name)
+	}
+	if !exists {
+		return nil
+	}
+	var users []entities.ListContainer
+	err = withPodman(conn, podmanTimeout(), "list containers", func(ctx context.Context) error {
+		var err error
+		users, err = containers.List(ctx, new(containers.ListOptions).WithAll(true).WithFilters(map[string][]string{"volume": {vol.Name}}))
+		return err
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error listing containers using volume %s", vol.Name)
+	}
+	if len(users) > 0 {
+		logger.Infof("Volume %s is in use by %d container(s), it will not be removed", vol.Name, len(users))
+		return nil
+	}
+	err = withPodman(conn, podmanTimeout(), "remove volume "+vol.Name, func(ctx context.Context) error {
+		return volumes.Remove(ctx, vol.Name, nil)
+	})
+	if err != nil {
+		return utils.WrapErr(err, "Error removing volume %s", vol.Name)
+	}
+	logger.Infof("Volume %s removed", vol.Name)
+	return nil
+}
+
+func rawVolumeFromBytes(b []byte) (*RawVolume, error) {
+	b = bytes.TrimSpace(b)
+	vol := RawVolume{}
+	if len(b) > 0 && b[0] == '{' {
+		if err := json.Unmarshal(b, &vol); err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to unmarshal json")
+		}
+	} else {
+		if err := yaml.Unmarshal(b, &vol); err != nil {
+			return nil, utils.WrapErrClass(utils.ErrValidation, err, "Unable to unmarshal yaml")
+		}
+	}
+	return &vol, nil
+}
+
+// rawVolumes returns the named volumes of the containers of a raw file as
+// volumes of the volume method, each is removed on delete when the file opts in
+func rawVolumes(raw *RawPod) []*RawVolume {
+	containers := []*RawPod{raw}
+	if raw.isPod() {
+		containers = containerRefs(raw.Containers)
+	}
+	var vols []*RawVolume
+	for _, c := range containers {
+		for _, v := range c.Volumes {
+			vols = append(vols, &RawVolume{
+				Name:           v.Name,
+				Driver:         v.Driver,
+				Options:        v.DriverOptions,
+				RemoveOnDelete: raw.RemoveVolumesOnDelete,
+			})
+		}
+	}
+	return vols
+}
+
+// ensureRawVolumes creates the named volumes of a raw file which do not exist yet
+func ensureRawVolumes(conn context.Context, raw *RawPod) error {
+	for _, vol := range rawVolumes(raw) {
+		if err := ensureVolume(conn, vol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRawVolumes removes the named volumes of a raw file removed from the
+// repository, when it set RemoveVolumesOnDelete and no container still uses them
+func (r *Raw) removeRawVolumes(conn context.Context, change *object.Change, prev *string) error {
+	if prev == nil {
+		return nil
+	}
+	raw, err := r.parsePrevRawPod([]byte(*prev), change.From.Name)
+	if err != nil {
+		return err
+	}
+	if !raw.RemoveVolumesOnDelete {
+		return nil
+	}
+	for _, vol := range rawVolumes(raw) {
+		if err := removeVolume(conn, vol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package engine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultWebhookPath = "/webhook"
+	// webhookMaxBody bounds the size of a webhook payload
+	webhookMaxBody = 10 << 20
+)
+
+// Webhook triggers an immediate run of the targets of a pushed repository,
+// served on the metricsAddress of the config. Scheduled polls still run.
+type Webhook struct {
+	// Path the webhook is served on, defaults to /webhook
+	Path string `mapstructure:"path"`
+	// Secret validates the X-Hub-Signature-256 header of GitHub or the
+	// X-Gitlab-Token header of GitLab
+	Secret string `mapstructure:"secret"`
+}
+
+// webhookPayload holds the fields of GitHub and GitLab push events which
+// identify the pushed repository and ref
+type webhookPayload struct {
+	Ref        string            `json:"ref"`
+	Repository webhookRepository `json:"repository"`
+	Project    webhookProject    `json:"project"`
+}
+
+// webhookRepository is the repository of a GitHub push event
+type webhookRepository struct {
+	CloneURL string `json:"clone_url"`
+	HTMLURL  string `json:"html_url"`
+	SSHURL   string `json:"ssh_url"`
+	GitURL   string `json:"git_url"`
+}
+
+// webhookProject is the project of a GitLab push event
+type webhookProject struct {
+	GitHTTPURL string `json:"git_http_url"`
+	GitSSHURL  string `json:"git_ssh_url"`
+	WebURL     string `json:"web_url"`
+}
+
+func (p *webhookPayload) urls() []string {
+	return []string{p.Repository.CloneURL, p.Repository.HTMLURL, p.Repository.SSHURL, p.Repository.GitURL,
+		p.Project.GitHTTPURL, p.Project.GitSSHURL, p.Project.WebURL}
+}
+
+// webhookPath is the path the webhook of a config is served on
+func (hook *Webhook) webhookPath() string {
+	if hook.Path == "" {
+		return defaultWebhookPath
+	}
+	return hook.Path
+}
+
+// webhookHandler validates a push event and runs the git methods of the
+// targets following the pushed repository. Each method run waits for
+// the method's scheduled poll, so webhooks and polls of a method never run
+// concurrently. The path and secret are those of the config currently loaded.
+func webhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := currentConfig()
+		hook := rc.webhook
+		if hook == nil || hook.Secret == "" || r.URL.Path != hook.webhookPath() {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "webhooks must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+		if err != nil {
+			http.Error(w, "unable to read payload", http.StatusBadRequest)
+			return
+		}
+		if !validWebhook(hook.Secret, r.Header, body) {
+			logger.Infof("Rejected webhook from %s with an invalid signature", r.RemoteAddr)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-GitHub-Event") == "ping" {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "unable to parse payload", http.StatusBadRequest)
+			return
+		}
+
+		if rc.fetchit == nil {
+			http.Error(w, "config is not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		var triggered []string
+		for _, t := range rc.targets {
+			if webhookMatches(t, r.URL.Query().Get("target"), &payload) {
+				trigger(t)
+				triggered = append(triggered, t.displayName())
+			}
+		}
+		if len(triggered) == 0 {
+			http.Error(w, "no target follows the pushed repository and ref", http.StatusNotFound)
+			return
+		}
+		logger.Infof("Webhook triggered targets %s", strings.Join(triggered, ", "))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, strings.Join(triggered, "\n"))
+	}
+}
+
+// validWebhook checks the GitHub HMAC signature or the GitLab token of a webhook
+func validWebhook(secret string, header http.Header, body []byte) bool {
+	if sig := header.Get("X-Hub-Signature-256"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(expected))
+	}
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+// webhookMatches reports whether a push event is for a target. A target named
+// by the target query parameter always matches, otherwise the target must
+// follow the pushed repository and, for branch targets, the pushed branch.
+func webhookMatches(t *Target, name string, payload *webhookPayload) bool {
+	if name != "" {
+		return t.displayName() == name
+	}
+	if t.url == "" {
+		return false
+	}
+	if t.branch != "" && t.tag == "" && t.revision == "" && strings.HasPrefix(payload.Ref, "refs/heads/") &&
+		payload.Ref != "refs/heads/"+t.branch {
+		return false
+	}
+	want := normalizeRepoURL(t.url)
+	for _, u := range payload.urls() {
+		if u != "" && normalizeRepoURL(u) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRepoURL reduces the https, ssh and scp-like forms of a repository
+// URL to host/path, e.g. git@github.com:org/repo.git becomes github.com/org/repo
+func normalizeRepoURL(u string) string {
+	u = strings.ToLower(strings.TrimSpace(u))
+	u = strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+		if at := strings.Index(u, "@"); at >= 0 && at < strings.Index(u+"/", "/") {
+			u = u[at+1:]
+		}
+		return u
+	}
+	if at := strings.Index(u, "@"); at >= 0 {
+		u = strings.Replace(u[at+1:], ":", "/", 1)
+	}
+	return u
+}
+
+// webhookRuns holds a queue of runs per target name, each served by a
+// goroutine until the config is reloaded
+var webhookRuns = struct {
+	sync.Mutex
+	queues map[string]chan struct{}
+}{queues: map[string]chan struct{}{}}
+
+// trigger queues a run of the git methods of a target, coalescing webhooks
+// which arrive while a run is queued so a burst of pushes runs the target at
+// most twice
+func trigger(t *Target) {
+	webhookRuns.Lock()
+	defer webhookRuns.Unlock()
+	name := t.displayName()
+	queue, ok := webhookRuns.queues[name]
+	if !ok {
+		queue = make(chan struct{}, 1)
+		webhookRuns.queues[name] = queue
+		go runTriggered(name, queue)
+	}
+	select {
+	case queue <- struct{}{}:
+	default:
+	}
+}
+
+// drainTriggered stops the goroutines of the queued runs when a config is
+// reloaded, a run in progress finishes and runs queued are dropped
+func drainTriggered() {
+	webhookRuns.Lock()
+	defer webhookRuns.Unlock()
+	for name, queue := range webhookRuns.queues {
+		// a closed channel still delivers its buffered run, drop it first
+		select {
+		case <-queue:
+		default:
+		}
+		close(queue)
+		delete(webhookRuns.queues, name)
+	}
+}
+
+// runTriggered runs the git methods of the target named name from the config
+// loaded when each run starts
+func runTriggered(name string, queue chan struct{}) {
+	for range queue {
+		rc := currentConfig()
+		if rc.fetchit == nil {
+			continue
+		}
+		for _, t := range rc.targets {
+			if t.displayName() != name {
+				continue
+			}
+			for _, m := range rc.methods[t] {
+				if gitMethod(m) {
+					reconcile(context.Background(), rc.fetchit.conn, m, 0)
+				}
+			}
+		}
+	}
+}
+
+// gitMethod reports whether a method applies the files of its target's
+// repository, unlike image watches, prunes and image loads
+func gitMethod(m Method) bool {
+	switch m.GetKind() {
+	case rawMethod, kubeMethod, ansibleMethod, filetransferMethod, systemdMethod, volumeMethod:
+		return m.GetTarget() != nil && m.GetTarget().url != ""
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	target := &Target{name: "web", url: "https://github.com/containers/fetchit", branch: "main"}
+	for _, tt := range []struct {
+		name    string
+		payload webhookPayload
+		want    bool
+	}{
+		{"", webhookPayload{Ref: "refs/heads/main", Repository: webhookRepository{SSHURL: "git@github.com:containers/fetchit.git"}}, true},
+		{"", webhookPayload{Ref: "refs/heads/dev", Repository: webhookRepository{CloneURL: "https://github.com/containers/fetchit.git"}}, false},
+		{"", webhookPayload{Ref: "refs/heads/main"}, false},
+		{"web", webhookPayload{}, true},
+		{"other", webhookPayload{}, false},
+	} {
+		if got := webhookMatches(target, tt.name, &tt.payload); got != tt.want {
+			t.Errorf("webhookMatches(%q, %+v) = %v, want %v", tt.name, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestValidWebhook(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main"}`)
+	github := http.Header{}
+	github.Set("X-Hub-Signature-256", "sha256=cfb5b7b07a5b3a7f6e0d92b6a1cd0f0e7d0fa3b7b1b4c7ad3e5b3d4ff2c9b4f2")
+	if validWebhook("secret", github, body) {
+		t.Errorf("Failed: webhook with a wrong GitHub signature validated")
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	github.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	if !validWebhook("secret", github, body) {
+		t.Errorf("Failed: webhook with a valid GitHub signature rejected")
+	}
+	gitlab := http.Header{}
+	gitlab.Set("X-Gitlab-Token", "secret")
+	if !validWebhook("secret", gitlab, body) || validWebhook("other", gitlab, body) || validWebhook("secret", http.Header{}, body) {
+		t.Errorf("Failed: GitLab token or unsigned webhook validated incorrectly")
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	saved, savedLogger := currentConfig(), logger
+	defer func() { running.Store(saved); logger = savedLogger }()
+	logger = zap.NewNop().Sugar()
+	f := &Fetchit{methodTargetScheds: map[Method]SchedInfo{}}
+	handler := webhookHandler()
+	post := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"ref": "refs/heads/main"}`))
+		req.Header.Set("X-Gitlab-Token", token)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	publishConfig(f, &FetchitConfig{Webhook: &Webhook{Secret: "old"}})
+	if code := post("/webhook", "new"); code != http.StatusUnauthorized {
+		t.Errorf("Failed: webhook with a wrong secret returned %d", code)
+	}
+	if code := post("/other", "old"); code != http.StatusNotFound {
+		t.Errorf("Failed: webhook on another path returned %d", code)
+	}
+	// A reload rotating the secret applies to the next request
+	publishConfig(f, &FetchitConfig{Webhook: &Webhook{Secret: "new"}})
+	if code := post("/webhook", "old"); code != http.StatusUnauthorized {
+		t.Errorf("Failed: webhook with the rotated secret returned %d", code)
+	}
+	if code := post("/webhook", "new"); code != http.StatusNotFound {
+		t.Errorf("Failed: webhook matching no target returned %d", code)
+	}
+	publishConfig(f, &FetchitConfig{})
+	if code := post("/webhook", "new"); code != http.StatusNotFound {
+		t.Errorf("Failed: removed webhook returned %d", code)
+	}
+}
+
+func TestGitMethod(t *testing.T) {
+	target := &Target{url: "https://github.com/containers/fetchit"}
+	if !gitMethod(&Raw{CommonMethod: CommonMethod{target: target}}) {
+		t.Errorf("Failed: raw method is not run by webhooks")
+	}
+	if gitMethod(newImageWatch(&Raw{CommonMethod: CommonMethod{target: target}})) {
+		t.Errorf("Failed: image watch is run by webhooks")
+	}
+}
+
+func TestDrainTriggered(t *testing.T) {
+	queue := make(chan struct{}, 1)
+	queue <- struct{}{}
+	webhookRuns.Lock()
+	webhookRuns.queues["web"] = queue
+	webhookRuns.Unlock()
+	drainTriggered()
+	// the run queued before the reload is dropped rather than delivered
+	for range queue {
+		t.Fatalf("Failed: a queued run was delivered after the queue was drained")
+	}
+	webhookRuns.Lock()
+	defer webhookRuns.Unlock()
+	if _, ok := webhookRuns.queues["web"]; ok {
+		t.Errorf("Failed: drained queue is still registered")
+	}
+}